@@ -125,6 +125,11 @@ func (mal *MmapAllocator) allocAt(offset int64, n int) ([]byte, error) {
 	return mal.mmArea[from : from+int64(n)], nil
 }
 
+//Offset 当前映射区在文件中的偏移量，其为系统页对齐的
+func (mal *MmapAllocator) Offset() int64 {
+	return mal.mmOff
+}
+
 //Size 当前映射区的大小
 func (mal *MmapAllocator) Size() int {
 	return len(mal.mmArea)
@@ -0,0 +1,242 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package lws
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"chainmaker.org/chainmaker/lws/dsl"
+	"chainmaker.org/chainmaker/lws/file"
+)
+
+const (
+	archiveCompressedExt = ".z" //压缩归档的文件在原文件名后追加的扩展名
+	archiveHeadSize      = 9    //压缩归档的文件头 压缩算法[1]|原文件大小[8]
+
+	maxArchivedSize = 1 << 32 //压缩归档的文件打开时解压到内存中，文件头记录的大小超出此值视为损坏
+)
+
+var (
+	ErrArchiveReadOnly = errors.New("archive is read-only")
+	ErrArchivedFile    = errors.New("invalid archived file")
+	ErrArchiveLogDir   = errors.New("archive directory is the log directory or inside it")
+)
+
+//Archiver 日志文件的归档器，清理时所有待清理的文件都归档成功后才会被删除，任一文件归档失败则本次不做清理
+type Archiver interface {
+	//Archive 归档名称为name的wal文件，r为文件的全部内容
+	Archive(name string, r io.Reader) error
+}
+
+//DirArchiver 将wal文件归档到磁盘目录中，可选择压缩，归档目录可以通过OpenArchive只读打开
+type DirArchiver struct {
+	dir string
+	ct  CompressionType
+}
+
+/*
+ @title: NewDirArchiver
+ @description: 创建归档到dir目录的归档器，文件写入并刷盘后才算归档成功
+ @param {string} dir 归档目录，不存在时创建
+ @param {CompressionType} ct 归档文件的压缩算法，CompressionNone时原样保存
+ @return {*DirArchiver} 归档器
+ @return {error} 压缩算法未注册时返回ErrCompressorNotExist
+*/
+func NewDirArchiver(dir string, ct CompressionType) (*DirArchiver, error) {
+	if ct != CompressionNone {
+		if _, err := getCompressor(ct); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	return &DirArchiver{
+		dir: dir,
+		ct:  ct,
+	}, nil
+}
+
+func (da *DirArchiver) Archive(name string, r io.Reader) error {
+	path := filepath.Join(da.dir, name)
+	if da.ct == CompressionNone {
+		return writeArchived(path, r)
+	}
+	c, err := getCompressor(da.ct)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, archiveHeadSize, archiveHeadSize+len(data)/2)
+	b[0] = byte(da.ct)
+	binary.BigEndian.PutUint64(b[1:], uint64(len(data)))
+	if b, err = c.Compress(b, data); err != nil {
+		return err
+	}
+	return writeArchived(path+archiveCompressedExt, bytes.NewReader(b))
+}
+
+//inDir 归档目录是否为dir或位于其中，归档的文件与原文件同名，归档到日志目录会覆盖待清理的文件，位于其中则会随日志目录被一起操作
+func (da *DirArchiver) inDir(dir string) bool {
+	a, err := filepath.Abs(da.dir)
+	if err != nil {
+		return false
+	}
+	b, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(b, a)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+//checkArchiver 拒绝归档到日志目录或其子目录的归档器
+func (l *Lws) checkArchiver(a Archiver) error {
+	if da, ok := a.(*DirArchiver); ok && da.inDir(l.path) {
+		return ErrArchiveLogDir
+	}
+	return nil
+}
+
+//writeArchived 先写入临时文件并刷盘，再重命名并同步目录，保证归档的文件是完整的
+func writeArchived(path string, r io.Reader) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+/*
+ @title: OpenArchive
+ @description: 只读打开DirArchiver的归档目录，可以像只读打开的日志一样按索引读取及迭代归档的日志条目
+ @param {string} dir 归档目录
+ @param {...Opt} opt 日志的参数配置，文件前缀、扩展名及加密器需与写入时一致
+ @return {*Lws} 只读的日志实例
+ @return {error} 错误信息
+*/
+func OpenArchive(dir string, opt ...Opt) (*Lws, error) {
+	l := newLws(&dsl.DSL{
+		Path: dir,
+	})
+	l.backend = archiveBackend{}
+	l.readOnly = true
+	if err := l.open(opt...); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+//archiveBackend 归档目录的只读存储后端，压缩归档的文件在打开时解压到内存中
+type archiveBackend struct{}
+
+func (ab archiveBackend) Create(path string) (LwsFile, error) {
+	return ab.Open(path)
+}
+
+func (archiveBackend) Open(path string) (LwsFile, error) {
+	if _, err := os.Stat(path); err == nil {
+		f, err := file.OpenFile(path, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	b, err := os.ReadFile(path + archiveCompressedExt)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < archiveHeadSize {
+		return nil, ErrArchivedFile
+	}
+	c, err := getCompressor(CompressionType(b[0]))
+	if err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint64(b[1:])
+	if size > maxArchivedSize {
+		return nil, ErrArchivedFile
+	}
+	data, err := c.Decompress(make([]byte, 0, size), b[archiveHeadSize:])
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)) != size {
+		return nil, ErrArchivedFile
+	}
+	return file.NewMemFile(data), nil
+}
+
+//Stat 压缩归档的文件返回其原文件的大小
+func (archiveBackend) Stat(path string) (int64, error) {
+	if info, err := os.Stat(path); err == nil {
+		return info.Size(), nil
+	}
+	f, err := os.Open(path + archiveCompressedExt)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var head [archiveHeadSize]byte
+	if _, err = io.ReadFull(f, head[:]); err != nil {
+		return 0, ErrArchivedFile
+	}
+	size := binary.BigEndian.Uint64(head[1:])
+	if size > maxArchivedSize {
+		return 0, ErrArchivedFile
+	}
+	return int64(size), nil
+}
+
+//List 压缩归档的文件以原文件名返回
+func (archiveBackend) List(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, strings.TrimSuffix(e.Name(), archiveCompressedExt))
+		}
+	}
+	return names, nil
+}
+
+func (archiveBackend) Remove(path string) error {
+	return ErrArchiveReadOnly
+}
+
+func (archiveBackend) Rename(oldPath, newPath string) error {
+	return ErrArchiveReadOnly
+}
@@ -0,0 +1,50 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package lws
+
+import "errors"
+
+var (
+	ErrEmptyBatch = errors.New("batch has no entries")
+)
+
+//Batch 批量写入的日志条目集合，通过Lws.WriteBatch整体写入，恢复时要么整批可见，要么整批不可见
+type Batch struct {
+	entries []batchEntry
+}
+
+type batchEntry struct {
+	typ int8
+	obj interface{}
+}
+
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+//Add 向批量中添加typ类型的obj对象，obj在写入时通过注册的Coder进行序列化
+func (b *Batch) Add(typ int8, obj interface{}) {
+	b.entries = append(b.entries, batchEntry{
+		typ: typ,
+		obj: obj,
+	})
+}
+
+//AddBytes 向批量中添加字节流
+func (b *Batch) AddBytes(data []byte) {
+	b.Add(RawCoderType, data)
+}
+
+//Len 批量中日志条目的数量
+func (b *Batch) Len() int {
+	return len(b.entries)
+}
+
+//Reset 清空批量，以便复用
+func (b *Batch) Reset() {
+	b.entries = b.entries[:0]
+}
@@ -28,7 +28,7 @@ type ReaderCache struct {
 type refReader struct {
 	*SegmentReader
 	ref        int32
-	lastAccess time.Time
+	lastAccess int64 //最近访问的时间(UnixNano)，读取时与淘汰协程并发访问，故使用原子操作
 }
 
 //GetReader 通过段ID获取reader，不存在则返回nil
@@ -120,8 +120,8 @@ func (rc *ReaderCache) evict() {
 		rc.rw.Lock()
 		defer rc.rw.Unlock()
 		for id, v := range rc.readers {
-			if v.ref == 0 && t.After(v.lastAccess) {
-				t = v.lastAccess
+			if atomic.LoadInt32(&v.ref) == 0 && t.After(v.accessTime()) {
+				t = v.accessTime()
 				segmentID = id
 			}
 		}
@@ -139,7 +139,7 @@ func (rc *ReaderCache) evict() {
 			return
 		}
 		//检测reader是否超时，如若超时，则进行删除
-		if rd.ref == 0 && time.Now().Sub(rd.lastAccess) >= evictInterval {
+		if atomic.LoadInt32(&rd.ref) == 0 && time.Now().Sub(rd.accessTime()) >= evictInterval {
 			delete(rc.readers, id)
 		}
 	}
@@ -170,7 +170,11 @@ func (rr *refReader) Release() {
 }
 
 func (rr *refReader) access() {
-	rr.lastAccess = time.Now()
+	atomic.StoreInt64(&rr.lastAccess, time.Now().UnixNano())
+}
+
+func (rr *refReader) accessTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&rr.lastAccess))
 }
 
 func (rr *refReader) ReadLogByIndex(index uint64) (*LogEntry, error) {
@@ -0,0 +1,130 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package lws
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"math/bits"
+)
+
+//ChecksumType 日志条目的校验算法，记录在段头中，读取时根据段头选择校验算法，故不同算法写入的文件可以混合存在
+type ChecksumType uint8
+
+const (
+	ChecksumIEEE       ChecksumType = 1 //IEEE多项式的crc32，没有段头的老版本文件使用此算法
+	ChecksumCastagnoli ChecksumType = 2 //Castagnoli多项式的crc32(crc32c)，支持硬件加速
+	ChecksumXXH64      ChecksumType = 3 //64位的xxHash，用于长期保存的日志
+	ChecksumNone       ChecksumType = 4 //不进行校验，只能通过条目长度检测损坏
+)
+
+//checksumer 日志条目的校验器，校验值按照Size的长度写入条目中
+type checksumer interface {
+	Size() int
+	Sum(data []byte) uint64
+}
+
+func newChecksumer(ct ChecksumType) checksumer {
+	switch ct {
+	case ChecksumIEEE:
+		return newCrc32er(crc32.IEEE)
+	case ChecksumCastagnoli:
+		return newCrc32er(crc32.Castagnoli)
+	case ChecksumXXH64:
+		return xxh64er{}
+	case ChecksumNone:
+		return noneChecksumer{}
+	default:
+		return nil
+	}
+}
+
+type xxh64er struct{}
+
+func (xxh64er) Size() int {
+	return 8
+}
+
+func (xxh64er) Sum(data []byte) uint64 {
+	return xxh64(data)
+}
+
+type noneChecksumer struct{}
+
+func (noneChecksumer) Size() int {
+	return 0
+}
+
+func (noneChecksumer) Sum(data []byte) uint64 {
+	return 0
+}
+
+//xxHash64的素数，声明为变量以便种子计算时按uint64回绕
+var (
+	xxhPrime1 uint64 = 11400714785074694791
+	xxhPrime2 uint64 = 14029467366897019727
+	xxhPrime3 uint64 = 1609587929392839161
+	xxhPrime4 uint64 = 9650029242287828579
+	xxhPrime5 uint64 = 2870177450012600261
+)
+
+//xxh64 seed为0的xxHash64
+func xxh64(b []byte) uint64 {
+	n := len(b)
+	var h uint64
+	if n >= 32 {
+		v1 := xxhPrime1 + xxhPrime2
+		v2 := xxhPrime2
+		v3 := uint64(0)
+		v4 := -xxhPrime1
+		for ; len(b) >= 32; b = b[32:] {
+			v1 = xxhRound(v1, binary.LittleEndian.Uint64(b[0:]))
+			v2 = xxhRound(v2, binary.LittleEndian.Uint64(b[8:]))
+			v3 = xxhRound(v3, binary.LittleEndian.Uint64(b[16:]))
+			v4 = xxhRound(v4, binary.LittleEndian.Uint64(b[24:]))
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxhMergeRound(h, v1)
+		h = xxhMergeRound(h, v2)
+		h = xxhMergeRound(h, v3)
+		h = xxhMergeRound(h, v4)
+	} else {
+		h = xxhPrime5
+	}
+	h += uint64(n)
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxhRound(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*xxhPrime1 + xxhPrime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * xxhPrime1
+		h = bits.RotateLeft64(h, 23)*xxhPrime2 + xxhPrime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * xxhPrime5
+		h = bits.RotateLeft64(h, 11) * xxhPrime1
+	}
+	h ^= h >> 33
+	h *= xxhPrime2
+	h ^= h >> 29
+	h *= xxhPrime3
+	h ^= h >> 32
+	return h
+}
+
+func xxhRound(acc, input uint64) uint64 {
+	acc += input * xxhPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxhPrime1
+}
+
+func xxhMergeRound(acc, val uint64) uint64 {
+	val = xxhRound(0, val)
+	acc ^= val
+	return acc*xxhPrime1 + xxhPrime4
+}
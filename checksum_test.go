@@ -0,0 +1,81 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package lws
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestXXH64(t *testing.T) {
+	cases := []struct {
+		in  string
+		sum uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"a", 0xd24ec4f1a98c6e5b},
+		{"abc", 0x44bc2cf5ad770999},
+		{"Nobody inspects the spammish repetition", 0xfbcea83c8a378bf1},
+	}
+	for _, c := range cases {
+		require.Equal(t, c.sum, xxh64([]byte(c.in)), c.in)
+	}
+}
+
+func BenchmarkChecksum(b *testing.B) {
+	for _, size := range []int{128, 4 << 10, 64 << 10} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		for _, ct := range []struct {
+			name string
+			ct   ChecksumType
+		}{
+			{"IEEE", ChecksumIEEE},
+			{"Castagnoli", ChecksumCastagnoli},
+			{"XXH64", ChecksumXXH64},
+			{"None", ChecksumNone},
+		} {
+			summer := newChecksumer(ct.ct)
+			b.Run(fmt.Sprintf("%s/%d", ct.name, size), func(b *testing.B) {
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					summer.Sum(data)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkLws_WriteChecksum(b *testing.B) {
+	data := make([]byte, 1<<10)
+	for _, ct := range []struct {
+		name string
+		ct   ChecksumType
+	}{
+		{"IEEE", ChecksumIEEE},
+		{"Castagnoli", ChecksumCastagnoli},
+		{"XXH64", ChecksumXXH64},
+		{"None", ChecksumNone},
+	} {
+		b.Run(ct.name, func(b *testing.B) {
+			l, err := Open(b.TempDir(), WithFilePrex("bench_"), WithChecksum(ct.ct), WithWriteFlag(WF_TIMEDFLUSH, 0))
+			require.Nil(b, err)
+			defer l.Close()
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err = l.WriteBytes(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
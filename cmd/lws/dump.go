@@ -0,0 +1,205 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"chainmaker.org/chainmaker/lws"
+)
+
+const (
+	encodingBase64 = "base64"
+	encodingHex    = "hex"
+)
+
+//record 导出的一个日志条目，json格式下每行一个
+type record struct {
+	Index    uint64 `json:"index"`
+	Type     int8   `json:"type"`
+	Crc      uint64 `json:"crc"`      //条目在文件中的校验值，由文件的校验算法对写入的数据计算
+	Length   int    `json:"length"`   //数据的长度
+	Encoding string `json:"encoding"` //数据的编码方式，base64或hex
+	Data     string `json:"data"`
+}
+
+//dumpCommand 导出[from, to]范围内的日志条目，指定-file时导出通过WriteToFile写入的特定文件
+func dumpCommand(fs *flag.FlagSet) runner {
+	var (
+		from     = fs.Uint64("from", 0, "first index to dump, defaults to the first index of the log")
+		to       = fs.Uint64("to", 0, "last index to dump, defaults to the last index of the log")
+		format   = fs.String("format", "json", "output format: json (one entry per line) or raw (data only)")
+		encoding = fs.String("data", encodingBase64, "data encoding of json output: base64 or hex")
+		file     = fs.String("file", "", "dump the side file written by WriteToFile instead of the wal files")
+		typ      *int8
+	)
+	fs.Func("type", "only dump entries of this type", func(s string) error {
+		t, err := strconv.ParseInt(s, 10, 8)
+		if err != nil {
+			return err
+		}
+		typ = new(int8)
+		*typ = int8(t)
+		return nil
+	})
+	return func(dir string, opts []lws.Opt, _ io.Reader, out io.Writer) error {
+		if *format != "json" && *format != "raw" {
+			return fmt.Errorf("unknown format %q", *format)
+		}
+		if *encoding != encodingBase64 && *encoding != encodingHex {
+			return fmt.Errorf("unknown data encoding %q", *encoding)
+		}
+		l, err := lws.OpenReadOnly(dir, opts...)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		it, err := entryIterator(l, *file)
+		if err != nil {
+			return err
+		}
+		defer it.Release()
+		if *from > 0 {
+			if err = it.Seek(*from); err != nil {
+				return err
+			}
+		}
+		var (
+			w   = bufio.NewWriter(out)
+			enc = json.NewEncoder(w)
+		)
+		for it.HasNext() {
+			ele := it.Next()
+			if *to > 0 && ele.Index() > *to {
+				break
+			}
+			le, err := ele.GetEntry()
+			if err != nil {
+				return fmt.Errorf("index %d: %w", ele.Index(), err)
+			}
+			if typ != nil && le.Typ != *typ {
+				continue
+			}
+			if *format == "raw" {
+				_, err = w.Write(le.Data)
+			} else {
+				err = enc.Encode(&record{
+					Index:    ele.Index(),
+					Type:     le.Typ,
+					Crc:      le.Sum,
+					Length:   len(le.Data),
+					Encoding: *encoding,
+					Data:     encodeData(*encoding, le.Data),
+				})
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return w.Flush()
+	}
+}
+
+//entryIterator 生成日志的迭代器，file不为空时迭代特定文件中的条目，其索引从1开始
+func entryIterator(l *lws.Lws, file string) (*lws.EntryIterator, error) {
+	if file != "" {
+		return l.ReadFromFile(file)
+	}
+	return l.NewLogIterator(), nil
+}
+
+//importCommand 将json格式导出的日志条目依次追加写入日志，指定-file时写入特定文件
+//写入日志时条目的索引需紧接日志的最新索引，指定-renumber时忽略导出的索引
+func importCommand(fs *flag.FlagSet) runner {
+	var (
+		input    = fs.String("in", "-", "json lines dump to import, - for stdin")
+		renumber = fs.Bool("renumber", false, "append entries regardless of their dumped index")
+		file     = fs.String("file", "", "import into a side file read by ReadFromFile instead of the wal files")
+	)
+	return func(dir string, opts []lws.Opt, in io.Reader, out io.Writer) error {
+		if *input != "-" {
+			f, err := os.Open(*input)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+		l, err := lws.Open(dir, opts...)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		var (
+			dec     = json.NewDecoder(bufio.NewReader(in))
+			entries []*lws.LogEntry
+			count   int
+		)
+		for {
+			var r record
+			if err = dec.Decode(&r); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			data, err := decodeData(r.Encoding, r.Data)
+			if err != nil {
+				return fmt.Errorf("index %d: %w", r.Index, err)
+			}
+			if len(data) != r.Length {
+				return fmt.Errorf("index %d: data length %d does not match %d", r.Index, len(data), r.Length)
+			}
+			count++
+			if *file != "" {
+				entries = append(entries, &lws.LogEntry{Typ: r.Type, Data: data})
+				continue
+			}
+			if !*renumber && r.Index != l.LastIndex()+1 {
+				return fmt.Errorf("index %d does not follow the last index %d of the log, use -renumber to ignore it", r.Index, l.LastIndex())
+			}
+			if _, err = l.WriteEntry(r.Type, data); err != nil {
+				return fmt.Errorf("index %d: %w", r.Index, err)
+			}
+		}
+		if *file != "" {
+			err = l.WriteEntriesToFile(*file, entries)
+		} else {
+			err = l.Flush()
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%d entries imported\n", count)
+		return nil
+	}
+}
+
+func encodeData(encoding string, data []byte) string {
+	if encoding == encodingHex {
+		return hex.EncodeToString(data)
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func decodeData(encoding, s string) ([]byte, error) {
+	switch encoding {
+	case encodingBase64, "":
+		return base64.StdEncoding.DecodeString(s)
+	case encodingHex:
+		return hex.DecodeString(s)
+	}
+	return nil, errors.New("unknown data encoding " + strconv.Quote(encoding))
+}
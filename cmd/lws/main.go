@@ -0,0 +1,309 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+//lws 日志目录的离线检查及修复工具
+//	lws verify [-prefix p] [-ext e] dir   校验所有wal文件中的日志条目及文件之间的索引连续性
+//	lws repair [-prefix p] [-ext e] dir   截断最新文件尾部的损坏数据，将最早的损坏的已封存文件移动到quarantine目录
+//	lws stat   [-prefix p] [-ext e] dir   打印每个wal文件的编号、索引范围、大小及条目数
+//	lws dump   [-prefix p] [-ext e] [-from n] [-to n] [-type t] [-format json|raw] [-data base64|hex] [-file name] dir
+//	                                      导出日志条目，json格式每行一个条目
+//	lws import [-prefix p] [-ext e] [-in dump] [-renumber] [-file name] dir
+//	                                      将json格式导出的日志条目追加写入日志
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"chainmaker.org/chainmaker/lws"
+)
+
+var errIssues = errors.New("issues found")
+
+//runner 子命令的执行函数，dir为日志目录，opts为根据公共参数生成的配置项
+type runner func(dir string, opts []lws.Opt, in io.Reader, out io.Writer) error
+
+type command struct {
+	name  string
+	usage string
+	setup func(fs *flag.FlagSet) runner //注册子命令特有的参数，返回其执行函数
+}
+
+var commands = []*command{
+	{"verify", "verify all segments and report corrupted entries and index gaps", noFlags(verify)},
+	{"repair", "truncate the torn tail of the last segment and quarantine broken leading sealed segments", noFlags(repair)},
+	{"stat", "print id, index range, size and entry count of each segment", noFlags(stat)},
+	{"dump", "export entries as json lines or raw data", dumpCommand},
+	{"import", "append entries from a json lines dump to the log", importCommand},
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func noFlags(r runner) func(*flag.FlagSet) runner {
+	return func(*flag.FlagSet) runner {
+		return r
+	}
+}
+
+//run 执行子命令，返回进程的退出码，0为成功，1为检测到问题或执行出错，2为参数错误
+func run(args []string, in io.Reader, out, errOut io.Writer) int {
+	if len(args) == 0 {
+		usage(errOut)
+		return 2
+	}
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(errOut, "unknown command %q\n", args[0])
+		usage(errOut)
+		return 2
+	}
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.SetOutput(errOut)
+	prefix := fs.String("prefix", "", "wal file name prefix (FilePrefix)")
+	ext := fs.String("ext", "wal", "wal file extension (FileExtension)")
+	r := cmd.setup(fs)
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintf(errOut, "usage: lws %s [flags] dir\n", cmd.name)
+		fs.PrintDefaults()
+		return 2
+	}
+	opts := []lws.Opt{lws.WithFilePrex(*prefix), lws.WithFileExtension(*ext)}
+	if err := r(fs.Arg(0), opts, in, out); err != nil {
+		if !errors.Is(err, errIssues) {
+			fmt.Fprintf(errOut, "lws %s: %s\n", cmd.name, err)
+		}
+		return 1
+	}
+	return 0
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: lws <command> [flags] dir")
+	fmt.Fprintln(w, "commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-8s %s\n", cmd.name, cmd.usage)
+	}
+}
+
+//verify 逐个打开wal文件并遍历校验所有日志条目，同时检查相邻文件的索引是否连续，有问题时返回errIssues
+//校验期间持有日志目录的读锁，日志被写入实例打开时返回错误
+func verify(dir string, opts []lws.Opt, _ io.Reader, out io.Writer) error {
+	locker, err := lockDir(dir, opts, true)
+	if err != nil {
+		return err
+	}
+	defer locker.Unlock()
+	segs, err := lws.ListSegments(dir, opts...)
+	if err != nil {
+		return err
+	}
+	var (
+		issues int
+		next   uint64 //上一个文件之后的下一个索引，为0表示未知
+	)
+	for _, s := range segs {
+		if next != 0 && s.Index != next {
+			fmt.Fprintf(out, "segment %d: index gap, expected first index %d, got %d\n", s.ID, next, s.Index)
+			issues++
+		}
+		next = 0
+		sr, err := lws.NewSegmentReader(s, lws.FT_NORMAL)
+		if err != nil {
+			fmt.Fprintf(out, "segment %d: open %s: %s\n", s.ID, s.Path, err)
+			issues++
+			continue
+		}
+		report, err := sr.Verify()
+		if err == nil {
+			next = sr.LastIndex() + 1
+		}
+		sr.Close()
+		switch {
+		case err != nil:
+			fmt.Fprintf(out, "segment %d: verify %s: %s\n", s.ID, s.Path, err)
+			issues++
+		case report != nil:
+			fmt.Fprintf(out, "segment %d: corrupted at offset %d, %d bytes after the last valid entry\n", s.ID, report.Offset, report.Discarded)
+			issues++
+		}
+	}
+	fmt.Fprintf(out, "%d segments, %d issues\n", len(segs), issues)
+	if issues > 0 {
+		return errIssues
+	}
+	return nil
+}
+
+//repair 截断最新文件尾部的损坏数据，已封存的文件损坏时整体移动到quarantine目录
+//只有位于日志开头的文件可以被移动，中间的文件被移动后会导致索引不连续，此时只报告问题并返回errIssues
+//修复期间持有日志目录的写锁，日志被其他进程打开时返回错误
+func repair(dir string, opts []lws.Opt, _ io.Reader, out io.Writer) error {
+	locker, err := lockDir(dir, opts, false)
+	if err != nil {
+		return err
+	}
+	defer locker.Unlock()
+	segs, err := lws.ListSegments(dir, opts...)
+	if err != nil {
+		return err
+	}
+	var (
+		repaired, unrepaired int
+		kept                 bool //是否已有保留的文件，之后的损坏文件不能被移动
+	)
+	for i, s := range segs {
+		if i == len(segs)-1 {
+			//最新的文件由写入者按照TruncateTail策略打开，关闭时截断到最后一个完整条目之后
+			sw, err := lws.NewSegmentWriter(s, lws.WriterOptions{
+				SegmentSize: s.Size,
+				Ft:          lws.FT_NORMAL,
+				Wf:          lws.WF_SYNCFLUSH,
+				Recovery:    lws.TruncateTail,
+			})
+			if err != nil {
+				return err
+			}
+			report := sw.RecoveryReport()
+			if err = sw.Close(); err != nil {
+				return err
+			}
+			if report != nil {
+				fmt.Fprintf(out, "segment %d: truncated at offset %d, %d bytes discarded\n", s.ID, report.Offset, report.Discarded)
+				repaired++
+			}
+			break
+		}
+		broken, err := segmentBroken(s)
+		if err != nil {
+			return err
+		}
+		if !broken {
+			kept = true
+			continue
+		}
+		if kept {
+			fmt.Fprintf(out, "segment %d: corrupted, not quarantined since it would leave an index gap\n", s.ID)
+			unrepaired++
+			continue
+		}
+		dst, err := lws.MoveToQuarantine(s)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "segment %d: moved to %s\n", s.ID, dst)
+		repaired++
+	}
+	fmt.Fprintf(out, "%d segments, %d repaired, %d unrepaired\n", len(segs), repaired, unrepaired)
+	if unrepaired > 0 {
+		return errIssues
+	}
+	return nil
+}
+
+//segmentBroken 检测已封存的文件是否无法打开或者存在损坏的数据
+func segmentBroken(s *lws.Segment) (bool, error) {
+	sr, err := lws.NewSegmentReader(s, lws.FT_NORMAL)
+	if err != nil {
+		return !errors.Is(err, os.ErrNotExist), nil
+	}
+	defer sr.Close()
+	report, err := sr.Verify()
+	if err != nil {
+		return false, err
+	}
+	return report != nil, nil
+}
+
+//stat 打印每个wal文件的编号、索引范围、条目数、大小及段头信息，期间持有日志目录的读锁
+func stat(dir string, opts []lws.Opt, _ io.Reader, out io.Writer) error {
+	locker, err := lockDir(dir, opts, true)
+	if err != nil {
+		return err
+	}
+	defer locker.Unlock()
+	segs, err := lws.ListSegments(dir, opts...)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tFIRST\tLAST\tENTRIES\tSIZE\tVERSION\tCHECKSUM\tFILE")
+	for _, s := range segs {
+		sr, err := lws.NewSegmentReader(s, lws.FT_NORMAL)
+		if err != nil {
+			fmt.Fprintf(tw, "%d\t%d\t-\t-\t%d\t-\t-\t%s (%s)\n", s.ID, s.Index, s.Size, filepath.Base(s.Path), err)
+			continue
+		}
+		var (
+			version  = "v0"
+			checksum = checksumName(lws.ChecksumIEEE)
+			count    = sr.LastIndex() + 1 - sr.FirstIndex()
+		)
+		if h := sr.Header(); h != nil {
+			version = fmt.Sprintf("v%d", h.Version)
+			checksum = checksumName(h.Checksum)
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%d\t%s\t%s\t%s\n", s.ID, sr.FirstIndex(), sr.LastIndex(), count, s.Size, version, checksum, filepath.Base(s.Path))
+		sr.Close()
+	}
+	return tw.Flush()
+}
+
+func checksumName(ct lws.ChecksumType) string {
+	switch ct {
+	case lws.ChecksumIEEE:
+		return "crc32"
+	case lws.ChecksumCastagnoli:
+		return "crc32c"
+	case lws.ChecksumXXH64:
+		return "xxh64"
+	case lws.ChecksumNone:
+		return "none"
+	}
+	return fmt.Sprintf("unknown(%d)", ct)
+}
+
+//lockDir 对日志目录加锁，shared为true时加读锁，与写入实例使用同一个锁文件
+func lockDir(dir string, opts []lws.Opt, shared bool) (*lws.FileLock, error) {
+	o := lwsOptions(opts)
+	locker := lws.NewFileLocker(filepath.Join(dir, o.FilePrefix+lws.LockFileName))
+	lock := locker.Lock
+	if shared {
+		lock = locker.RLock
+	}
+	if err := lock(); err != nil {
+		return nil, err
+	}
+	return locker, nil
+}
+
+//lwsOptions 根据命令行参数生成的配置项
+func lwsOptions(opts []lws.Opt) lws.Options {
+	var o lws.Options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
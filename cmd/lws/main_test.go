@@ -0,0 +1,154 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"chainmaker.org/chainmaker/lws"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCmd_VerifyRepairStat(t *testing.T) {
+	dir := t.TempDir()
+	l, err := lws.Open(dir, lws.WithFilePrex("test_"), lws.WithSegmentSize(200), lws.WithWriteFlag(lws.WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	for i := 1; i <= 30; i++ {
+		_, err = l.WriteBytes([]byte(fmt.Sprintf("entry_%d", i)))
+		require.Nil(t, err)
+	}
+	l.Close()
+	segs, err := lws.ListSegments(dir, lws.WithFilePrex("test_"))
+	require.Nil(t, err)
+	require.True(t, len(segs) > 2)
+
+	var out, errOut bytes.Buffer
+	require.Equal(t, 0, run([]string{"verify", "-prefix", "test_", dir}, nil, &out, &errOut), errOut.String())
+	out.Reset()
+	require.Equal(t, 0, run([]string{"stat", "-prefix", "test_", dir}, nil, &out, &errOut), errOut.String())
+	require.Equal(t, len(segs)+1, strings.Count(out.String(), "\n"))
+
+	//损坏第一个文件中的日志条目，并在最新文件的尾部追加残缺的数据
+	raw, err := os.ReadFile(segs[0].Path)
+	require.Nil(t, err)
+	raw[len(raw)-1] ^= 0xff
+	require.Nil(t, os.WriteFile(segs[0].Path, raw, 0644))
+	last := segs[len(segs)-1]
+	f, err := os.OpenFile(last.Path, os.O_APPEND|os.O_WRONLY, 0644)
+	require.Nil(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 9, 1, 2})
+	require.Nil(t, err)
+	f.Close()
+
+	out.Reset()
+	require.Equal(t, 1, run([]string{"verify", "-prefix", "test_", dir}, nil, &out, &errOut))
+	require.Contains(t, out.String(), fmt.Sprintf("segment %d: corrupted", segs[0].ID))
+	require.Contains(t, out.String(), fmt.Sprintf("segment %d: corrupted", last.ID))
+
+	out.Reset()
+	require.Equal(t, 0, run([]string{"repair", "-prefix", "test_", dir}, nil, &out, &errOut), errOut.String())
+	require.Contains(t, out.String(), "2 repaired")
+	_, err = os.Stat(segs[0].Path)
+	require.True(t, os.IsNotExist(err))
+
+	//隔离的文件不再被匹配，文件之间剩余的索引仍然连续
+	out.Reset()
+	require.Equal(t, 0, run([]string{"verify", "-prefix", "test_", dir}, nil, &out, &errOut), out.String())
+	require.Equal(t, 2, run([]string{"stat", dir, "extra"}, nil, &out, &errOut))
+	require.Equal(t, 2, run([]string{"unknown"}, nil, &out, &errOut))
+}
+
+func TestCmd_RepairGap(t *testing.T) {
+	dir := t.TempDir()
+	l, err := lws.Open(dir, lws.WithFilePrex("test_"), lws.WithSegmentSize(200), lws.WithWriteFlag(lws.WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	for i := 1; i <= 30; i++ {
+		_, err = l.WriteBytes([]byte(fmt.Sprintf("entry_%d", i)))
+		require.Nil(t, err)
+	}
+	//日志被写入实例打开时，检查工具无法获取读锁
+	var out, errOut bytes.Buffer
+	require.Equal(t, 1, run([]string{"verify", "-prefix", "test_", dir}, nil, &out, &errOut))
+	require.Equal(t, 1, run([]string{"stat", "-prefix", "test_", dir}, nil, &out, &errOut))
+	require.Contains(t, errOut.String(), lws.ErrLocked.Error())
+	l.Close()
+	segs, err := lws.ListSegments(dir, lws.WithFilePrex("test_"))
+	require.Nil(t, err)
+	require.True(t, len(segs) > 3)
+
+	//损坏中间的文件，移动后会导致索引不连续，故不进行移动
+	raw, err := os.ReadFile(segs[1].Path)
+	require.Nil(t, err)
+	raw[len(raw)-1] ^= 0xff
+	require.Nil(t, os.WriteFile(segs[1].Path, raw, 0644))
+	out.Reset()
+	require.Equal(t, 1, run([]string{"repair", "-prefix", "test_", dir}, nil, &out, &errOut))
+	require.Contains(t, out.String(), fmt.Sprintf("segment %d: corrupted, not quarantined", segs[1].ID))
+	_, err = os.Stat(segs[1].Path)
+	require.Nil(t, err)
+
+	//手动移动后，verify报告索引不连续
+	_, err = lws.MoveToQuarantine(segs[1])
+	require.Nil(t, err)
+	out.Reset()
+	require.Equal(t, 1, run([]string{"verify", "-prefix", "test_", dir}, nil, &out, &errOut))
+	require.Contains(t, out.String(), fmt.Sprintf("segment %d: index gap", segs[2].ID))
+}
+
+func TestCmd_DumpImport(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	l, err := lws.Open(src, lws.WithFilePrex("test_"), lws.WithSegmentSize(200))
+	require.Nil(t, err)
+	for i := 1; i <= 20; i++ {
+		_, err = l.WriteEntry(int8(i%2), []byte(fmt.Sprintf("entry_%d", i)))
+		require.Nil(t, err)
+	}
+	require.Nil(t, l.WriteEntriesToFile("side.log", []*lws.LogEntry{{Typ: 1, Data: []byte("side")}}))
+	l.Close()
+
+	var out, errOut bytes.Buffer
+	require.Equal(t, 0, run([]string{"dump", "-prefix", "test_", "-from", "3", "-to", "8", "-type", "1", "-data", "hex", src}, nil, &out, &errOut), errOut.String())
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Equal(t, 3, len(lines))
+	require.Contains(t, lines[0], `"index":3,"type":1`)
+	require.Contains(t, lines[0], fmt.Sprintf(`"data":"%x"`, "entry_3"))
+
+	out.Reset()
+	require.Equal(t, 0, run([]string{"dump", "-prefix", "test_", "-format", "raw", "-from", "20", src}, nil, &out, &errOut), errOut.String())
+	require.Equal(t, "entry_20", out.String())
+
+	//全量导出后导入到新的目录中，条目的索引、类型及数据保持一致
+	out.Reset()
+	require.Equal(t, 0, run([]string{"dump", "-prefix", "test_", src}, nil, &out, &errOut), errOut.String())
+	dump := out.String()
+	out.Reset()
+	require.Equal(t, 0, run([]string{"import", "-prefix", "test_", dst}, strings.NewReader(dump), &out, &errOut), errOut.String())
+	require.Contains(t, out.String(), "20 entries imported")
+	l, err = lws.OpenReadOnly(dst, lws.WithFilePrex("test_"))
+	require.Nil(t, err)
+	require.Equal(t, uint64(20), l.LastIndex())
+	le, err := l.ReadEntry(7)
+	require.Nil(t, err)
+	require.Equal(t, int8(1), le.Typ)
+	require.Equal(t, "entry_7", string(le.Data))
+	l.Close()
+	//索引不连续时拒绝导入
+	require.Equal(t, 1, run([]string{"import", "-prefix", "test_", dst}, strings.NewReader(dump), &out, &errOut))
+
+	//特定文件通过ReadFromFile导出，通过WriteEntriesToFile导入
+	out.Reset()
+	require.Equal(t, 0, run([]string{"dump", "-prefix", "test_", "-file", "side.log", src}, nil, &out, &errOut), errOut.String())
+	side := out.String()
+	require.Equal(t, 0, run([]string{"import", "-prefix", "test_", "-file", "side.log", dst}, strings.NewReader(side), &out, &errOut), errOut.String())
+	out.Reset()
+	require.Equal(t, 0, run([]string{"dump", "-prefix", "test_", "-file", "side.log", dst}, nil, &out, &errOut), errOut.String())
+	require.Equal(t, side, out.String())
+}
@@ -0,0 +1,178 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package lws
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+)
+
+//CompressionType 日志条目的压缩算法，记录在每个压缩条目中，故压缩与未压缩的条目可以混合存在
+type CompressionType uint8
+
+const (
+	CompressionNone CompressionType = 0
+	CompressionGzip CompressionType = 1 //标准库实现的gzip，无需额外依赖
+)
+
+const (
+	compressedType     int8 = -2 //压缩条目的类型，数据为 压缩算法[1]|原始类型[1]|压缩后的数据
+	compressHeaderSize      = 2
+)
+
+var (
+	compressMinSize = 128 //小于此长度的条目不进行压缩
+
+	ErrCompressorExist    = errors.New("this type compressor has exist")
+	ErrCompressorNotExist = errors.New("this type compressor not exist")
+	ErrCompressSysType    = errors.New("the compression type is system reservation type")
+	ErrCompressedEntry    = errors.New("invalid compressed log entry")
+
+	compressors = &compressorMap{
+		m: map[CompressionType]Compressor{
+			CompressionGzip: newGzipCompressor(),
+		},
+	}
+)
+
+//Compressor 日志条目的压缩器，可以通过RegisterCompressor注册snappy、zstd等第三方实现
+type Compressor interface {
+	Type() CompressionType
+	//Compress 将data压缩后追加到dst之后并返回
+	Compress(dst, data []byte) ([]byte, error)
+	//Decompress 将data解压后追加到dst之后并返回
+	Decompress(dst, data []byte) ([]byte, error)
+}
+
+type compressorMap struct {
+	sync.RWMutex
+	m map[CompressionType]Compressor
+}
+
+/*
+ @title: RegisterCompressor
+ @description: 注册压缩器，注册后可通过WithCompression指定写入时使用，读取时根据条目中记录的压缩算法自动选择，故读取压缩条目的进程也需注册
+ @param {Compressor} c 压缩器
+ @return {error} 错误信息
+*/
+func RegisterCompressor(c Compressor) error {
+	if c.Type() == CompressionNone {
+		return ErrCompressSysType
+	}
+	compressors.Lock()
+	defer compressors.Unlock()
+	if _, exist := compressors.m[c.Type()]; exist {
+		return ErrCompressorExist
+	}
+	compressors.m[c.Type()] = c
+	return nil
+}
+
+func getCompressor(t CompressionType) (Compressor, error) {
+	compressors.RLock()
+	defer compressors.RUnlock()
+	if c, exist := compressors.m[t]; exist {
+		return c, nil
+	}
+	return nil, ErrCompressorNotExist
+}
+
+//compressEntry 压缩日志条目，系统类型的条目及过小的条目不压缩，压缩后没有变小的条目保持原样
+func compressEntry(c Compressor, t int8, data []byte) (int8, []byte, error) {
+	if c == nil || t < RawCoderType || len(data) < compressMinSize {
+		return t, data, nil
+	}
+	buf := make([]byte, compressHeaderSize, compressHeaderSize+len(data))
+	buf[0], buf[1] = byte(c.Type()), byte(t)
+	buf, err := c.Compress(buf, data)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(buf) >= len(data) {
+		return t, data, nil
+	}
+	return compressedType, buf, nil
+}
+
+//decompressEntry 将压缩条目还原为原始类型及数据，Len及Sum保持文件中记录的值
+func decompressEntry(le *LogEntry) (*LogEntry, error) {
+	if len(le.Data) < compressHeaderSize {
+		return nil, ErrCompressedEntry
+	}
+	c, err := getCompressor(CompressionType(le.Data[0]))
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.Decompress(nil, le.Data[compressHeaderSize:])
+	if err != nil {
+		return nil, err
+	}
+	return &LogEntry{
+		Len:  le.Len,
+		Sum:  le.Sum,
+		Typ:  int8(le.Data[1]),
+		Data: data,
+	}, nil
+}
+
+type gzipCompressor struct {
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func newGzipCompressor() *gzipCompressor {
+	return &gzipCompressor{
+		writers: sync.Pool{
+			New: func() interface{} {
+				return gzip.NewWriter(nil)
+			},
+		},
+	}
+}
+
+func (gc *gzipCompressor) Type() CompressionType {
+	return CompressionGzip
+}
+
+func (gc *gzipCompressor) Compress(dst, data []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w := gc.writers.Get().(*gzip.Writer)
+	defer gc.writers.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gc *gzipCompressor) Decompress(dst, data []byte) ([]byte, error) {
+	var (
+		r   *gzip.Reader
+		err error
+	)
+	if v := gc.readers.Get(); v != nil {
+		r = v.(*gzip.Reader)
+		err = r.Reset(bytes.NewReader(data))
+	} else {
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer gc.readers.Put(r)
+	buf := bytes.NewBuffer(dst)
+	if _, err = io.Copy(buf, r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
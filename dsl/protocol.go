@@ -6,6 +6,11 @@ SPDX-License-Identifier: Apache-2.0
 */
 package dsl
 
+import (
+	"errors"
+	"sync"
+)
+
 type (
 	ProtocolType int
 	Protocol     struct {
@@ -17,14 +22,22 @@ type (
 const (
 	PT_UNKNOWN ProtocolType = iota
 	PT_FILE
+	PT_MEMORY
 )
 
 var (
+	ErrProtocolExist = errors.New("protocol has been registered")
+
+	protocolMu       sync.RWMutex
 	supportProtocols protocols = []Protocol{
 		{
 			Type: PT_FILE,
 			Name: "file",
 		},
+		{
+			Type: PT_MEMORY,
+			Name: "mem",
+		},
 	}
 )
 
@@ -58,13 +71,33 @@ func (ps *protocols) HasType(t ProtocolType) bool {
 }
 
 func ProtocolTypeBySchema(schema string) ProtocolType {
+	protocolMu.RLock()
+	defer protocolMu.RUnlock()
 	return supportProtocols.GetProtocolType(schema)
 }
 
 func IsSupportedForSchema(schema string) bool {
+	protocolMu.RLock()
+	defer protocolMu.RUnlock()
 	return supportProtocols.HasName(schema)
 }
 
 func IsSupportedForType(t ProtocolType) bool {
+	protocolMu.RLock()
+	defer protocolMu.RUnlock()
 	return supportProtocols.HasType(t)
 }
+
+//RegisterProtocol register a new protocol named name, a new protocol type is assigned to it
+func RegisterProtocol(name string) error {
+	protocolMu.Lock()
+	defer protocolMu.Unlock()
+	if supportProtocols.HasName(name) {
+		return ErrProtocolExist
+	}
+	supportProtocols = append(supportProtocols, Protocol{
+		Type: supportProtocols[len(supportProtocols)-1].Type + 1,
+		Name: name,
+	})
+	return nil
+}
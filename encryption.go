@@ -0,0 +1,152 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package lws
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	encryptedType     int8 = -3 //加密条目的类型，数据为 密钥ID[4]|原始类型[1]|nonce[12]|密文
+	keyIDSize              = 4
+	encryptHeaderSize      = keyIDSize + typeSize
+)
+
+var (
+	ErrKeyNotFound   = errors.New("encryption key not found")
+	ErrKeyExist      = errors.New("encryption key has exist")
+	ErrDecrypt       = errors.New("log entry decryption failed")
+	ErrEncryptedData = errors.New("invalid encrypted log entry")
+)
+
+//Encryptor 使用AES-GCM对日志条目进行加密，每个条目记录加密使用的密钥ID，轮换密钥后老的条目仍可使用老密钥解密，无需重写文件
+type Encryptor struct {
+	mu      sync.RWMutex
+	keys    map[uint32]cipher.AEAD
+	current uint32 //写入时使用的密钥ID
+}
+
+/*
+ @title: NewEncryptor
+ @description: 创建加密器，并以keyID对应的密钥作为写入时使用的密钥
+ @param {uint32} keyID 密钥ID
+ @param {[]byte} key AES密钥，长度为16、24或32字节
+ @return {*Encryptor} 加密器
+ @return {error} 错误信息
+*/
+func NewEncryptor(keyID uint32, key []byte) (*Encryptor, error) {
+	e := &Encryptor{
+		keys: make(map[uint32]cipher.AEAD),
+	}
+	if err := e.AddKey(keyID, key); err != nil {
+		return nil, err
+	}
+	e.current = keyID
+	return e, nil
+}
+
+//AddKey 添加只用于解密的密钥，用于读取老密钥加密的条目
+func (e *Encryptor) AddKey(keyID uint32, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, exist := e.keys[keyID]; exist {
+		return ErrKeyExist
+	}
+	e.keys[keyID] = aead
+	return nil
+}
+
+//Rotate 添加新的密钥并将其作为之后写入时使用的密钥，老的密钥仍保留用于解密
+func (e *Encryptor) Rotate(keyID uint32, key []byte) error {
+	if err := e.AddKey(keyID, key); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.current = keyID
+	e.mu.Unlock()
+	return nil
+}
+
+//KeyID 返回写入时使用的密钥ID
+func (e *Encryptor) KeyID() uint32 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.current
+}
+
+func (e *Encryptor) aead(keyID uint32) (cipher.AEAD, error) {
+	if e == nil {
+		return nil, fmt.Errorf("%w: key id %d, no encryptor configured", ErrKeyNotFound, keyID)
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	aead, exist := e.keys[keyID]
+	if !exist {
+		return nil, fmt.Errorf("%w: key id %d", ErrKeyNotFound, keyID)
+	}
+	return aead, nil
+}
+
+//encryptEntry 加密日志条目，密钥ID及原始类型作为附加数据参与认证，批量头等系统条目不加密
+func encryptEntry(e *Encryptor, t int8, data []byte) (int8, []byte, error) {
+	if e == nil || (t < RawCoderType && t != compressedType) {
+		return t, data, nil
+	}
+	e.mu.RLock()
+	keyID := e.current
+	aead := e.keys[keyID]
+	e.mu.RUnlock()
+	ns := aead.NonceSize()
+	buf := make([]byte, encryptHeaderSize+ns, encryptHeaderSize+ns+len(data)+aead.Overhead())
+	binary.BigEndian.PutUint32(buf, keyID)
+	buf[keyIDSize] = byte(t)
+	nonce := buf[encryptHeaderSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, nil, err
+	}
+	return encryptedType, aead.Seal(buf, nonce, data, buf[:encryptHeaderSize]), nil
+}
+
+//decryptEntry 解密并认证加密条目，还原为原始类型及数据，Len及Sum保持文件中记录的值
+func decryptEntry(e *Encryptor, le *LogEntry) (*LogEntry, error) {
+	if len(le.Data) < encryptHeaderSize {
+		return nil, ErrEncryptedData
+	}
+	aead, err := e.aead(binary.BigEndian.Uint32(le.Data))
+	if err != nil {
+		return nil, err
+	}
+	ns := aead.NonceSize()
+	if len(le.Data) < encryptHeaderSize+ns+aead.Overhead() {
+		return nil, ErrEncryptedData
+	}
+	nonce := le.Data[encryptHeaderSize : encryptHeaderSize+ns]
+	data, err := aead.Open(nil, nonce, le.Data[encryptHeaderSize+ns:], le.Data[:encryptHeaderSize])
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return &LogEntry{
+		Len:  le.Len,
+		Sum:  le.Sum,
+		Typ:  int8(le.Data[keyIDSize]),
+		Data: data,
+	}, nil
+}
@@ -49,6 +49,18 @@ func (b *fixedbuffer) Truncate(n int64) error {
 	return nil
 }
 
+//Refresh 同步文件的大小并丢弃缓存的文件内容，下次读取时重新从文件中加载，用于文件被其他writer写入的情况
+func (b *fixedbuffer) Refresh(n int64) error {
+	if err := b.writeFile(); err != nil {
+		return err
+	}
+	if err := b.Truncate(n); err != nil {
+		return err
+	}
+	b.mmOff = math.MaxInt64
+	return nil
+}
+
 //ReadAt 从offset处读取n个字节，除非读到文件末尾，否则读取到的长度一定为n, 其主要用来读取文件的内容
 func (b *fixedbuffer) ReadAt(offset int64, n int) ([]byte, error) {
 	return b.readAt(offset, n)
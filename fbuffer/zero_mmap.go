@@ -11,6 +11,7 @@ import (
 	"io"
 	"os"
 	"syscall"
+	"unsafe"
 
 	"chainmaker.org/chainmaker/lws/allocate"
 )
@@ -20,6 +21,7 @@ var (
 	strNegativeOffset = "negative offset"
 	strSeekOffInvaild = "seek offset invaild"
 	strInvaildArg     = "arguments invaild"
+	syncRange         = msync //将映射区的指定区域同步到磁盘，测试时替换以检测刷盘的区域
 )
 
 //concurrent operations are unsafe
@@ -27,6 +29,7 @@ type ZeroMmap struct {
 	f         *os.File //映射的文件
 	fSize     int64    //文件大小
 	waitSync  area     //待刷盘的区域
+	sizeDirty bool     //文件大小是否发生了变化，刷盘时需同步文件元数据
 	mmSize    int      //映射区大小
 	mmOff     int64    //映射区偏移量
 	allocator *allocate.MmapAllocator
@@ -48,6 +51,7 @@ func NewZeroMmap(f *os.File, mmSize int, mapPort, mapFlag int, lock bool) (*Zero
 	return &ZeroMmap{
 		f:         f,
 		fSize:     finfo.Size(),
+		sizeDirty: true, //文件可能在映射前被调整过大小，首次刷盘时同步文件元数据
 		mmSize:    mmSize,
 		allocator: allocator,
 	}, nil
@@ -59,9 +63,20 @@ func (zm *ZeroMmap) Truncate(size int64) error {
 		return errors.New(strInvaildArg)
 	}
 	zm.fSize = size
+	zm.sizeDirty = true
+	//截断后待刷盘的区域不能超出文件大小
+	zm.waitSync = overlapArea(zm.waitSync, area{
+		off: 0,
+		len: int(size),
+	})
 	return nil
 }
 
+//Refresh 同步文件的大小，映射区与底层文件共享，故其他writer写入的数据无需重新映射即可见
+func (zm *ZeroMmap) Refresh(size int64) error {
+	return zm.Truncate(size)
+}
+
 //ReadAt 从offset处读取n个字节，除非读到文件末尾，否则读取到的长度一定为n, 其主要用来读取文件的内容
 func (zm *ZeroMmap) ReadAt(offset int64, n int) ([]byte, error) {
 	return zm.readAt(offset, n)
@@ -107,20 +122,30 @@ func (zm *ZeroMmap) readAt(offset int64, n int) (data []byte, err error) {
 			if n > size {
 				size = n
 			}
-			err = zm.allocator.Resize(offset, size)
-			if err != nil {
-				return nil, syscall.EAGAIN
+			if err = zm.remap(offset, size); err != nil {
+				return nil, err
 			}
-			zm.mmOff = offset
-			zm.waitSync = area{}
 			continue
 		}
 		return
 	}
 }
 
+//remap 重新映射前先将待刷盘的区域同步到磁盘，munmap不会保证映射区的数据落盘，故不能丢弃待刷盘的区域
+func (zm *ZeroMmap) remap(offset int64, size int) error {
+	if err := zm.msync(); err != nil {
+		return err
+	}
+	zm.waitSync = area{}
+	if err := zm.allocator.Resize(offset, size); err != nil {
+		return syscall.EAGAIN
+	}
+	zm.mmOff = offset
+	return nil
+}
+
 //nextAt 如果获取的数据超过了文件的长度，则先Truncate文件，以防止映射区写入出错，然后再重新映射；获取到缓存后，会将缓存对应的区域合并到waitSync， 以在上层调用刷盘的时候，将waitSync标记的区域内的数据刷新到磁盘
-//因为在每次重映射的时候会系统会主动将映射区数据同步到底层文件，故waitSync会在重映射时重置
+//重映射前会先将waitSync标记的区域同步到磁盘，然后再重置waitSync
 func (zm *ZeroMmap) nextAt(offset int64, n int) ([]byte, error) {
 	var (
 		nextEnd = offset + int64(n)
@@ -130,6 +155,7 @@ func (zm *ZeroMmap) nextAt(offset int64, n int) ([]byte, error) {
 			return nil, err
 		}
 		zm.fSize = nextEnd
+		zm.sizeDirty = true
 	}
 	for {
 		data, err := zm.allocator.AllocAt(offset, n)
@@ -138,12 +164,9 @@ func (zm *ZeroMmap) nextAt(offset int64, n int) ([]byte, error) {
 			if n > size {
 				size = n
 			}
-			err = zm.allocator.Resize(offset, size)
-			if err != nil {
-				return nil, syscall.EAGAIN
+			if err = zm.remap(offset, size); err != nil {
+				return nil, err
 			}
-			zm.mmOff = offset
-			zm.waitSync = area{}
 			continue
 		}
 		zm.waitSync = mergeArea(zm.waitSync, area{
@@ -158,35 +181,58 @@ func (zm *ZeroMmap) WriteBack() error {
 	return nil
 }
 
-//Sync 将映射区的数据刷新到磁盘
+//Sync 将映射区中待刷盘的区域通过msync同步到磁盘，映射区保持不变，如果文件大小发生了变化，则同时同步文件的元数据
 func (zm *ZeroMmap) Sync() error {
+	if err := zm.msync(); err != nil {
+		return err
+	}
+	zm.waitSync = area{}
+	if zm.sizeDirty {
+		if err := zm.f.Sync(); err != nil {
+			return err
+		}
+		zm.sizeDirty = false
+	}
+	return nil
+}
+
+//msync 将waitSync与映射区交集的区域同步到磁盘
+func (zm *ZeroMmap) msync() error {
+	if zm.allocator == nil {
+		return nil
+	}
 	//为安全期间，获取waitSync和映射区的交集范围
-	// overlap := overlapArea(zm.waitSync, area{
-	// 	off: zm.mmOff,
-	// 	len: zm.allocator.Size(),
-	// })
-	// if overlap.len == 0 {
-	// 	return nil
-	// }
-	// //将交集的offset进行页对齐，防止sync失败
-	// off := int64(alignDown(uint64(overlap.off), uint64(OsPageSize)))
-	// overlap = area{
-	// 	off: off,
-	// 	len: int(overlap.off-off) + overlap.len,
-	// }
-	// buf, err := zm.allocator.AllocAt(overlap.off, overlap.len)
-	// if err != nil {
-	// 	if err == allocate.End {
-	// 		return nil
-	// 	}
-	// 	return err
-	// }
+	overlap := overlapArea(zm.waitSync, area{
+		off: zm.allocator.Offset(),
+		len: zm.allocator.Size(),
+	})
+	if overlap.len == 0 {
+		return nil
+	}
+	//将交集的offset进行页对齐，防止sync失败，映射区的起始偏移本身是页对齐的，故对齐后依然在映射区内
+	off := int64(alignDown(uint64(overlap.off), uint64(OsPageSize)))
+	overlap = area{
+		off: off,
+		len: int(overlap.off-off) + overlap.len,
+	}
+	buf, err := zm.allocator.AllocAt(overlap.off, overlap.len)
+	if err != nil {
+		if err == allocate.End {
+			return nil
+		}
+		return err
+	}
+	return syncRange(buf, syscall.MS_SYNC)
+}
 
-	// if err := unix.Msync(buf, unix.MS_SYNC); err != nil {
-	// 	return err
-	// }
-	zm.allocator.Release()
-	zm.waitSync = area{}
+func msync(b []byte, flags int) error {
+	if len(b) == 0 {
+		return nil
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), uintptr(flags))
+	if errno != 0 {
+		return errno
+	}
 	return nil
 }
 
@@ -207,6 +253,7 @@ func (zm *ZeroMmap) Size() int64 {
 	return info.Size()
 }
 
+//mergeArea 合并两个区域，返回覆盖两者的最小区域
 func mergeArea(a area, b area) area {
 	if a.len == 0 {
 		return b
@@ -214,53 +261,34 @@ func mergeArea(a area, b area) area {
 	if b.len == 0 {
 		return a
 	}
-	aEnd := a.off + int64(a.len)
-	bEnd := b.off + int64(b.len)
-	if a.off <= b.off && aEnd >= bEnd {
-		return a
+	off, end := a.off, a.off+int64(a.len)
+	if b.off < off {
+		off = b.off
 	}
-	if a.off > b.off && aEnd < bEnd {
-		return b
+	if bEnd := b.off + int64(b.len); bEnd > end {
+		end = bEnd
 	}
-	if bEnd < a.off {
-		return area{
-			off: b.off,
-			len: int(aEnd - b.off),
-		}
-	} else if b.off > aEnd {
-		return area{
-			off: a.off,
-			len: int(bEnd - a.off),
-		}
-	} else if a.off < b.off {
-		a.off = b.off
-	} else {
-		a.len = b.len
+	return area{
+		off: off,
+		len: int(end - off),
 	}
-	return a
 }
 
+//overlapArea 返回两个区域的交集，没有交集则返回空区域
 func overlapArea(a area, b area) area {
-	aEnd := a.off + int64(a.len)
-	bEnd := b.off + int64(b.len)
-	if a.off <= b.off && aEnd >= bEnd {
-		return b
+	off, end := a.off, a.off+int64(a.len)
+	if b.off > off {
+		off = b.off
 	}
-	if a.off > b.off && aEnd < bEnd {
-		return a
+	if bEnd := b.off + int64(b.len); bEnd < end {
+		end = bEnd
 	}
-	if bEnd < a.off || b.off > aEnd {
+	if end <= off {
 		return area{}
-	} else if a.off < b.off {
-		return area{
-			off: b.off,
-			len: int(bEnd - a.off),
-		}
-	} else {
-		return area{
-			off: a.off,
-			len: int(aEnd - b.off),
-		}
+	}
+	return area{
+		off: off,
+		len: int(end - off),
 	}
 }
 
@@ -0,0 +1,146 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package fbuffer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeArea(t *testing.T) {
+	cases := []struct {
+		a, b, expect area
+	}{
+		{area{0, 0}, area{10, 5}, area{10, 5}},
+		{area{0, 100}, area{100, 50}, area{0, 150}},
+		{area{100, 50}, area{0, 100}, area{0, 150}},
+		{area{0, 100}, area{50, 100}, area{0, 150}},
+		{area{50, 100}, area{0, 100}, area{0, 150}},
+		{area{0, 100}, area{10, 10}, area{0, 100}},
+		{area{10, 10}, area{0, 100}, area{0, 100}},
+		{area{0, 10}, area{20, 10}, area{0, 30}},
+	}
+	for _, c := range cases {
+		require.Equal(t, c.expect, mergeArea(c.a, c.b), "%v + %v", c.a, c.b)
+	}
+}
+
+func TestOverlapArea(t *testing.T) {
+	cases := []struct {
+		a, b, expect area
+	}{
+		{area{0, 100}, area{50, 100}, area{50, 50}},
+		{area{50, 100}, area{0, 100}, area{50, 50}},
+		{area{0, 100}, area{10, 10}, area{10, 10}},
+		{area{10, 10}, area{0, 100}, area{10, 10}},
+		{area{0, 10}, area{10, 10}, area{}},
+		{area{0, 10}, area{20, 10}, area{}},
+	}
+	for _, c := range cases {
+		require.Equal(t, c.expect, overlapArea(c.a, c.b), "%v & %v", c.a, c.b)
+	}
+}
+
+func TestZeroMmap_Sync(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sync.wal")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	require.Nil(t, err)
+	defer f.Close()
+	zm, err := NewZeroMmap(f, OsPageSize*2, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED, false)
+	require.Nil(t, err)
+	defer zm.Close()
+	var expect []byte
+	//跨越多个系统页写入，迫使映射区重映射
+	for i := 0; i < 5; i++ {
+		data := make([]byte, OsPageSize-100)
+		for j := range data {
+			data[j] = byte('a' + i)
+		}
+		buf, err := zm.NextAt(int64(len(expect)), len(data))
+		require.Nil(t, err)
+		copy(buf, data)
+		expect = append(expect, data...)
+		require.Nil(t, zm.Sync())
+		//刷盘不会释放映射区
+		require.True(t, zm.allocator.Size() > 0)
+		require.Equal(t, area{}, zm.waitSync)
+	}
+	content, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, expect, content[:len(expect)])
+}
+
+func TestZeroMmap_SyncRange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "range.wal")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	require.Nil(t, err)
+	defer f.Close()
+	zm, err := NewZeroMmap(f, OsPageSize*4, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED, false)
+	require.Nil(t, err)
+	defer zm.Close()
+	//重映射后旧的映射区不可访问，故记录刷盘区域的副本及其末尾字节的地址
+	var (
+		synced [][]byte
+		ends   []*byte
+	)
+	syncRange = func(b []byte, flags int) error {
+		require.Equal(t, syscall.MS_SYNC, flags)
+		synced = append(synced, append([]byte(nil), b...))
+		ends = append(ends, &b[len(b)-1])
+		return msync(b, flags)
+	}
+	defer func() {
+		syncRange = msync
+	}()
+	//写入跨越页边界的数据，刷盘的区域从页边界开始并覆盖写入的数据
+	off := int64(OsPageSize + 100)
+	data := []byte("hello world")
+	buf, err := zm.NextAt(off, len(data))
+	require.Nil(t, err)
+	copy(buf, data)
+	require.Nil(t, zm.Sync())
+	require.Len(t, synced, 1)
+	require.Equal(t, 100+len(data), len(synced[0]))
+	require.Equal(t, data, synced[0][100:])
+	//没有新的写入时不会再次刷盘
+	require.Nil(t, zm.Sync())
+	require.Len(t, synced, 1)
+
+	//同一页内不连续的两次写入，刷盘的区域从页边界开始直至最后写入的字节，不会超出
+	synced, ends = nil, nil
+	first, err := zm.NextAt(100, 50)
+	require.Nil(t, err)
+	copy(first, data)
+	last, err := zm.NextAt(3000, 200)
+	require.Nil(t, err)
+	require.Nil(t, zm.Sync())
+	require.Len(t, synced, 1)
+	require.Len(t, synced[0], 3200)
+	require.Equal(t, data, synced[0][100:100+len(data)])
+	require.True(t, ends[0] == &last[199])
+
+	//映射区重映射前先将待刷盘的区域刷盘，重映射后只刷新之后写入的区域
+	synced, ends = nil, nil
+	before, err := zm.NextAt(200, 10)
+	require.Nil(t, err)
+	copy(before, data)
+	off = int64(OsPageSize*8 + 10)
+	after, err := zm.NextAt(off, 20)
+	require.Nil(t, err)
+	require.Len(t, synced, 1)
+	require.Len(t, synced[0], 210)
+	require.Equal(t, data[:10], synced[0][200:])
+	require.Nil(t, zm.Sync())
+	require.Len(t, synced, 2)
+	require.Len(t, synced[1], 30)
+	require.True(t, ends[1] == &after[19])
+}
@@ -0,0 +1,242 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package file
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//memFS 进程内的内存文件系统，以清理后的路径为键，同一路径的文件在进程内共享数据，关闭后数据依然保留
+var memFS = struct {
+	sync.Mutex
+	files map[string]*memData
+}{
+	files: make(map[string]*memData),
+}
+
+type memData struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+//MemFile 内存文件，不进行任何磁盘读写，用于测试及无需持久化的日志
+type MemFile struct {
+	*memData
+	offset int64
+	closed bool
+}
+
+//OpenMemFile 打开路径为path的内存文件，文件不存在时创建
+func OpenMemFile(path string) *MemFile {
+	memFS.Lock()
+	defer memFS.Unlock()
+	path = filepath.Clean(path)
+	md, ok := memFS.files[path]
+	if !ok {
+		md = &memData{}
+		memFS.files[path] = md
+	}
+	return &MemFile{
+		memData: md,
+	}
+}
+
+//NewMemFile 以data为内容创建不属于内存文件系统的内存文件，关闭后其数据随之释放
+func NewMemFile(data []byte) *MemFile {
+	return &MemFile{
+		memData: &memData{
+			data: data,
+		},
+	}
+}
+
+//StatMemFile 返回内存文件的大小，文件不存在时返回os.ErrNotExist
+func StatMemFile(path string) (int64, error) {
+	memFS.Lock()
+	md, ok := memFS.files[filepath.Clean(path)]
+	memFS.Unlock()
+	if !ok {
+		return 0, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+	return int64(len(md.data)), nil
+}
+
+//ListMemFiles 按名称排序返回目录dir下的内存文件名，不包括子目录中的文件
+func ListMemFiles(dir string) []string {
+	memFS.Lock()
+	defer memFS.Unlock()
+	dir = filepath.Clean(dir)
+	var names []string
+	for path := range memFS.files {
+		if filepath.Dir(path) == dir {
+			names = append(names, filepath.Base(path))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+//RemoveMemFile 删除内存文件，已打开的MemFile仍可访问其数据
+func RemoveMemFile(path string) error {
+	memFS.Lock()
+	defer memFS.Unlock()
+	path = filepath.Clean(path)
+	if _, ok := memFS.files[path]; !ok {
+		return &os.PathError{Op: "remove", Path: path, Err: os.ErrNotExist}
+	}
+	delete(memFS.files, path)
+	return nil
+}
+
+//RenameMemFile 重命名内存文件，newPath已存在时被替换
+func RenameMemFile(oldPath, newPath string) error {
+	memFS.Lock()
+	defer memFS.Unlock()
+	oldPath, newPath = filepath.Clean(oldPath), filepath.Clean(newPath)
+	md, ok := memFS.files[oldPath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: os.ErrNotExist}
+	}
+	delete(memFS.files, oldPath)
+	memFS.files[newPath] = md
+	return nil
+}
+
+//RemoveMemDir 删除目录dir及其子目录下的所有内存文件，释放其占用的内存
+func RemoveMemDir(dir string) {
+	memFS.Lock()
+	defer memFS.Unlock()
+	dir = filepath.Clean(dir)
+	for path := range memFS.files {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			delete(memFS.files, path)
+		}
+	}
+}
+
+func (mf *MemFile) Write(b []byte) (int, error) {
+	n, err := mf.WriteAt(b, mf.offset)
+	mf.offset += int64(n)
+	return n, err
+}
+
+func (mf *MemFile) Read(b []byte) (int, error) {
+	n, err := mf.ReadAt(b, mf.offset)
+	mf.offset += int64(n)
+	return n, err
+}
+
+//WriteAt 写入位置超出文件大小时，文件自动扩展，中间以零填充
+func (mf *MemFile) WriteAt(b []byte, offset int64) (int, error) {
+	if mf.closed {
+		return 0, os.ErrClosed
+	}
+	if offset < 0 {
+		return 0, errors.New(strSeekOffInvaild)
+	}
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	if end := offset + int64(len(b)); end > int64(len(mf.data)) {
+		mf.resize(end)
+	}
+	return copy(mf.data[offset:], b), nil
+}
+
+//ReadAt 与os.File一致，读取的数据不足len(b)时返回io.EOF
+func (mf *MemFile) ReadAt(b []byte, offset int64) (int, error) {
+	if mf.closed {
+		return 0, os.ErrClosed
+	}
+	if offset < 0 {
+		return 0, errors.New(strSeekOffInvaild)
+	}
+	mf.mu.RLock()
+	defer mf.mu.RUnlock()
+	if offset >= int64(len(mf.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, mf.data[offset:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (mf *MemFile) Size() int64 {
+	mf.mu.RLock()
+	defer mf.mu.RUnlock()
+	return int64(len(mf.data))
+}
+
+func (mf *MemFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += mf.offset
+	case io.SeekEnd:
+		offset += mf.Size()
+	}
+	if offset < 0 {
+		return mf.offset, errors.New(strSeekOffInvaild)
+	}
+	mf.offset = offset
+	return offset, nil
+}
+
+func (mf *MemFile) Truncate(size int64) error {
+	if mf.closed {
+		return os.ErrClosed
+	}
+	if size < 0 {
+		return errors.New(strSeekOffInvaild)
+	}
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	mf.resize(size)
+	return nil
+}
+
+//resize 调整数据的长度，扩展的部分以零填充，调用者需持有写锁
+func (mf *MemFile) resize(size int64) {
+	if size <= int64(len(mf.data)) {
+		//截断后重新扩展的部分需为零，故清空被截掉的数据
+		tail := mf.data[size:]
+		for i := range tail {
+			tail[i] = 0
+		}
+		mf.data = mf.data[:size]
+		return
+	}
+	if size <= int64(cap(mf.data)) {
+		mf.data = mf.data[:size]
+		return
+	}
+	data := make([]byte, size, size+size/2)
+	copy(data, mf.data)
+	mf.data = data
+}
+
+//Sync 内存文件无需刷盘
+func (mf *MemFile) Sync() error {
+	if mf.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (mf *MemFile) Close() error {
+	mf.closed = true
+	return nil
+}
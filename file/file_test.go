@@ -319,3 +319,31 @@ func BenchmarkMmapAllFileR(b *testing.B) {
 		allMmapFileReplice(i)
 	}
 }
+
+func TestMemFile(t *testing.T) {
+	defer RemoveMemDir("mem_test")
+	f := OpenMemFile("mem_test/a.wal")
+	_, err := f.WriteAt([]byte("world"), 6)
+	require.Nil(t, err)
+	_, err = f.WriteAt([]byte("hello"), 0)
+	require.Nil(t, err)
+	require.Equal(t, int64(11), f.Size())
+	b := make([]byte, 8)
+	n, err := f.ReadAt(b, 6)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, "world", string(b[:n]))
+	//同一路径的文件共享数据
+	require.Equal(t, int64(11), OpenMemFile("mem_test/./a.wal").Size())
+	require.Nil(t, f.Truncate(5))
+	require.Nil(t, f.Truncate(8))
+	n, _ = f.ReadAt(b, 0)
+	require.Equal(t, "hello\x00\x00\x00", string(b[:n]))
+	require.Equal(t, []string{"a.wal"}, ListMemFiles("mem_test"))
+	require.Nil(t, RenameMemFile("mem_test/a.wal", "mem_test/b.wal"))
+	size, err := StatMemFile("mem_test/b.wal")
+	require.Nil(t, err)
+	require.Equal(t, int64(8), size)
+	require.Nil(t, RemoveMemFile("mem_test/b.wal"))
+	_, err = StatMemFile("mem_test/b.wal")
+	require.True(t, os.IsNotExist(err))
+}
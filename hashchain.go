@@ -0,0 +1,176 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package lws
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+const (
+	chainedType     int8 = -4 //带有哈希链的条目类型，数据为 哈希[32]|原始类型[1]|数据
+	hashSize             = sha256.Size
+	chainHeaderSize      = hashSize + typeSize
+)
+
+var (
+	ErrChainBroken  = errors.New("hash chain is broken")
+	ErrChainMissing = errors.New("log entry is not in hash chain")
+)
+
+//ChainError 哈希链校验失败的详情，Index为第一个断开的日志条目的索引
+type ChainError struct {
+	Index uint64
+	Err   error
+}
+
+func (ce *ChainError) Error() string {
+	return fmt.Sprintf("%s at index %d", ce.Err, ce.Index)
+}
+
+func (ce *ChainError) Unwrap() error {
+	return ce.Err
+}
+
+//hashChain 写入者的哈希链状态，last为最新写入条目的哈希
+type hashChain struct {
+	last [hashSize]byte
+}
+
+//chainHash 计算条目的哈希：sha256(上一个条目的哈希|类型|数据)
+func chainHash(prev []byte, t int8, data []byte) []byte {
+	h := sha256.New()
+	h.Write(prev)
+	h.Write([]byte{byte(t)})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+//advance 条目写入成功后将哈希链推进到该条目的哈希，不带哈希链的条目不影响链的状态
+func (c *hashChain) advance(t int8, data []byte) {
+	if c != nil && t == chainedType && len(data) >= hashSize {
+		copy(c.last[:], data)
+	}
+}
+
+//mark 返回哈希链当前的哈希，用于写入失败时回退，没有哈希链时返回零值
+func (c *hashChain) mark() [hashSize]byte {
+	if c == nil {
+		return [hashSize]byte{}
+	}
+	return c.last
+}
+
+//reset 将哈希链回退到last
+func (c *hashChain) reset(last [hashSize]byte) {
+	if c != nil {
+		c.last = last
+	}
+}
+
+//chainEntry 将条目链接到哈希链上，数据为写入文件的最终形式，故加密的条目无需密钥即可校验，批量头不参与哈希链
+func chainEntry(c *hashChain, t int8, data []byte) (int8, []byte) {
+	if c == nil || t == batchHeaderType {
+		return t, data
+	}
+	buf := make([]byte, chainHeaderSize, chainHeaderSize+len(data))
+	copy(buf, chainHash(c.last[:], t, data))
+	buf[hashSize] = byte(t)
+	return chainedType, append(buf, data...)
+}
+
+//unchainEntry 去掉条目的哈希，还原为原始类型及数据
+func unchainEntry(le *LogEntry) (*LogEntry, error) {
+	if len(le.Data) < chainHeaderSize {
+		return nil, ErrChainBroken
+	}
+	return &LogEntry{
+		Len:  le.Len,
+		Sum:  le.Sum,
+		Typ:  int8(le.Data[hashSize]),
+		Data: le.Data[chainHeaderSize:],
+	}, nil
+}
+
+//verifyChained 校验条目的哈希是否由prev链接而来
+func verifyChained(prev []byte, le *LogEntry) error {
+	if le == nil || le.Typ != chainedType || len(le.Data) < chainHeaderSize {
+		return ErrChainMissing
+	}
+	if !bytes.Equal(le.Data[:hashSize], chainHash(prev, int8(le.Data[hashSize]), le.Data[chainHeaderSize:])) {
+		return ErrChainBroken
+	}
+	return nil
+}
+
+/*
+ @title: VerifyChain
+ @description: 校验[from, to]范围内日志条目的哈希链，包括文件之间的链接，from之前的条目存在时会以其哈希作为起点，否则以from所在文件段头中记录的哈希作为起点
+ @param {uint64} from 校验的起始索引
+ @param {uint64} to 校验的结束索引
+ @return {error} 链完整返回nil，断开时返回*ChainError，其中记录第一个断开的条目的索引
+*/
+func (l *Lws) VerifyChain(from, to uint64) error {
+	l.readRequest()
+	defer l.readRelease()
+	first, last := l.FirstIndex(), l.LastIndex()
+	if from < first {
+		return ErrCompacted
+	}
+	if to > last {
+		return ErrNotFound
+	}
+	if from > to {
+		return ErrIndexOutOfRange
+	}
+	//from之前的条目依然存在于文件中时，以其哈希作为起点
+	var (
+		prev   [hashSize]byte
+		linked bool //prev是否已确定
+	)
+	if from > 1 {
+		if rd, err := l.findReaderByIndex(from - 1); err == nil {
+			if le, err := rd.readRecordByIndex(from - 1); err == nil && le.Typ == chainedType && len(le.Data) >= hashSize {
+				copy(prev[:], le.Data)
+				linked = true
+			}
+		}
+	}
+	for idx := from; idx <= to; {
+		rd, err := l.findReaderByIndex(idx)
+		if err != nil {
+			return err
+		}
+		h := rd.Header()
+		if h == nil || !h.HashChain {
+			return &ChainError{Index: idx, Err: ErrChainMissing}
+		}
+		//文件的起点需与上一个文件最后一个条目的哈希一致
+		if idx == rd.FirstIndex() {
+			if linked && prev != h.PrevHash {
+				return &ChainError{Index: idx, Err: ErrChainBroken}
+			}
+			prev, linked = h.PrevHash, true
+		}
+		if !linked {
+			return &ChainError{Index: idx, Err: ErrChainMissing}
+		}
+		for end := rd.LastIndex(); idx <= to && idx <= end; idx++ {
+			le, err := rd.readRecordByIndex(idx)
+			if err != nil {
+				return err
+			}
+			if err = verifyChained(prev[:], le); err != nil {
+				return &ChainError{Index: idx, Err: err}
+			}
+			copy(prev[:], le.Data)
+		}
+	}
+	return nil
+}
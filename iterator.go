@@ -88,6 +88,15 @@ func (it *EntryIterator) SkipToLast() {
 	it.index = it.container.LastIndex() + 1
 }
 
+//Seek 将迭代器游标定位到index之前，之后调用Next获取到的即为index对应的条目，index需在[FirstIndex, LastIndex+1]范围内
+func (it *EntryIterator) Seek(index uint64) error {
+	if index < it.container.FirstIndex() || index > it.container.LastIndex()+1 {
+		return ErrIndexOutOfRange
+	}
+	it.index = index - 1
+	return nil
+}
+
 func (it *EntryIterator) HasNext() bool {
 	return it.HasNextN(1)
 }
@@ -160,15 +169,25 @@ func (ele *EntryElemnet) Get() ([]byte, error) {
 	return entry.Data, nil
 }
 
+//GetEntry 获取完整的日志条目，包括其类型及校验值，数据指向reader的缓存区，需要持有时应进行拷贝
+func (ele *EntryElemnet) GetEntry() (*LogEntry, error) {
+	return ele.get()
+}
+
 func (ele *EntryElemnet) GetObj() (interface{}, error) {
 	entry, err := ele.get()
 	if err != nil {
 		return nil, err
 	}
+	return decodeEntry(entry, ele.container.GetCoder)
+}
+
+//decodeEntry 通过条目类型对应的Coder将日志数据解码成对象，字节类型的条目直接返回数据
+func decodeEntry(entry *LogEntry, getCoder func(int8) (Coder, error)) (interface{}, error) {
 	if entry.Typ == RawCoderType {
 		return entry.Data, nil
 	}
-	coder, err := ele.container.GetCoder(entry.Typ)
+	coder, err := getCoder(entry.Typ)
 	if err != nil {
 		return nil, err
 	}
@@ -18,6 +18,7 @@ import (
 
 type fileBuffer interface {
 	Truncate(size int64) error
+	Refresh(size int64) error
 	ReadAt(offset int64, n int) ([]byte, error)
 	NextAt(offset int64, n int) ([]byte, error)
 	Close() error
@@ -36,19 +37,29 @@ type LwsFile interface {
 
 type logfile struct {
 	LwsFile
-	buf    fileBuffer
-	sync   func() error
-	offset int64
+	buf        fileBuffer
+	sync       func() error
+	offset     int64
+	summer     checksumer //日志条目的校验器
+	typedSum   bool       //校验值是否覆盖类型字段，有段头的文件为true，老版本文件只校验数据
+	compressor Compressor //写入时使用的压缩器，为nil则不压缩
+	encryptor  *Encryptor //加密器，为nil则写入时不加密，读取加密条目时返回ErrKeyNotFound
+	chain      *hashChain //哈希链状态，为nil则写入的条目不带哈希链
 }
 
-func openFile(fn string, ft FileType, segmentSize int64) (LwsFile, error) {
+//openFile 通过存储后端打开文件，写入者打开的磁盘文件会预分配到segmentSize，其他后端的文件按需扩展
+//读取者只以只读方式打开已存在的文件，不会创建或修改文件
+func openFile(b Backend, fn string, ft FileType, segmentSize int64, writable bool) (LwsFile, error) {
 	switch ft {
-	case FT_MMAP, FT_NORMAL:
-		f, err := file.NewFile(fn)
+	case FT_MMAP, FT_NORMAL, FT_MEMORY:
+		if !writable {
+			return b.Open(fn)
+		}
+		f, err := b.Create(fn)
 		if err != nil {
 			return nil, err
 		}
-		if segmentSize > 0 && segmentSize > f.Size() {
+		if _, ok := f.(*file.NormalFile); ok && segmentSize > 0 && segmentSize > f.Size() {
 			if err = f.Truncate(segmentSize); err != nil {
 				f.Close()
 				return nil, err
@@ -60,8 +71,8 @@ func openFile(fn string, ft FileType, segmentSize int64) (LwsFile, error) {
 	}
 }
 
-func newLogFile(fn string, ft FileType, segmentSize int64, bufSize int, mlock bool) (*logfile, error) {
-	f, err := openFile(fn, ft, segmentSize)
+func newLogFile(b Backend, fn string, ft FileType, segmentSize int64, bufSize int, mlock bool, writable bool) (*logfile, error) {
+	f, err := openFile(b, fn, ft, segmentSize, writable)
 	if err != nil {
 		return nil, err
 	}
@@ -78,11 +89,22 @@ func newLogFile(fn string, ft FileType, segmentSize int64, bufSize int, mlock bo
 		if bufSize == 0 {
 			return nil, errors.New("mmp size must greater than 0 for mmap file")
 		}
-		nf, _ := f.(*file.NormalFile)
+		nf, ok := f.(*file.NormalFile)
+		if !ok {
+			f.Close()
+			return nil, ErrFileTypeNotSupport
+		}
+		//只读打开的文件只能以只读方式映射
+		prot := syscall.PROT_READ
+		if writable {
+			prot |= syscall.PROT_WRITE
+		}
 		var buf *fbuffer.ZeroMmap
-		buf, err = fbuffer.NewZeroMmap(nf.File, bufSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED, mlock)
+		buf, err = fbuffer.NewZeroMmap(nf.File, bufSize, prot, syscall.MAP_SHARED, mlock)
 		sync = buf.Sync
 		fb = buf
+	case FT_MEMORY:
+		//内存文件直接读写，不使用缓存
 	default:
 		return nil, ErrFileTypeNotSupport
 	}
@@ -93,37 +115,47 @@ func newLogFile(fn string, ft FileType, segmentSize int64, bufSize int, mlock bo
 		LwsFile: f,
 		buf:     fb,
 		sync:    sync,
+		summer:  newChecksumer(ChecksumIEEE),
 	}, nil
 }
 
-func (f *logfile) WriteLog(t int8, data []byte, crc32 uint32) (int, error) {
+//WriteLog 对日志条目依次进行压缩、加密、链接哈希及计算校验值之后写入，校验值针对写入文件的类型及数据
+func (f *logfile) WriteLog(t int8, data []byte) (int, error) {
+	t, data, err := compressEntry(f.compressor, t, data)
+	if err != nil {
+		return 0, err
+	}
+	if t, data, err = encryptEntry(f.encryptor, t, data); err != nil {
+		return 0, err
+	}
+	t, data = chainEntry(f.chain, t, data)
+	var n int
 	if f.hasBuffer() {
-		return f.writeWithBuffer(t, data, crc32)
+		n, err = f.writeWithBuffer(t, data)
+	} else {
+		n, err = f.writeNoBuffer(t, data)
+	}
+	if err == nil {
+		f.chain.advance(t, data)
 	}
-	return f.writeNoBuffer(t, data, crc32)
+	return n, err
 }
 
-func (f *logfile) writeWithBuffer(t int8, data []byte, crc32 uint32) (int, error) {
-	dl := len(data) + crc32Size + typeSize
+func (f *logfile) writeWithBuffer(t int8, data []byte) (int, error) {
+	dl := len(data) + f.summer.Size() + typeSize
 	buf, err := f.buf.NextAt(f.offset, dl+lenSize)
 	if err != nil {
 		return 0, err
 	}
-	serializateUint32(buf[:lenSize], uint32(dl))
-	serializateUint32(buf[lenSize:], crc32)
-	buf[lenSize+crc32Size] = byte(t)
-	copy(buf[lenSize+crc32Size+1:], data)
+	f.encodeLog(buf, dl, t, data)
 	f.offset += int64(len(buf))
 	return len(buf), nil
 }
 
-func (f *logfile) writeNoBuffer(t int8, data []byte, crc32 uint32) (int, error) {
-	dl := len(data) + crc32Size + typeSize
+func (f *logfile) writeNoBuffer(t int8, data []byte) (int, error) {
+	dl := len(data) + f.summer.Size() + typeSize
 	buf := make([]byte, dl+lenSize)
-	serializateUint32(buf[:lenSize], uint32(dl))
-	serializateUint32(buf[lenSize:], crc32)
-	buf[lenSize+crc32Size] = byte(t)
-	copy(buf[lenSize+crc32Size+1:], data)
+	f.encodeLog(buf, dl, t, data)
 	n, err := f.WriteAt(buf, f.offset)
 	if err == nil {
 		f.offset += int64(n)
@@ -131,11 +163,95 @@ func (f *logfile) writeNoBuffer(t int8, data []byte, crc32 uint32) (int, error)
 	return n, err
 }
 
+//encodeLog 按照 len|sum|typ|data 的格式将日志条目编码到buf中
+func (f *logfile) encodeLog(buf []byte, dl int, t int8, data []byte) {
+	sumSize := f.summer.Size()
+	serializateUint32(buf[:lenSize], uint32(dl))
+	buf[lenSize+sumSize] = byte(t)
+	copy(buf[lenSize+sumSize+typeSize:], data)
+	sum := f.sum(buf[lenSize+sumSize : lenSize+dl])
+	switch sumSize {
+	case 4:
+		serializateUint32(buf[lenSize:], uint32(sum))
+	case 8:
+		binary.BigEndian.PutUint64(buf[lenSize:], sum)
+	}
+}
+
+//sum 计算 typ|data 格式的记录的校验值，老版本文件的校验值不包含类型字段
+func (f *logfile) sum(record []byte) uint64 {
+	if !f.typedSum {
+		record = record[typeSize:]
+	}
+	return f.summer.Sum(record)
+}
+
+//verify 检测文件中读出的日志条目的校验值是否正确
+func (f *logfile) verify(le *LogEntry) bool {
+	return len(le.record) >= typeSize && f.sum(le.record) == le.Sum
+}
+
+//decodeLog 解析去掉长度字段之后的日志条目
+func (f *logfile) decodeLog(l int, b []byte) *LogEntry {
+	sumSize := f.summer.Size()
+	if len(b) < sumSize+typeSize {
+		return nil
+	}
+	var sum uint64
+	switch sumSize {
+	case 4:
+		sum = uint64(deserializeUint32(b))
+	case 8:
+		sum = binary.BigEndian.Uint64(b)
+	}
+	return &LogEntry{
+		Len:    l,
+		Sum:    sum,
+		Typ:    int8(b[sumSize]),
+		Data:   b[sumSize+typeSize:],
+		record: b[sumSize:],
+	}
+}
+
 func (f *logfile) hasBuffer() bool {
 	return f.buf != nil
 }
 
+//ReadLog 读取pos处的日志条目，带哈希链、加密及压缩的条目会被还原为原始类型及数据
 func (f *logfile) ReadLog(pos int64) (*LogEntry, error) {
+	le, err := f.ReadRecord(pos)
+	if err != nil || le == nil {
+		return le, err
+	}
+	return f.restoreRecord(le)
+}
+
+//restoreRecord 将文件中记录的日志条目还原为原始类型及数据，还原后仍为未知的系统保留类型说明条目已损坏
+func (f *logfile) restoreRecord(le *LogEntry) (*LogEntry, error) {
+	var err error
+	if le.Typ == chainedType {
+		if le, err = unchainEntry(le); err != nil {
+			return nil, err
+		}
+	}
+	if le.Typ == encryptedType {
+		if le, err = decryptEntry(f.encryptor, le); err != nil {
+			return nil, err
+		}
+	}
+	if le.Typ == compressedType {
+		if le, err = decompressEntry(le); err != nil {
+			return nil, err
+		}
+	}
+	if le.Typ < 0 && le.Typ != batchHeaderType {
+		return nil, ErrCorruptEntry
+	}
+	return le, nil
+}
+
+//ReadRecord 读取pos处文件中记录的日志条目，不进行解压，用于遍历及校验
+func (f *logfile) ReadRecord(pos int64) (*LogEntry, error) {
 	if f.hasBuffer() {
 		return f.readWithBuffer(pos)
 	}
@@ -147,19 +263,17 @@ func (f *logfile) readWithBuffer(pos int64) (*LogEntry, error) {
 	if err != nil {
 		return nil, err
 	}
+	//文件末尾不足以容纳长度字段
+	if len(lbz) < lenSize {
+		return nil, nil
+	}
 	l := int(deserializeUint32(lbz))
 	data, err := f.buf.ReadAt(pos+lenSize, l)
 	if err != nil {
 		return nil, err
 	}
 	f.offset = pos + int64(lenSize+l)
-	c := deserializeUint32(data)
-	return &LogEntry{
-		Len:   l,
-		Crc32: c,
-		Typ:   int8(data[crc32Size]),
-		Data:  data[crc32Size+typeSize:],
-	}, nil
+	return f.decodeLog(l, data), nil
 }
 
 func (f *logfile) readNoBuffer(pos int64) (*LogEntry, error) {
@@ -178,13 +292,42 @@ func (f *logfile) readNoBuffer(pos int64) (*LogEntry, error) {
 		return nil, err
 	}
 	f.offset = pos + int64(n+lenSize)
-	c := deserializeUint32(dbz)
-	return &LogEntry{
-		Len:   l,
-		Crc32: c,
-		Typ:   int8(dbz[crc32Size]),
-		Data:  dbz[crc32Size+typeSize:],
-	}, nil
+	return f.decodeLog(l, dbz), nil
+}
+
+//WriteRaw 在当前写入位置写入不带日志格式的原始数据，用于写入段头
+func (f *logfile) WriteRaw(b []byte) (int, error) {
+	if f.hasBuffer() {
+		buf, err := f.buf.NextAt(f.offset, len(b))
+		if err != nil {
+			return 0, err
+		}
+		copy(buf, b)
+		f.offset += int64(len(b))
+		return len(b), nil
+	}
+	n, err := f.WriteAt(b, f.offset)
+	if err == nil {
+		f.offset += int64(n)
+	}
+	return n, err
+}
+
+//ReadRaw 从pos处读取最多n个字节的原始数据，文件长度不足时返回的数据长度小于n
+func (f *logfile) ReadRaw(pos int64, n int) ([]byte, error) {
+	if f.hasBuffer() {
+		b, err := f.buf.ReadAt(pos, n)
+		if err == io.EOF {
+			return nil, nil
+		}
+		return b, err
+	}
+	b := make([]byte, n)
+	rn, err := f.LwsFile.ReadAt(b, pos)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return b[:rn], nil
 }
 
 func (f *logfile) WriteBack() error {
@@ -204,6 +347,18 @@ func (f *logfile) Sync() error {
 	return f.sync()
 }
 
+//Refresh 同步底层文件的大小并丢弃读缓存，使其他writer新写入文件的数据可见
+func (f *logfile) Refresh() error {
+	if !f.hasBuffer() {
+		return nil
+	}
+	size := f.LwsFile.Size()
+	if size < 0 {
+		return errors.WithMessage(syscall.EAGAIN, "logfile-refresh")
+	}
+	return f.buf.Refresh(size)
+}
+
 func (f *logfile) Truncate(size int64) error {
 	if err := f.LwsFile.Truncate(size); err != nil {
 		return err
@@ -7,8 +7,10 @@ SPDX-License-Identifier: Apache-2.0
 package lws
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"os"
 	"path"
 	"path/filepath"
@@ -17,10 +19,15 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"chainmaker.org/chainmaker/lws/dsl"
 )
 
+//LockFileName 日志目录锁文件的名称，文件名前会加上FilePrefix，离线工具需对同一文件加锁以与写入实例互斥
+const LockFileName = "LOCK"
+
 var (
 	timeDelay   = 1000 //ms
 	defaultOpts = Options{
@@ -30,11 +37,21 @@ var (
 		Wf:            WF_TIMEDFLUSH,
 		FlushQuota:    timeDelay,
 		BufferSize:    -1, //-1无配置
+		Checksum:      ChecksumIEEE,
 	}
 
 	fileReg             = `%s\d{5}_\d+\.%s`
+	firstIndexFileName  = "FIRST" //记录清理到文件中间时日志条目的起始索引
 	ErrPurgeWorkExisted = errors.New("purge work has been performed")
 	ErrPurgeNotReached  = errors.New("purge threshold not reached")
+	ErrIndexOutOfRange  = errors.New("index out of range")
+	ErrNotFound         = errors.New("log entry not found")
+	ErrCompacted        = errors.New("log entry has been compacted")
+	ErrClosed           = errors.New("lws has been closed")
+	ErrLocked           = errors.New("log directory is locked by another lws instance")
+	ErrReadOnly         = errors.New("lws is opened in read-only mode")
+	ErrBroken           = errors.New("lws is broken by a partially failed truncation, reopen it to recover")
+	ErrTruncated        = errors.New("log entries have been truncated")
 
 	InitID    = 1
 	InitIndex = 1
@@ -55,6 +72,16 @@ type Lws struct {
 	writeNoticeCh    chan writeNoticeType //notice purge go routine that a new log/a new file has been writed
 	closeCh          chan struct{}
 	coders           *coderMap
+	appendMu         sync.Mutex
+	appendCh         chan struct{}   //有新日志写入或刷盘时关闭，用于唤醒等待的tail迭代器
+	subs             subscriberSet   //新写入日志条目的订阅者
+	readOnly         bool            //只读模式，不创建SegmentWriter，拒绝所有写入及清理操作
+	dirLock          dirLocker       //日志目录锁，读写模式加排他锁，只读模式加共享锁
+	backend          Backend         //日志路径的协议对应的存储后端
+	store            storage         //日志文件所在的存储
+	report           *RecoveryReport //打开时对最新文件中损坏数据的处理记录
+	broken           error           //截断中途失败后记录的错误，之后拒绝写入及截断
+	truncs           *truncation     //最近一次尾部截断之后的记录点，tail迭代器据此检测已返回的条目是否被截断
 }
 
 /*
@@ -86,17 +113,11 @@ func OpenWithDSL(sl *dsl.DSL, opt ...Opt) (*Lws, error) {
 		return nil, dsl.ErrNotSupport
 	}
 
-	lws := &Lws{
-		path:    sl.Path,
-		opts:    defaultOpts,
-		cond:    sync.NewCond(&sync.Mutex{}),
-		closeCh: make(chan struct{}),
-		coders:  newCoderMap(),
-	}
+	lws := newLws(sl)
 	if err := lws.open(opt...); err != nil {
 		return nil, err
 	}
-	if lws.opts.LogEntryCountLimitForPurge > 0 || lws.opts.LogFileLimitForPurge > 0 {
+	if lws.opts.LogEntryCountLimitForPurge > 0 || lws.opts.LogFileLimitForPurge > 0 || lws.opts.LogAgeLimitForPurge > 0 {
 		lws.writeNoticeCh = make(chan writeNoticeType)
 		go lws.cleanStartUp()
 	}
@@ -104,6 +125,58 @@ func OpenWithDSL(sl *dsl.DSL, opt ...Opt) (*Lws, error) {
 	return lws, nil
 }
 
+/*
+ @title: OpenReadOnly
+ @description: 以只读模式打开lws实例，不创建SegmentWriter，所有写入及清理操作返回ErrReadOnly，可通过Refresh同步写入实例的最新状态
+ 目录未被写入实例占用时加共享锁，阻止写入实例在此期间打开；目录已被写入实例占用时不加锁，跟随写入实例读取已写入文件的日志
+ @param {string} path 日志文件存放路径
+ @param {...Opt} opt 打开日志写入系统的参数配置
+ @return {*Lws} 日志写入系统实例句柄
+ @return {error} 错误信息
+*/
+func OpenReadOnly(path string, opt ...Opt) (*Lws, error) {
+	sl, err := dsl.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	if !dsl.IsSupportedForSchema(sl.Schema) {
+		return nil, dsl.ErrNotSupport
+	}
+	lws := newLws(sl)
+	lws.readOnly = true
+	if err := lws.open(opt...); err != nil {
+		return nil, err
+	}
+	return lws, nil
+}
+
+//resolveBackend mem://路径下的日志只使用内存文件，磁盘以外的后端不支持内存映射
+func (l *Lws) resolveBackend() {
+	switch l.backend.(type) {
+	case memBackend:
+		l.opts.Ft = FT_MEMORY
+	case diskBackend:
+		l.backend = backendOf(l.opts.Ft)
+	default:
+		if l.opts.Ft == FT_MMAP {
+			l.opts.Ft = FT_NORMAL
+		}
+	}
+	l.store = storage{l.backend}
+}
+
+func newLws(sl *dsl.DSL) *Lws {
+	return &Lws{
+		path:    sl.Path,
+		backend: getBackend(sl.Schema),
+		opts:    defaultOpts,
+		cond:    sync.NewCond(&sync.Mutex{}),
+		closeCh: make(chan struct{}),
+		coders:  newCoderMap(),
+		truncs:  &truncation{},
+	}
+}
+
 func (l *Lws) open(opt ...Opt) error {
 	var (
 		err error
@@ -111,6 +184,135 @@ func (l *Lws) open(opt ...Opt) error {
 	for _, o := range opt {
 		o(&l.opts)
 	}
+	if err = l.checkArchiver(l.opts.Archiver); err != nil {
+		return err
+	}
+	l.resolveBackend()
+	if l.readOnly {
+		//内存存储中没有目录，无需检查
+		if _, err = l.store.Stat(l.path); err != nil && l.opts.Ft != FT_MEMORY {
+			return err
+		}
+	} else if err = l.store.MkdirAll(l.path); err != nil {
+		return err
+	}
+	//对日志目录加锁，防止多个实例同时写入同一目录下的日志文件
+	if err = l.lockDir(); err != nil {
+		return err
+	}
+	if l.readOnly {
+		err = l.loadReadOnly()
+	} else {
+		err = l.load()
+	}
+	if err != nil {
+		l.dirLock.Unlock()
+	}
+	return err
+}
+
+func (l *Lws) lockDir() error {
+	l.dirLock = l.store.Locker(filepath.Join(l.path, l.opts.FilePrefix+LockFileName))
+	if l.readOnly {
+		//只读介质上无法创建锁文件，也不会有写入实例，无需加锁
+		if err := l.dirLock.RLock(); err != nil && !errors.Is(err, ErrLocked) && !errors.Is(err, syscall.EROFS) {
+			return err
+		}
+		return nil
+	}
+	return l.dirLock.Lock()
+}
+
+//loadReadOnly 只读模式下根据已有的wal文件计算日志条目的索引范围
+func (l *Lws) loadReadOnly() error {
+	l.segments.Lock()
+	err := l.buildSegments()
+	l.segments.Unlock()
+	if err != nil {
+		return err
+	}
+	return l.loadIndexRange()
+}
+
+//loadIndexRange 根据segment信息及最新文件中的有效条目计算日志条目的索引范围
+func (l *Lws) loadIndexRange() error {
+	if l.segments.Len() == 0 {
+		l.firstIndex = uint64(InitIndex)
+		l.lastIndex = l.firstIndex - 1
+		return nil
+	}
+	last := l.segments.Last()
+	rd, err := l.findReaderByIndex(last.Index)
+	if err != nil {
+		return err
+	}
+	//缓存的reader可能创建于文件写入之前，需重新加载
+	if err = rd.Reload(); err != nil {
+		return err
+	}
+	l.currentSegmentID = last.ID
+	l.lastIndex = rd.LastIndex()
+	l.firstIndex = l.startIndex()
+	return nil
+}
+
+/*
+ @title: Refresh
+ @description: 只读模式下重新扫描日志目录，同步写入实例新写入、清理及截断后的状态，读写模式下直接返回
+ 需等待所有迭代器释放之后才会进行，请勿在持有迭代器时调用
+ @return {error} 错误信息
+*/
+func (l *Lws) Refresh() error {
+	if !l.readOnly {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	//等待迭代器都释放掉才可以重置reader
+	l.cond.L.Lock()
+	for l.readCount > 0 {
+		l.cond.Wait()
+	}
+	defer l.cond.L.Unlock()
+
+	l.segments.Lock()
+	old := make(map[uint64]struct{}, l.segments.Len())
+	l.segments.ForEach(func(i int, s *Segment) bool {
+		old[s.ID] = struct{}{}
+		return false
+	})
+	err := l.buildSegments()
+	if err == nil {
+		l.segments.ForEach(func(i int, s *Segment) bool {
+			delete(old, s.ID)
+			return false
+		})
+	}
+	l.segments.Unlock()
+	if err != nil {
+		return err
+	}
+	//清理或截断已删除的文件，其reader需关闭
+	for id := range old {
+		if rd := l.readCache.DeleteReader(id); rd != nil {
+			rd.Close()
+		}
+	}
+	//最新文件被截断时，reader中记录的条目已失效
+	if l.segments.Len() > 0 {
+		last := l.segments.Last()
+		if rd := l.readCache.GetReader(last.ID); rd != nil && int64(rd.end) > last.Size {
+			l.readCache.DeleteReader(last.ID)
+			rd.Close()
+		}
+	}
+	return l.loadIndexRange()
+}
+
+func (l *Lws) load() error {
+	var (
+		err error
+	)
 	//构建所有wal文件的segment信息
 	if err = l.buildSegments(); err != nil {
 		return err
@@ -127,30 +329,74 @@ func (l *Lws) open(opt ...Opt) error {
 	}
 	currentSegment := l.segments.Last()
 	l.currentSegmentID = currentSegment.ID
+	//最新文件会继续写入，封存时生成的附属文件已失效
+	if err = removeSidecars(l.store, currentSegment.Path); err != nil {
+		return err
+	}
 	//根据最新文件的segment信息创建SegmentWriter用于写wal日志
-	l.sw, err = NewSegmentWriter(currentSegment, WriterOptions{
-		SegmentSize: l.opts.SegmentSize,
-		Ft:          l.opts.Ft,
-		Wf:          l.opts.Wf,
-		Fv:          l.opts.FlushQuota,
-		MapLock:     l.opts.MmapFileLock,
-		BufferSize:  l.opts.BufferSize,
-	})
+	l.sw, err = NewSegmentWriter(currentSegment, l.writerOptions())
 	if err != nil {
 		return err
 	}
+	l.report = l.sw.report
 	//计算日志条目的最新索引
 	l.lastIndex = currentSegment.Index + uint64(l.sw.EntryCount()) - 1
 	//计算日志条目的起始索引
-	l.firstIndex = l.segments.First().Index
+	l.firstIndex = l.startIndex()
 
 	return nil
 }
 
-func (l *Lws) buildSegments() error {
-	if err := os.MkdirAll(l.path, 0777); err != nil {
-		return err
+//startIndex 计算日志条目的起始索引，清理到文件中间时起始索引之前的条目仍在第一个文件中，以持久化的起始索引为准
+func (l *Lws) startIndex() uint64 {
+	first := l.segments.First().Index
+	if saved := l.loadFirstIndex(); saved > first && saved <= l.lastIndex+1 {
+		first = saved
 	}
+	return first
+}
+
+func (l *Lws) firstIndexPath() string {
+	return filepath.Join(l.path, l.opts.FilePrefix+firstIndexFileName)
+}
+
+//saveFirstIndex 持久化日志条目的起始索引，布局(大端)：index[8] | crc32[4]
+func (l *Lws) saveFirstIndex(index uint64) error {
+	b := make([]byte, 8+crc32Size)
+	binary.BigEndian.PutUint64(b, index)
+	binary.BigEndian.PutUint32(b[8:], crc32.ChecksumIEEE(b[:8]))
+	return l.store.WriteFile(l.firstIndexPath(), b)
+}
+
+//loadFirstIndex 读取持久化的起始索引，文件不存在或已损坏时返回0
+func (l *Lws) loadFirstIndex() uint64 {
+	b, err := l.store.ReadFile(l.firstIndexPath())
+	if err != nil || len(b) != 8+crc32Size || binary.BigEndian.Uint32(b[8:]) != crc32.ChecksumIEEE(b[:8]) {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (l *Lws) writerOptions() WriterOptions {
+	return WriterOptions{
+		SegmentSize: l.opts.SegmentSize,
+		Ft:          l.opts.Ft,
+		Wf:          l.opts.Wf,
+		Fv:          l.opts.FlushQuota,
+		MapLock:     l.opts.MmapFileLock,
+		BufferSize:  l.opts.BufferSize,
+		OnFlush:     l.onFlush,
+		Checksum:    l.opts.Checksum,
+		Compression: l.opts.Compression,
+		Encryptor:   l.opts.Encryptor,
+		HashChain:   l.opts.HashChain,
+		Recovery:    l.opts.Recovery,
+		Backend:     l.backend,
+		Merkle:      l.opts.Merkle,
+	}
+}
+
+func (l *Lws) buildSegments() error {
 	//根据wal命名规则匹配文件夹下所有wal文件
 	names, err := l.matchFiles()
 	if err != nil {
@@ -175,39 +421,76 @@ func (l *Lws) buildSegments() error {
 	return nil
 }
 
+/*
+ @title: ListSegments
+ @description: 列出日志目录下所有wal文件的段信息，不打开lws实例也不加锁，用于离线的检查及修复工具
+ @param {string} dir 日志文件存放路径，与Open一样可以带有存储后端的协议
+ @param {...Opt} opt 参数配置，根据其中的FilePrefix及FileExtension匹配wal文件
+ @return {[]*Segment} 按文件编号排序的段信息
+ @return {error} 错误信息
+*/
+func ListSegments(dir string, opt ...Opt) ([]*Segment, error) {
+	sl, err := dsl.Parse(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !dsl.IsSupportedForSchema(sl.Schema) {
+		return nil, dsl.ErrNotSupport
+	}
+	l := newLws(sl)
+	for _, o := range opt {
+		o(&l.opts)
+	}
+	l.resolveBackend()
+	if err := l.buildSegments(); err != nil {
+		return nil, err
+	}
+	segs := make([]*Segment, 0, l.segments.Len())
+	l.segments.ForEach(func(i int, s *Segment) bool {
+		s.backend = l.backend
+		segs = append(segs, s)
+		return false
+	})
+	return segs, nil
+}
+
 //根据wal命名规则匹配文件夹下所有wal文件
 func (l *Lws) matchFiles() ([]string, error) {
 	reg, err := regexp.Compile(fmt.Sprintf(fileReg, l.opts.FilePrefix, l.opts.FileExtension))
 	if err != nil {
 		return nil, err
 	}
+	files, err := l.store.List(l.path)
+	if err != nil {
+		return nil, err
+	}
 	var (
 		names []string
 	)
-	err = filepath.Walk(l.path, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			if reg.Match([]byte(info.Name())) {
-				names = append(names, info.Name())
-			}
+	for _, name := range files {
+		if reg.Match([]byte(name)) {
+			names = append(names, name)
 		}
-		return nil
-	})
-
-	return names, err
+	}
+	return names, nil
 }
 
 func (l *Lws) fileSize(file string) int64 {
-	s, err := os.Stat(file)
+	size, err := l.store.Stat(file)
 	if err != nil {
 		return 0
 	}
-	return s.Size()
+	return size
 }
 
 func (l *Lws) rollover() error {
+	//封存当前文件，写入其附属文件
+	if err := l.sealSegment(); err != nil {
+		return err
+	}
+	l.segments.Lock()
+	l.segments.Last().Sealed = time.Now()
+	l.segments.Unlock()
 	l.currentSegmentID++
 	s := &Segment{
 		ID:    l.currentSegmentID,
@@ -270,15 +553,45 @@ func (l *Lws) WriteRetIndex(typ int8, obj interface{}) (uint64, error) {
 }
 
 func (l *Lws) write(typ int8, obj interface{}) (uint64, error) {
+	if l.readOnly {
+		return 0, ErrReadOnly
+	}
 	t, data, err := l.encodeObj(typ, obj) //序列化obj对象
 	if err != nil {
-		return 0, nil
+		return 0, err
+	}
+	return l.writeEntry(t, data)
+}
+
+/*
+ @title: WriteEntry
+ @description: 将已经序列化的数据按照typ类型写入文件，不经过Coder编码，用于日志的导入及转存
+ @param {int8} typ 日志条目的类型，不可为系统保留的负数类型
+ @param {[]byte} data 日志数据
+ @return {uint64} 成功返回entry的索引值
+ @return {error} 错误信息
+*/
+func (l *Lws) WriteEntry(typ int8, data []byte) (uint64, error) {
+	if l.readOnly {
+		return 0, ErrReadOnly
+	}
+	if typ < RawCoderType {
+		return 0, ErrCodeSysType
 	}
+	return l.writeEntry(typ, data)
+}
+
+//writeEntry 写入序列化后的日志条目，必要时分割文件
+func (l *Lws) writeEntry(t int8, data []byte) (uint64, error) {
 	var (
 		writeNotice writeNoticeType //写入通知信息，用于通知purgework有新日志写入
+		err         error
 	)
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if l.broken != nil {
+		return 0, l.broken
+	}
 	//判断是否需要分割文件
 	if l.opts.SegmentSize > 0 && l.sw.Size() > l.opts.SegmentSize {
 		writeNotice |= newFile //如果创建新文件则通知信息中加入newFile类型
@@ -292,9 +605,69 @@ func (l *Lws) write(typ int8, obj interface{}) (uint64, error) {
 	writeNotice |= newLog //写log成功则在通知信息中加入newLog类型
 	l.lastIndex++
 	l.writeNotice(writeNotice)
+	l.notifyAppend()
+	if l.subs.active() {
+		l.publishEntries(l.lastIndex, []*LogEntry{{Typ: t, Data: data}})
+	}
 	return l.lastIndex, nil
 }
 
+/*
+ @title: WriteBatch
+ @description: 将批量中的日志条目作为一个整体连续写入文件，整批只进行一次刷盘检测
+ @param {*Batch} b 批量日志条目
+ @return {uint64} 批量中第一个entry的索引值
+ @return {uint64} 批量中最后一个entry的索引值
+ @return {error} 错误信息
+*/
+func (l *Lws) WriteBatch(b *Batch) (uint64, uint64, error) {
+	if l.readOnly {
+		return 0, 0, ErrReadOnly
+	}
+	if b == nil || b.Len() == 0 {
+		return 0, 0, ErrEmptyBatch
+	}
+	//序列化批量中所有的obj对象
+	entries := make([]*LogEntry, b.Len())
+	for i, e := range b.entries {
+		t, data, err := l.encodeObj(e.typ, e.obj)
+		if err != nil {
+			return 0, 0, err
+		}
+		entries[i] = &LogEntry{
+			Typ:  t,
+			Data: data,
+		}
+	}
+	var (
+		writeNotice writeNoticeType
+	)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.broken != nil {
+		return 0, 0, l.broken
+	}
+	//批量不会跨文件写入，故只在写入前判断是否需要分割文件
+	if l.opts.SegmentSize > 0 && l.sw.Size() > l.opts.SegmentSize {
+		writeNotice |= newFile
+		if err := l.rollover(); err != nil {
+			return 0, 0, err
+		}
+	}
+	if _, err := l.sw.WriteBatch(entries); err != nil {
+		return 0, 0, err
+	}
+	writeNotice |= newLog
+	first := l.lastIndex + 1
+	l.lastIndex += uint64(len(entries))
+	l.writeNotice(writeNotice)
+	l.notifyAppend()
+	if l.subs.active() {
+		l.publishEntries(first, entries)
+	}
+	return first, l.lastIndex, nil
+}
+
 func (l *Lws) encodeObj(t int8, obj interface{}) (int8, []byte, error) {
 	data, ok := obj.([]byte)
 	if !ok {
@@ -333,12 +706,167 @@ func (l *Lws) NewLogIterator() *EntryIterator {
 	return it
 }
 
+/*
+ @title: NewRangeIterator
+ @description: 生成[from, to]范围内的日志条目迭代器，用于从指定的索引开始回放日志
+ @param {uint64} from 迭代的起始索引
+ @param {uint64} to 迭代的结束索引
+ @return {*EntryIterator} 日志条目迭代器
+ @return {error} from小于起始索引返回ErrCompacted，to大于最新索引返回ErrNotFound
+*/
+func (l *Lws) NewRangeIterator(from, to uint64) (*EntryIterator, error) {
+	if from > to {
+		return nil, ErrIndexOutOfRange
+	}
+	l.readRequest()
+	l.mu.Lock()
+	first, last := l.firstIndex, l.lastIndex
+	l.mu.Unlock()
+	if from < first {
+		l.readRelease()
+		return nil, ErrCompacted
+	}
+	if to > last {
+		l.readRelease()
+		return nil, ErrNotFound
+	}
+	return newEntryIterator(
+		&walContainer{
+			wal:   l,
+			first: from,
+			last:  to,
+		},
+	), nil
+}
+
+/*
+ @title: ReadEntry
+ @description: 通过索引读取日志条目，无需创建迭代器，读取期间会短暂阻止清理程序
+ @param {uint64} index 日志条目的索引
+ @return {*LogEntry} 日志条目，其数据为拷贝，可以安全持有
+ @return {error} 索引大于最新索引返回ErrNotFound，小于起始索引返回ErrCompacted
+*/
+func (l *Lws) ReadEntry(index uint64) (*LogEntry, error) {
+	l.readRequest()
+	defer l.readRelease()
+	l.mu.Lock()
+	first, last := l.firstIndex, l.lastIndex
+	l.mu.Unlock()
+	if index < first {
+		return nil, ErrCompacted
+	}
+	if index > last {
+		return nil, ErrNotFound
+	}
+	sr, err := l.findReaderByIndex(index)
+	if err != nil {
+		return nil, err
+	}
+	sr.Obtain()
+	defer sr.Release()
+	le, err := sr.ReadLogByIndex(index)
+	if err != nil {
+		return nil, err
+	}
+	if le == nil {
+		return nil, ErrNotFound
+	}
+	//reader读出的数据指向其缓存区，缓存区会被复用或释放，故进行拷贝
+	data := make([]byte, len(le.Data))
+	copy(data, le.Data)
+	return &LogEntry{
+		Len:  le.Len,
+		Sum:  le.Sum,
+		Typ:  le.Typ,
+		Data: data,
+	}, nil
+}
+
+/*
+ @title: Read
+ @description: 通过索引读取日志条目的数据
+ @param {uint64} index 日志条目的索引
+ @return {[]byte} 日志数据
+ @return {error} 错误信息
+*/
+func (l *Lws) Read(index uint64) ([]byte, error) {
+	le, err := l.ReadEntry(index)
+	if err != nil {
+		return nil, err
+	}
+	return le.Data, nil
+}
+
+/*
+ @title: ReadObj
+ @description: 通过索引读取日志条目，并通过注册的Coder解码成对象
+ @param {uint64} index 日志条目的索引
+ @return {interface{}} 解码后的对象，字节类型的条目直接返回数据
+ @return {error} 错误信息
+*/
+func (l *Lws) ReadObj(index uint64) (interface{}, error) {
+	le, err := l.ReadEntry(index)
+	if err != nil {
+		return nil, err
+	}
+	return decodeEntry(le, l.coders.GetCoder)
+}
+
+//FirstIndex 返回日志条目的起始索引
+func (l *Lws) FirstIndex() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.firstIndex
+}
+
+//LastIndex 返回最新写入的日志条目的索引
+func (l *Lws) LastIndex() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastIndex
+}
+
+//Stats lws的状态统计信息
+type Stats struct {
+	FirstIndex   uint64 //日志条目的起始索引
+	LastIndex    uint64 //最新写入的日志条目的索引
+	EntryCount   uint64 //日志条目的数量
+	SegmentCount int    //wal文件的数量
+	Size         int64  //所有wal文件占用的磁盘大小
+	ReadOnly     bool   //是否以只读模式打开
+}
+
+//Stats 返回lws当前的状态统计信息，只读模式下为最近一次Refresh时的状态
+func (l *Lws) Stats() Stats {
+	l.mu.Lock()
+	st := Stats{
+		FirstIndex: l.firstIndex,
+		LastIndex:  l.lastIndex,
+		ReadOnly:   l.readOnly,
+	}
+	l.mu.Unlock()
+	if st.LastIndex+1 > st.FirstIndex {
+		st.EntryCount = st.LastIndex + 1 - st.FirstIndex
+	}
+	l.segments.RLock()
+	defer l.segments.RUnlock()
+	st.SegmentCount = l.segments.Len()
+	l.segments.ForEach(func(i int, s *Segment) bool {
+		st.Size += l.fileSize(s.Path)
+		return false
+	})
+	return st
+}
+
 /*
  @title: Flush
  @description: 手动将写入的日志条目强制刷盘
  @return {error} 错误信息
 */
 func (l *Lws) Flush() error {
+	if l.readOnly {
+		return ErrReadOnly
+	}
 	return l.sw.Flush()
 }
 
@@ -349,46 +877,80 @@ func (l *Lws) Flush() error {
  @return {error} 错误信息
 */
 func (l *Lws) Purge(opt ...PurgeOpt) error {
+	if l.readOnly {
+		return ErrReadOnly
+	}
 	opts := PurgeOptions{}
 	for _, o := range opt {
 		o(&opts)
 	}
+	if err := l.checkArchiver(opts.archiver); err != nil {
+		return err
+	}
 	switch opts.mode {
 	case purgeModAsync:
-		go l.purge(opts.purgeLimit)
+		go l.purge(opts.purgeLimit, opts.archiver)
 	case purgeModSync:
-		return l.purge(opts.purgeLimit)
+		return l.purge(opts.purgeLimit, opts.archiver)
 	}
 	return nil
 }
 
-func (l *Lws) purge(limit purgeLimit) error {
-	//根据限额指标（文件保留数&日志条目保留数)，创建PurgeWorker
-	pworker := newPurgeWorker(limit)
-	pool := segmentWaterPool{
-		rwlockSegmentGroup: &l.segments,
-		lastIndex:          l.lastIndex,
+//purge archiver为nil时使用Options中配置的归档器
+func (l *Lws) purge(limit purgeLimit, archiver Archiver) error {
+	pool := l.waterPool()
+	//起始索引最多调整到最新日志条目之后
+	if limit.purgeBefore > pool.lastIndex+1 {
+		limit.purgeBefore = pool.lastIndex + 1
+	}
+	//根据限额指标（文件保留数&日志条目保留数&清理的索引)，创建PurgeWorker
+	if archiver == nil {
+		archiver = l.opts.Archiver
 	}
+	pworker := newPurgeWorker(limit, l.store, archiver)
 	//探测是否需要进行清理工作，以减少后续的资源竞争
 	if !pworker.Probe(pool) {
 		return nil
 	}
-	//清理加锁，如果加锁失败，说明目前有清理程序正在工作
-	gurder := pworker.Guard()
-	if gurder == nil {
+	//清理加锁，如果加锁失败，说明目前有清理程序正在工作；清理到指定的索引是调用者明确要求的截断，需等待正在进行的清理结束
+	var gurder *purgeGuarder
+	if limit.purgeBefore > 0 {
+		gurder = pworker.Wait()
+		//等待期间其他清理可能已经完成，需根据最新的状态重新探测
+		if pool = l.waterPool(); !pworker.Probe(pool) {
+			gurder.Release()
+			return nil
+		}
+	} else if gurder = pworker.Guard(); gurder == nil {
 		return ErrPurgeWorkExisted
 	}
 	defer gurder.Release()
+	//清理到指定的索引时，起始索引可能位于边界文件的中间，需在删除文件前持久化，重新打开后依然不会读到其之前的条目
+	if limit.purgeBefore > pool.firstIndex {
+		if err := l.saveFirstIndex(limit.purgeBefore); err != nil {
+			return err
+		}
+	}
 	//等待wal迭代器都释放掉才可以进行清理工作
 	l.cond.L.Lock()
 	for l.readCount > 0 {
 		l.cond.Wait()
 	}
+	locked := true
 	//purgeworker会检测到要清理到的边界文件Segment，lws根据边界文件的信息进行本身状态重置
 	callBack := func(boundary *Segment) {
 		if boundary != nil {
-			l.firstIndex = boundary.Index
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			//起始索引只会增长，边界文件为第一个文件时，其中已清理的条目不会重新可读
+			if boundary.Index > l.firstIndex {
+				l.firstIndex = boundary.Index
+			}
+			if limit.purgeBefore > l.firstIndex {
+				l.firstIndex = limit.purgeBefore
+			}
 			l.cond.L.Unlock()
+			locked = false
 			l.segments.Lock()
 			defer l.segments.Unlock()
 			var at int
@@ -399,18 +961,159 @@ func (l *Lws) purge(limit purgeLimit) error {
 					}
 					return false
 				}
-				at = i - 1
+				at = i
 				return true
 			})
-			if at >= 0 {
+			if at > 0 {
 				_, l.segments.SegmentGroup = l.segments.Split(at)
 			}
 		}
 	}
-	return pworker.Purge(segmentWaterPool{
-		rwlockSegmentGroup: &l.segments,
+	//等待期间可能有新的文件写入，重新获取快照
+	err := pworker.Purge(l.waterPool(), callBack)
+	//没有找到边界文件时，回调不会被调用，需在此处释放锁
+	if locked {
+		l.cond.L.Unlock()
+	}
+	return err
+}
+
+//waterPool 在写锁内生成segment及索引范围的快照，清理程序据此计算，不会与写入及文件分割并发访问segment
+//最后一个segment为正在写入的文件，其前一个文件封存的时间为当前文件的创建时间，从writer的段头中获取，清理程序无需打开正在写入的文件
+func (l *Lws) waterPool() segmentWaterPool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.segments.RLock()
+	group := make(SegmentGroup, l.segments.Len())
+	l.segments.ForEach(func(i int, s *Segment) bool {
+		cp := *s
+		group[i] = &cp
+		return false
+	})
+	l.segments.RUnlock()
+	if n := len(group); n > 1 && group[n-2].Sealed.IsZero() && l.sw != nil {
+		if h := l.sw.Header(); h != nil {
+			group[n-2].Sealed = h.CreateTime
+		}
+	}
+	return segmentWaterPool{
+		rwlockSegmentGroup: &rwlockSegmentGroup{SegmentGroup: group},
+		firstIndex:         l.firstIndex,
 		lastIndex:          l.lastIndex,
-	}, callBack)
+	}
+}
+
+/*
+ @title: TruncateFront
+ @description: 删除index之前的所有日志条目，一般用于快照持久化后丢弃已经安全的日志，完全位于index之前的文件会被删除，index所在的文件会被保留，有其他清理正在进行时等待其结束，不会返回ErrPurgeWorkExisted
+ @param {uint64} index 保留的第一个日志条目的索引
+ @return {error} 错误信息
+*/
+func (l *Lws) TruncateFront(index uint64) error {
+	if l.readOnly {
+		return ErrReadOnly
+	}
+	if index > l.LastIndex()+1 {
+		return ErrIndexOutOfRange
+	}
+	return l.purge(purgeLimit{
+		purgeBefore: index,
+	}, nil)
+}
+
+/*
+ @title: TruncateBack
+ @description: 删除index之后的所有日志条目，用于日志冲突时丢弃分叉的尾部日志，index之后的文件会被删除，index所在的文件会被截断
+ 需等待所有迭代器释放之后才会进行，请勿在持有迭代器时调用；已收到被删除条目的订阅者会收到截断事件，tail迭代器返回ErrTruncated
+ @param {uint64} index 保留的最后一个日志条目的索引
+ @return {error} 错误信息，删除或截断文件中途失败时之后的写入返回ErrBroken，重新打开后恢复到文件中连续的日志
+*/
+func (l *Lws) TruncateBack(index uint64) error {
+	if l.readOnly {
+		return ErrReadOnly
+	}
+	//等待迭代器都释放掉才可以删除及截断文件，截断期间阻止新的读取
+	l.cond.L.Lock()
+	for l.readCount > 0 {
+		l.cond.Wait()
+	}
+	defer l.cond.L.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.broken != nil {
+		return l.broken
+	}
+	if index == l.lastIndex {
+		return nil
+	}
+	if index > l.lastIndex || index+1 < l.firstIndex {
+		return ErrIndexOutOfRange
+	}
+	//边界文件为第一个要删除的条目所在的文件
+	boundary := l.findSegmentByIndex(index + 1)
+	var (
+		at    int
+		later []*Segment
+	)
+	l.segments.RLock()
+	l.segments.ForEach(func(i int, s *Segment) bool {
+		if s.ID == boundary.ID {
+			at = i
+		} else if s.ID > boundary.ID {
+			later = append(later, s)
+		}
+		return false
+	})
+	l.segments.RUnlock()
+	//边界文件不是当前写入的文件，先在边界文件上打开新的writer，成功后再关闭当前的writer，失败时当前的writer保持可用
+	if boundary.ID != l.currentSegmentID {
+		sw, err := NewSegmentWriter(boundary, l.writerOptions())
+		if err != nil {
+			return err
+		}
+		if err = l.sw.Close(); err != nil {
+			sw.Close()
+			return err
+		}
+		l.sw = sw
+		l.report = sw.report
+		l.currentSegmentID = boundary.ID
+	}
+	//writer已切换到边界文件，之后中途失败时内存中的状态与文件不再一致，拒绝之后的写入
+	//文件从后往前删除，最后截断边界文件，故中途失败时文件中的日志依然连续，重新打开即可恢复
+	fail := func(err error) error {
+		l.broken = fmt.Errorf("%w: %v", ErrBroken, err)
+		return err
+	}
+	for i := len(later) - 1; i >= 0; i-- {
+		if rd := l.readCache.DeleteReader(later[i].ID); rd != nil {
+			rd.Close()
+		}
+		if err := l.store.Remove(later[i].Path); err != nil && !os.IsNotExist(err) {
+			return fail(err)
+		}
+		if err := removeSidecars(l.store, later[i].Path); err != nil {
+			return fail(err)
+		}
+	}
+	//边界文件截断后会继续写入，需重新封存
+	if err := removeSidecars(l.store, boundary.Path); err != nil {
+		return fail(err)
+	}
+	if rd := l.readCache.DeleteReader(boundary.ID); rd != nil {
+		rd.Close()
+	}
+	if err := l.sw.TruncateEntries(int(index + 1 - boundary.Index)); err != nil {
+		return fail(err)
+	}
+	l.segments.Lock()
+	l.segments.SegmentGroup, _ = l.segments.Split(at + 1)
+	l.segments.Unlock()
+	l.lastIndex = index
+	l.truncs = l.truncs.record(index)
+	l.subs.truncate(index)
+	l.notifyAppend()
+	return nil
 }
 
 /*
@@ -422,46 +1125,91 @@ func (l *Lws) purge(limit purgeLimit) error {
  @return {error} 错误信息
 */
 func (l *Lws) WriteToFile(file string, typ int8, obj interface{}) error {
-	//检测要写的文件是否与wal命名规则相同，如果相同则阻值
-	reg, err := regexp.Compile(fmt.Sprintf(fileReg, l.opts.FilePrefix, l.opts.FileExtension))
+	if l.readOnly {
+		return ErrReadOnly
+	}
+	if err := l.checkFileName(file); err != nil {
+		return err
+	}
+	t, data, err := l.encodeObj(typ, obj)
 	if err != nil {
 		return err
 	}
-	if reg.Match([]byte(file)) {
-		return errors.New("the file name is invalid: filename should circumvent the wal filename rules")
+	return l.writeEntriesToFile(file, []*LogEntry{{Typ: t, Data: data}})
+}
+
+/*
+ @title: WriteEntriesToFile
+ @description: 将已经序列化的日志条目依次写入到特定的文件中，用于日志的导入，文件名的限制同WriteToFile
+ @param {string} file 文件名
+ @param {[]*LogEntry} entries 日志条目，只使用其中的类型及数据
+ @return {error} 错误信息
+*/
+func (l *Lws) WriteEntriesToFile(file string, entries []*LogEntry) error {
+	if l.readOnly {
+		return ErrReadOnly
 	}
-	t, data, err := l.encodeObj(typ, obj)
+	if err := l.checkFileName(file); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Typ < RawCoderType {
+			return ErrCodeSysType
+		}
+	}
+	return l.writeEntriesToFile(file, entries)
+}
+
+//checkFileName 检测要写的文件是否与wal命名规则相同，如果相同则阻止
+func (l *Lws) checkFileName(file string) error {
+	reg, err := regexp.Compile(fmt.Sprintf(fileReg, l.opts.FilePrefix, l.opts.FileExtension))
 	if err != nil {
 		return err
 	}
+	if reg.Match([]byte(file)) {
+		return errors.New("the file name is invalid: filename should circumvent the wal filename rules")
+	}
+	return nil
+}
+
+func (l *Lws) writeEntriesToFile(file string, entries []*LogEntry) error {
 	//生成文件SegmentWriter对文件进行写入操作，因为一般此操作是一次性操作，故使用了普通文件无缓存的模式
 	sw, err := NewSegmentWriter(&Segment{
-		Path: path.Join(l.path, file),
+		Path:  path.Join(l.path, file),
+		Index: 1, //与ReadFromFile读取时的起始索引保持一致
 	}, WriterOptions{
-		Ft: FT_NORMAL,
-		Wf: WF_SYNCFLUSH,
+		Ft:        l.plainFileType(),
+		Wf:        WF_SYNCFLUSH,
+		Encryptor: l.opts.Encryptor,
+		Backend:   l.backend,
 	})
 	if err != nil {
 		return err
 	}
-	_, err = sw.Write(t, data)
-	return err
+	defer sw.Close()
+	for _, e := range entries {
+		if _, err = sw.Write(e.Typ, e.Data); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (l *Lws) ReadFromFile(file string) (*EntryIterator, error) {
 	path := path.Join(l.path, file)
-	finfo, err := os.Stat(path)
+	size, err := l.store.Stat(path)
 	if err != nil {
 		return nil, err
 	}
-	sr, err := NewSegmentReader(&Segment{
+	sr, err := newSegmentReader(&Segment{
 		Path:  path,
 		Index: 1,
-		Size:  finfo.Size(),
-	}, FT_NORMAL)
+		Size:  size,
+	}, l.plainFileType(), TruncateTail, l.backend)
 	if err != nil {
 		return nil, err
 	}
+	sr.setEncryptor(l.opts.Encryptor)
 	return newEntryIterator(
 		&fileContainer{
 			SegmentReader: sr,
@@ -469,27 +1217,60 @@ func (l *Lws) ReadFromFile(file string) (*EntryIterator, error) {
 		}), nil
 }
 
+//plainFileType 特定文件使用的文件类型，不使用内存映射
+func (l *Lws) plainFileType() FileType {
+	if l.opts.Ft == FT_MMAP {
+		return FT_NORMAL
+	}
+	return l.opts.Ft
+}
+
 func (l *Lws) findReaderByIndex(idx uint64) (*refReader, error) {
 	//根据index获取segment信息，如若为nil，说明index不在范围内
 	s := l.findSegmentByIndex(idx)
 	if s == nil {
-		return nil, errors.New("idx out of range")
+		return nil, ErrIndexOutOfRange
 	}
-	//从readCache中获取reader，如果不存在则通过传入的函数生成
-	return l.readCache.GetAndNewReader(s.ID, func() (*refReader, error) {
-		sr, err := NewSegmentReader(s, l.opts.Ft)
+	newReader := func() (*refReader, error) {
+		//正在写入的文件尾部可能有未写完的条目，只跳过中间的损坏条目，不做其他处理
+		recovery := TruncateTail
+		if s.ID < l.currentSegmentID || l.opts.Recovery == SkipCorrupt {
+			recovery = l.opts.Recovery
+		}
+		sr, err := newSegmentReader(s, l.opts.Ft, recovery, l.backend)
 		if err != nil {
 			return nil, err
 		}
+		sr.setEncryptor(l.opts.Encryptor)
 		return &refReader{
 			SegmentReader: sr,
 		}, nil
-	})
+	}
+	//从readCache中获取reader，如果不存在则通过传入的函数生成
+	rd, err := l.readCache.GetAndNewReader(s.ID, newReader)
+	if err != nil {
+		return nil, err
+	}
+	//reader创建之后写入当前文件的条目对其不可见，需将写缓存回写到文件后重新加载
+	if idx > rd.LastIndex() {
+		if l.sw != nil {
+			if err = l.sw.WriteBack(); err != nil {
+				return nil, err
+			}
+		}
+		if err = rd.Reload(); err != nil {
+			return nil, err
+		}
+	}
+	return rd, nil
 }
 
 func (l *Lws) findSegmentByIndex(idx uint64) *Segment {
 	l.segments.RLock()
 	defer l.segments.RUnlock()
+	if l.segments.Len() == 0 {
+		return nil
+	}
 	return l.segments.FindAt(idx)
 }
 
@@ -515,40 +1296,98 @@ func (l *Lws) writeNotice(nt writeNoticeType) {
 	}
 }
 
+//appendNotify 返回一个在有新日志写入或刷盘时被关闭的通道
+func (l *Lws) appendNotify() <-chan struct{} {
+	l.appendMu.Lock()
+	defer l.appendMu.Unlock()
+	if l.appendCh == nil {
+		l.appendCh = make(chan struct{})
+	}
+	return l.appendCh
+}
+
+//onFlush 刷盘成功后唤醒等待刷盘条目的tail迭代器，并推送已刷盘的事件
+func (l *Lws) onFlush() {
+	l.notifyAppend()
+	if l.subs.active() {
+		l.subs.flushed(l.sw.FlushedIndex())
+	}
+}
+
+//notifyAppend 唤醒所有等待新日志的tail迭代器，没有等待者时不做任何处理
+func (l *Lws) notifyAppend() {
+	l.appendMu.Lock()
+	if l.appendCh != nil {
+		close(l.appendCh)
+		l.appendCh = nil
+	}
+	l.appendMu.Unlock()
+}
+
 func (l *Lws) cleanStartUp() {
 	var (
 		fileCount  int
 		entryCount uint64
 		reassign   = func() {
+			l.mu.Lock()
 			fileCount = l.segments.Len()
 			entryCount = l.lastIndex - l.firstIndex + 1
+			l.mu.Unlock()
 		}
 	)
 	reassign() //初时化文件数目&日志条目数信息
+	limit := purgeLimit{
+		keepFiles:       l.opts.LogFileLimitForPurge,
+		keepSoftEntries: l.opts.LogEntryCountLimitForPurge,
+		maxAge:          l.opts.LogAgeLimitForPurge,
+	}
+	//按时长清理时定时检测，没有写入时文件也会过期
+	var tick <-chan time.Time
+	if limit.maxAge > 0 {
+		ticker := time.NewTicker(ageCheckInterval(limit.maxAge))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
 	for {
 		select {
 		case t := <-l.writeNoticeCh: //监听到写入通知
 			if t&newLog != 0 {
-				entryCount++
+				//批量写入一次通知包含多个条目，故根据索引重新计算条目数
+				l.mu.Lock()
+				entryCount = l.lastIndex - l.firstIndex + 1
+				l.mu.Unlock()
 			}
 			if t&newFile != 0 {
 				fileCount++
 			}
-			//判断是否需要进行文件清理
+			//判断是否需要进行文件清理，新建文件时有文件被封存，需检测其是否过期
 			if (l.opts.LogEntryCountLimitForPurge > 0 && entryCount > uint64(l.opts.LogEntryCountLimitForPurge)) ||
-				(l.opts.LogFileLimitForPurge > 0 && fileCount > l.opts.LogFileLimitForPurge) {
-				l.purge(purgeLimit{
-					keepFiles:       l.opts.LogFileLimitForPurge,
-					keepSoftEntries: l.opts.LogEntryCountLimitForPurge,
-				})
+				(l.opts.LogFileLimitForPurge > 0 && fileCount > l.opts.LogFileLimitForPurge) ||
+				(limit.maxAge > 0 && t&newFile != 0) {
+				l.purge(limit, nil)
 				reassign() //重置文件数目&日志条目数信息
 			}
+		case <-tick:
+			l.purge(limit, nil)
+			reassign()
 		case <-l.closeCh:
 			return
 		}
 	}
 }
 
+//ageCheckInterval 按时长清理的检测间隔，为保留时长的1/10，最长为purgeCheckInterval
+func ageCheckInterval(age time.Duration) time.Duration {
+	interval := age / 10
+	if interval > purgeCheckInterval {
+		interval = purgeCheckInterval
+	}
+	if interval <= 0 {
+		interval = age
+	}
+	return interval
+}
+
 func (l *Lws) RegisterCoder(c Coder) error {
 	return l.coders.RegisterCoder(c)
 }
@@ -558,7 +1397,11 @@ func (l *Lws) UnregisterCoder(t int8) error {
 }
 
 func (l *Lws) Close() {
-	l.sw.Close()
+	if l.sw != nil {
+		l.sw.Close()
+	}
 	l.readCache.CleanReader()
+	l.subs.removeAll()
 	close(l.closeCh)
+	l.dirLock.Unlock()
 }
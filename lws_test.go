@@ -7,13 +7,33 @@ SPDX-License-Identifier: Apache-2.0
 package lws
 
 import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"math/big"
 	"math/rand"
+	"net"
+	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"chainmaker.org/chainmaker/lws/fbuffer"
+	"chainmaker.org/chainmaker/lws/file"
 	"github.com/stretchr/testify/require"
 )
 
@@ -154,6 +174,752 @@ func TestLws_WriteReadObj(t *testing.T) {
 	l.Close()
 }
 
+func TestLws_WriteBatch(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, WithSegmentSize(200), WithFilePrex("test_"), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	err = l.RegisterCoder(&StudentCoder{})
+	require.Nil(t, err)
+	_, err = l.WriteBytes([]byte("single"))
+	require.Nil(t, err)
+	b := NewBatch()
+	for i := 0; i < 10; i++ {
+		b.AddBytes([]byte(fmt.Sprintf("batch_%d", i)))
+	}
+	b.Add(1, Student{Name: "lucy", Age: 10})
+	first, last, err := l.WriteBatch(b)
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), first)
+	require.Equal(t, uint64(12), last)
+	_, _, err = l.WriteBatch(NewBatch())
+	require.Equal(t, ErrEmptyBatch, err)
+	//没有注册编码器的对象无法序列化，写入失败且不占用索引
+	_, err = l.WriteRetIndex(2, Student{Name: "tom"})
+	require.Equal(t, ErrCoderNotExist, err)
+	b = NewBatch()
+	b.Add(2, Student{Name: "tom"})
+	_, _, err = l.WriteBatch(b)
+	require.Equal(t, ErrCoderNotExist, err)
+	require.Equal(t, uint64(12), l.LastIndex())
+	l.Close()
+
+	l, err = Open(dir, WithSegmentSize(200), WithFilePrex("test_"))
+	require.Nil(t, err)
+	require.Nil(t, l.RegisterCoder(&StudentCoder{}))
+	require.Equal(t, uint64(12), l.lastIndex)
+	it := l.NewLogIterator()
+	data, err := it.NextN(2).Get()
+	require.Nil(t, err)
+	require.Equal(t, "batch_0", string(data))
+	obj, err := it.NextN(10).GetObj()
+	require.Nil(t, err)
+	require.Equal(t, "lucy", obj.(*Student).Name)
+	it.Release()
+	l.Close()
+}
+
+func TestLws_WriteBatchTorn(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, WithFilePrex("test_"), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	b := NewBatch()
+	b.AddBytes([]byte("complete_0"))
+	b.AddBytes([]byte("complete_1"))
+	_, _, err = l.WriteBatch(b)
+	require.Nil(t, err)
+	//模拟批量写入中途崩溃：批量头声明3个条目，实际只写入了1个，之后写入与批量头等长的条目，残留条目不应被识别
+	header := make([]byte, batchHeaderSize)
+	serializateUint32(header, 3)
+	_, err = l.sw.writeLog(batchHeaderType, header)
+	require.Nil(t, err)
+	_, err = l.sw.writeLog(RawCoderType, []byte("torn_0"))
+	require.Nil(t, err)
+	require.Nil(t, l.Flush())
+	l.Close()
+
+	l, err = Open(dir, WithFilePrex("test_"), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), l.lastIndex)
+	idx, err := l.WriteBytes([]byte("last"))
+	require.Nil(t, err)
+	require.Equal(t, uint64(3), idx)
+	//模拟崩溃：不经过Close对文件的截断，直接关闭底层文件
+	require.Nil(t, l.Flush())
+	l.sw.SegmentProcessor.Close()
+	l.dirLock.Unlock() //进程退出时目录锁由系统释放
+
+	l, err = Open(dir, WithFilePrex("test_"))
+	require.Nil(t, err)
+	require.Equal(t, uint64(3), l.lastIndex)
+	it := l.NewLogIterator()
+	var got []string
+	for it.HasNext() {
+		data, err := it.Next().Get()
+		require.Nil(t, err)
+		got = append(got, string(data))
+	}
+	it.Release()
+	require.Equal(t, []string{"complete_0", "complete_1", "last"}, got)
+	l.Close()
+}
+
+func readAll(t *testing.T, l *Lws) []string {
+	it := l.NewLogIterator()
+	defer it.Release()
+	var got []string
+	for it.HasNext() {
+		data, err := it.Next().Get()
+		require.Nil(t, err)
+		got = append(got, string(data))
+	}
+	return got
+}
+
+func TestLws_TruncateBack(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, WithSegmentSize(60), WithFilePrex("test_"), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	var expect []string
+	for i := 1; i <= 20; i++ {
+		data := fmt.Sprintf("entry_%02d", i)
+		_, err = l.WriteBytes([]byte(data))
+		require.Nil(t, err)
+		expect = append(expect, data)
+	}
+	require.True(t, l.segments.Len() > 3)
+	require.Equal(t, ErrIndexOutOfRange, l.TruncateBack(21))
+	//截断到中间的文件，之后的文件都会被删除
+	require.Nil(t, l.TruncateBack(7))
+	require.Equal(t, uint64(7), l.lastIndex)
+	require.Equal(t, expect[:7], readAll(t, l))
+	idx, err := l.WriteBytes([]byte("new_08"))
+	require.Nil(t, err)
+	require.Equal(t, uint64(8), idx)
+	l.Close()
+
+	l, err = Open(dir, WithSegmentSize(60), WithFilePrex("test_"), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	require.Equal(t, uint64(8), l.lastIndex)
+	require.Equal(t, append(expect[:7:7], "new_08"), readAll(t, l))
+	names, err := l.matchFiles()
+	require.Nil(t, err)
+	require.Equal(t, l.segments.Len(), len(names))
+	//删除所有日志条目
+	require.Nil(t, l.TruncateBack(0))
+	require.Equal(t, uint64(0), l.lastIndex)
+	require.Empty(t, readAll(t, l))
+	idx, err = l.WriteBytes([]byte("first"))
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), idx)
+	l.Close()
+}
+
+func TestLws_TruncateBackWaitReaders(t *testing.T) {
+	l, err := Open(t.TempDir(), WithSegmentSize(60), WithFilePrex("test_"), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	defer l.Close()
+	for i := 1; i <= 20; i++ {
+		_, err = l.WriteBytes([]byte(fmt.Sprintf("entry_%02d", i)))
+		require.Nil(t, err)
+	}
+	//迭代器释放之前，截断不会删除其正在读取的文件
+	it := l.NewLogIterator()
+	done := make(chan error, 1)
+	go func() {
+		done <- l.TruncateBack(3)
+	}()
+	var got []string
+	for it.HasNext() {
+		data, err := it.Next().Get()
+		require.Nil(t, err)
+		got = append(got, string(data))
+	}
+	require.Len(t, got, 20)
+	select {
+	case <-done:
+		t.Fatal("truncate finished while the iterator was alive")
+	case <-time.After(50 * time.Millisecond):
+	}
+	it.Release()
+	require.Nil(t, <-done)
+	require.Equal(t, uint64(3), l.LastIndex())
+	idx, err := l.WriteBytes([]byte("new_04"))
+	require.Nil(t, err)
+	require.Equal(t, uint64(4), idx)
+}
+
+//failRemoveBackend 删除文件总是失败的存储后端
+type failRemoveBackend struct {
+	Backend
+}
+
+func (failRemoveBackend) Remove(string) error {
+	return errors.New("remove failed")
+}
+
+func TestLws_TruncateBackBroken(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, WithSegmentSize(60), WithFilePrex("test_"), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	var expect []string
+	for i := 1; i <= 20; i++ {
+		data := fmt.Sprintf("entry_%02d", i)
+		_, err = l.WriteBytes([]byte(data))
+		require.Nil(t, err)
+		expect = append(expect, data)
+	}
+	//删除文件失败后拒绝写入，防止写入的条目索引错乱
+	l.store = storage{failRemoveBackend{l.backend}}
+	require.NotNil(t, l.TruncateBack(7))
+	_, err = l.WriteBytes([]byte("new_08"))
+	require.True(t, errors.Is(err, ErrBroken))
+	require.True(t, errors.Is(l.TruncateBack(7), ErrBroken))
+	l.Close()
+
+	//文件中的日志依然连续，重新打开后恢复
+	l, err = Open(dir, WithSegmentSize(60), WithFilePrex("test_"), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	require.Equal(t, expect, readAll(t, l))
+	require.Nil(t, l.TruncateBack(7))
+	idx, err := l.WriteBytes([]byte("new_08"))
+	require.Nil(t, err)
+	require.Equal(t, uint64(8), idx)
+	l.Close()
+}
+
+func TestLws_TruncateBackNotify(t *testing.T) {
+	l, err := Open(t.TempDir(), WithSegmentSize(60), WithFilePrex("test_"), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	defer l.Close()
+	events, cancel := l.Subscribe(SubscribeWithBlock())
+	defer cancel()
+	ti, err := l.NewTailIterator(1)
+	require.Nil(t, err)
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelCtx()
+	for i := 1; i <= 10; i++ {
+		_, err = l.WriteBytes([]byte(fmt.Sprintf("entry_%02d", i)))
+		require.Nil(t, err)
+		ev := <-events
+		require.Equal(t, uint64(i), ev.Index)
+		ele, err := ti.NextWait(ctx)
+		require.Nil(t, err)
+		require.Equal(t, uint64(i), ele.Index())
+	}
+	//已收到被截断条目的订阅者及tail迭代器都会得到通知
+	require.Nil(t, l.TruncateBack(5))
+	ev := <-events
+	require.True(t, ev.Truncated)
+	require.Equal(t, uint64(5), ev.Index)
+	_, err = ti.NextWait(ctx)
+	require.Equal(t, ErrTruncated, err)
+
+	_, err = l.WriteBytes([]byte("new_06"))
+	require.Nil(t, err)
+	ev = <-events
+	require.False(t, ev.Truncated)
+	require.Equal(t, uint64(6), ev.Index)
+	ele, err := ti.NextWait(ctx)
+	require.Nil(t, err)
+	require.Equal(t, uint64(6), ele.Index())
+	data, err := ele.Get()
+	require.Nil(t, err)
+	require.Equal(t, "new_06", string(data))
+}
+
+func TestLws_TruncateBackInBatch(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, WithFilePrex("test_"), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	_, err = l.WriteBytes([]byte("single"))
+	require.Nil(t, err)
+	b := NewBatch()
+	for i := 0; i < 5; i++ {
+		b.AddBytes([]byte(fmt.Sprintf("batch_%d", i)))
+	}
+	_, _, err = l.WriteBatch(b)
+	require.Nil(t, err)
+	//截断于批量中，保留批量中的前两个条目
+	require.Nil(t, l.TruncateBack(3))
+	l.Close()
+
+	l, err = Open(dir, WithFilePrex("test_"), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	require.Equal(t, []string{"single", "batch_0", "batch_1"}, readAll(t, l))
+	//截断于批量的起始处，整个批量被删除
+	require.Nil(t, l.TruncateBack(1))
+	l.Close()
+
+	l, err = Open(dir, WithFilePrex("test_"))
+	require.Nil(t, err)
+	require.Equal(t, []string{"single"}, readAll(t, l))
+	l.Close()
+}
+
+func TestLws_TruncateFront(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, WithSegmentSize(60), WithFilePrex("test_"), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	var expect []string
+	for i := 1; i <= 20; i++ {
+		data := fmt.Sprintf("entry_%02d", i)
+		_, err = l.WriteBytes([]byte(data))
+		require.Nil(t, err)
+		expect = append(expect, data)
+	}
+	require.Equal(t, ErrIndexOutOfRange, l.TruncateFront(22))
+	require.Nil(t, l.TruncateFront(10))
+	require.Equal(t, uint64(10), l.firstIndex)
+	require.Equal(t, expect[9:], readAll(t, l))
+	//边界文件被保留，其之前的文件都被删除
+	require.True(t, l.segments.First().Index <= 10)
+	require.True(t, l.segments.Len() < 2 || l.segments.At(1).Index > 10)
+	names, err := l.matchFiles()
+	require.Nil(t, err)
+	require.Equal(t, l.segments.Len(), len(names))
+	//小于起始索引则不做处理
+	require.Nil(t, l.Purge(PurgeBefore(5)))
+	require.Equal(t, uint64(10), l.firstIndex)
+	require.Nil(t, l.Purge(PurgeBefore(16)))
+	require.Equal(t, uint64(16), l.firstIndex)
+	require.Equal(t, expect[15:], readAll(t, l))
+	//清理所有的日志条目，之后的写入依然连续
+	require.Nil(t, l.TruncateFront(21))
+	require.Empty(t, readAll(t, l))
+	idx, err := l.WriteBytes([]byte("entry_21"))
+	require.Nil(t, err)
+	require.Equal(t, uint64(21), idx)
+	require.Equal(t, []string{"entry_21"}, readAll(t, l))
+	l.Close()
+}
+
+func TestLws_TruncateFrontReopen(t *testing.T) {
+	dir := t.TempDir()
+	opts := []Opt{WithSegmentSize(200), WithFilePrex("test_"), WithWriteFlag(WF_SYNCFLUSH, 0)}
+	l, err := Open(dir, opts...)
+	require.Nil(t, err)
+	var expect []string
+	for i := 1; i <= 20; i++ {
+		data := fmt.Sprintf("entry_%02d", i)
+		_, err = l.WriteBytes([]byte(data))
+		require.Nil(t, err)
+		expect = append(expect, data)
+	}
+	require.Nil(t, l.TruncateFront(10))
+	//起始索引位于边界文件的中间
+	require.True(t, l.segments.First().Index < 10)
+	l.Close()
+	//重新打开后起始索引不变，边界文件中已清理的条目不可读
+	l, err = Open(dir, opts...)
+	require.Nil(t, err)
+	require.Equal(t, uint64(10), l.FirstIndex())
+	_, err = l.ReadEntry(9)
+	require.Equal(t, ErrCompacted, err)
+	require.Equal(t, expect[9:], readAll(t, l))
+	l.Close()
+	rl, err := OpenReadOnly(dir, opts...)
+	require.Nil(t, err)
+	require.Equal(t, uint64(10), rl.FirstIndex())
+	rl.Close()
+}
+
+func TestLws_TruncateFrontWaitPurge(t *testing.T) {
+	l, err := Open(t.TempDir(), WithSegmentSize(60), WithFilePrex("test_"), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	defer l.Close()
+	for i := 1; i <= 20; i++ {
+		_, err = l.WriteBytes([]byte(fmt.Sprintf("entry_%02d", i)))
+		require.Nil(t, err)
+	}
+	//模拟正在进行的清理，后台清理直接返回，截断则等待其结束
+	require.True(t, purgeLocker.TryAcquire())
+	require.Equal(t, ErrPurgeWorkExisted, l.Purge(PurgeWithKeepFiles(1)))
+	done := make(chan error, 1)
+	go func() {
+		done <- l.TruncateFront(10)
+	}()
+	select {
+	case err = <-done:
+		t.Fatalf("truncate returned %v while another purge was running", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	purgeLocker.Release()
+	require.Nil(t, <-done)
+	require.Equal(t, uint64(10), l.FirstIndex())
+}
+
+func TestLws_ReadByIndex(t *testing.T) {
+	for _, ft := range []FileType{FT_MMAP, FT_NORMAL} {
+		dir := t.TempDir()
+		l, err := Open(dir, WithSegmentSize(60), WithFilePrex("test_"), WithWriteFileType(ft))
+		require.Nil(t, err)
+		require.Nil(t, l.RegisterCoder(&StudentCoder{}))
+		_, err = l.Read(1)
+		require.Equal(t, ErrNotFound, err)
+		//边写边读，读取到的总是最新写入的条目
+		for i := 1; i <= 20; i++ {
+			idx, err := l.WriteBytes([]byte(fmt.Sprintf("entry_%02d", i)))
+			require.Nil(t, err)
+			data, err := l.Read(idx)
+			require.Nil(t, err)
+			require.Equal(t, fmt.Sprintf("entry_%02d", i), string(data))
+		}
+		idx, err := l.WriteRetIndex(1, Student{Name: "lucy", Age: 10})
+		require.Nil(t, err)
+		obj, err := l.ReadObj(idx)
+		require.Nil(t, err)
+		require.Equal(t, "lucy", obj.(*Student).Name)
+		obj, err = l.ReadObj(3)
+		require.Nil(t, err)
+		require.Equal(t, "entry_03", string(obj.([]byte)))
+		le, err := l.ReadEntry(5)
+		require.Nil(t, err)
+		require.Equal(t, RawCoderType, le.Typ)
+		require.Equal(t, "entry_05", string(le.Data))
+		_, err = l.Read(idx + 1)
+		require.Equal(t, ErrNotFound, err)
+		require.Nil(t, l.TruncateFront(10))
+		_, err = l.Read(9)
+		require.Equal(t, ErrCompacted, err)
+		data, err := l.Read(10)
+		require.Nil(t, err)
+		require.Equal(t, "entry_10", string(data))
+		require.Equal(t, 0, l.readCount)
+		l.Close()
+	}
+}
+
+func TestLws_ReadWhileWriting(t *testing.T) {
+	l, err := Open(t.TempDir(), WithSegmentSize(200), WithFilePrex("test_"), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	defer l.Close()
+	_, err = l.WriteBytes([]byte("entry_001"))
+	require.Nil(t, err)
+	//读取与写入并发进行，-race下检测索引范围的读取
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 2; i <= 200; i++ {
+			l.WriteBytes([]byte(fmt.Sprintf("entry_%03d", i)))
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		le, err := l.ReadEntry(1)
+		require.Nil(t, err)
+		require.Equal(t, "entry_001", string(le.Data))
+		it, err := l.NewRangeIterator(1, 1)
+		require.Nil(t, err)
+		data, err := it.Next().Get()
+		require.Nil(t, err)
+		require.Equal(t, "entry_001", string(data))
+		it.Release()
+	}
+	<-done
+}
+
+func TestLws_RangeIterator(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, WithSegmentSize(60), WithFilePrex("test_"))
+	require.Nil(t, err)
+	for i := 1; i <= 20; i++ {
+		_, err = l.WriteBytes([]byte(fmt.Sprintf("entry_%02d", i)))
+		require.Nil(t, err)
+	}
+	_, err = l.NewRangeIterator(5, 21)
+	require.Equal(t, ErrNotFound, err)
+	_, err = l.NewRangeIterator(9, 5)
+	require.Equal(t, ErrIndexOutOfRange, err)
+	it, err := l.NewRangeIterator(5, 9)
+	require.Nil(t, err)
+	var got []string
+	for it.HasNext() {
+		ele := it.Next()
+		data, err := ele.Get()
+		require.Nil(t, err)
+		got = append(got, fmt.Sprintf("%d:%s", ele.Index(), data))
+	}
+	require.Equal(t, []string{"5:entry_05", "6:entry_06", "7:entry_07", "8:entry_08", "9:entry_09"}, got)
+	require.Equal(t, ErrIndexOutOfRange, it.Seek(4))
+	require.Equal(t, ErrIndexOutOfRange, it.Seek(11))
+	require.Nil(t, it.Seek(10))
+	require.False(t, it.HasNext())
+	require.Nil(t, it.Seek(7))
+	data, err := it.Next().Get()
+	require.Nil(t, err)
+	require.Equal(t, "entry_07", string(data))
+	data, err = it.Previous().Get()
+	require.Nil(t, err)
+	require.Equal(t, "entry_06", string(data))
+	it.Release()
+
+	//在全量迭代器上定位到指定的索引开始回放
+	it = l.NewLogIterator()
+	require.Nil(t, it.Seek(18))
+	got = got[:0]
+	for it.HasNext() {
+		data, err := it.Next().Get()
+		require.Nil(t, err)
+		got = append(got, string(data))
+	}
+	require.Equal(t, []string{"entry_18", "entry_19", "entry_20"}, got)
+	it.Release()
+
+	require.Nil(t, l.TruncateFront(10))
+	_, err = l.NewRangeIterator(9, 12)
+	require.Equal(t, ErrCompacted, err)
+	require.Equal(t, 0, l.readCount)
+	l.Close()
+}
+
+func TestLws_TailIterator(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, WithSegmentSize(60), WithFilePrex("test_"))
+	require.Nil(t, err)
+	for i := 1; i <= 5; i++ {
+		_, err = l.WriteBytes([]byte(fmt.Sprintf("entry_%02d", i)))
+		require.Nil(t, err)
+	}
+	_, err = l.NewTailIterator(7)
+	require.Equal(t, ErrNotFound, err)
+	it, err := l.NewTailIterator(3)
+	require.Nil(t, err)
+	go func() {
+		for i := 6; i <= 10; i++ {
+			time.Sleep(10 * time.Millisecond)
+			l.WriteBytes([]byte(fmt.Sprintf("entry_%02d", i)))
+		}
+	}()
+	var first []byte
+	for i := 3; i <= 10; i++ {
+		ele, err := it.NextWait(context.Background())
+		require.Nil(t, err)
+		require.Equal(t, uint64(i), ele.Index())
+		data, err := ele.Get()
+		require.Nil(t, err)
+		require.Equal(t, fmt.Sprintf("entry_%02d", i), string(data))
+		if first == nil {
+			first = data
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	_, err = it.NextWait(ctx)
+	cancel()
+	require.Equal(t, context.DeadlineExceeded, err)
+	//tail迭代器不会阻止清理程序，已读出的数据为拷贝，文件被清理后依然可用
+	require.Nil(t, l.TruncateFront(8))
+	require.Equal(t, "entry_03", string(first))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		l.Close()
+	}()
+	_, err = it.NextWait(context.Background())
+	require.Equal(t, ErrClosed, err)
+	it.Release()
+}
+
+func TestLws_TailIteratorFlushed(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, WithFilePrex("test_"), WithWriteFlag(WF_QUOTAFLUSH, 3))
+	require.Nil(t, err)
+	it, err := l.NewTailIterator(1, TailWithFlushed())
+	require.Nil(t, err)
+	for i := 1; i <= 2; i++ {
+		_, err = l.WriteBytes([]byte(fmt.Sprintf("entry_%02d", i)))
+		require.Nil(t, err)
+	}
+	//未达到刷盘限额，条目不可见
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	_, err = it.NextWait(ctx)
+	cancel()
+	require.Equal(t, context.DeadlineExceeded, err)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		l.WriteBytes([]byte("entry_03"))
+	}()
+	for i := 1; i <= 3; i++ {
+		ele, err := it.NextWait(context.Background())
+		require.Nil(t, err)
+		data, err := ele.Get()
+		require.Nil(t, err)
+		require.Equal(t, fmt.Sprintf("entry_%02d", i), string(data))
+	}
+	it.Release()
+	l.Close()
+}
+
+func TestLws_Subscribe(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, WithFilePrex("test_"), WithWriteFlag(WF_QUOTAFLUSH, 3))
+	require.Nil(t, err)
+	require.Nil(t, l.RegisterCoder(&StudentCoder{}))
+	all, cancelAll := l.Subscribe()
+	dropped, cancelDropped := l.Subscribe(SubscribeWithBuffer(1))
+	blocked, cancelBlocked := l.Subscribe(SubscribeWithBuffer(1), SubscribeWithBlock())
+	flushed, cancelFlushed := l.Subscribe(SubscribeWithFlushed())
+
+	_, err = l.WriteBytes([]byte("entry_01"))
+	require.Nil(t, err)
+	_, err = l.WriteRetIndex(1, Student{Name: "lucy"})
+	require.Nil(t, err)
+	//未达到刷盘限额，只订阅刷盘条目的订阅者收不到事件
+	select {
+	case <-flushed:
+		t.Fatal("unflushed entry should not be delivered")
+	case <-time.After(20 * time.Millisecond):
+	}
+	b := NewBatch()
+	b.AddBytes([]byte("entry_03"))
+	b.AddBytes([]byte("entry_04"))
+	_, _, err = l.WriteBatch(b)
+	require.Nil(t, err)
+	for i := 1; i <= 4; i++ {
+		ev := <-all
+		require.Equal(t, uint64(i), ev.Index)
+		ev = <-flushed
+		require.Equal(t, uint64(i), ev.Index)
+	}
+	ev := <-dropped
+	require.Equal(t, uint64(1), ev.Index)
+	require.Equal(t, 0, len(dropped))
+	cancelDropped()
+	_, ok := <-dropped
+	require.False(t, ok)
+
+	//阻塞模式的订阅者没有消费时写入不受影响，事件在队列中等待
+	var got []EntryEvent
+	for i := 0; i < 4; i++ {
+		got = append(got, <-blocked)
+	}
+	require.Equal(t, uint64(1), got[0].Index)
+	require.Equal(t, int8(1), got[1].Typ)
+	require.Equal(t, "entry_04", string(got[3].Data))
+	cancelBlocked()
+	_, ok = <-blocked
+	require.False(t, ok)
+	cancelAll()
+	cancelFlushed()
+	//重复取消不会出错
+	cancelAll()
+
+	ch, _ := l.Subscribe()
+	l.Close()
+	_, ok = <-ch
+	require.False(t, ok)
+	//关闭之后订阅返回已关闭的通道
+	ch, cancel := l.Subscribe(SubscribeWithBlock())
+	_, ok = <-ch
+	require.False(t, ok)
+	cancel()
+}
+
+func TestLws_SubscribeStalled(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, WithFilePrex("test_"), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	ch, cancel := l.Subscribe(SubscribeWithBuffer(0), SubscribeWithBlock())
+	//订阅者不消费时写入及刷盘不会被阻塞
+	written := make(chan error, 1)
+	go func() {
+		for i := 0; i < 100; i++ {
+			if _, err := l.WriteBytes([]byte(fmt.Sprintf("entry_%03d", i))); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- l.Flush()
+	}()
+	select {
+	case err = <-written:
+		require.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("writer is blocked by a stalled subscriber")
+	}
+	for i := 0; i < 100; i++ {
+		ev := <-ch
+		require.Equal(t, uint64(i+1), ev.Index)
+	}
+	cancel()
+	l.Close()
+}
+
+func TestLws_WriteNormalBuffered(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, WithFilePrex("test_"), WithWriteFileType(FT_NORMAL), WithBufferSize(1<<12))
+	require.Nil(t, err)
+	var expect []string
+	for i := 1; i <= 500; i++ {
+		data := fmt.Sprintf("entry_%03d", i)
+		_, err = l.WriteBytes([]byte(data))
+		require.Nil(t, err)
+		expect = append(expect, data)
+	}
+	l.Close()
+	l, err = Open(dir, WithFilePrex("test_"), WithWriteFileType(FT_NORMAL), WithBufferSize(1<<12))
+	require.Nil(t, err)
+	require.Equal(t, expect, readAll(t, l))
+	l.Close()
+}
+
+func TestLws_FlushSync(t *testing.T) {
+	l, err := Open(t.TempDir(), WithWriteFileType(FT_MMAP), WithWriteFlag(WF_QUOTAFLUSH, 1000))
+	require.Nil(t, err)
+	defer l.Close()
+	//mmap文件的刷盘由映射区通过msync完成
+	_, ok := l.sw.f.buf.(*fbuffer.ZeroMmap)
+	require.True(t, ok)
+	var syncs int
+	sync := l.sw.f.sync
+	l.sw.f.sync = func() error {
+		syncs++
+		return sync()
+	}
+	for i := 0; i < 3; i++ {
+		_, err = l.WriteBytes([]byte(fmt.Sprintf("entry_%d", i)))
+		require.Nil(t, err)
+	}
+	require.Equal(t, 0, syncs)
+	require.Equal(t, uint64(0), l.sw.FlushedIndex())
+	require.Nil(t, l.Flush())
+	require.Equal(t, 1, syncs)
+	require.Equal(t, uint64(3), l.sw.FlushedIndex())
+}
+
+func TestLws_KillRecovery(t *testing.T) {
+	//子进程：同步刷盘写入日志，每写入一条就输出其索引，之后不经过Close直接被杀死
+	//进程被杀死时页缓存依然保留，故只能验证不经过Close时日志可以完整恢复，刷盘本身由TestLws_FlushSync验证
+	if dir := os.Getenv("LWS_CRASH_DIR"); dir != "" {
+		l, err := Open(dir, WithSegmentSize(1<<14), WithBufferSize(1<<12), WithWriteFlag(WF_SYNCFLUSH, 0))
+		if err != nil {
+			os.Exit(1)
+		}
+		for i := 1; i <= 1000; i++ {
+			idx, err := l.WriteBytes([]byte(fmt.Sprintf("entry_%04d", i)))
+			if err != nil {
+				os.Exit(1)
+			}
+			fmt.Println(idx)
+		}
+		syscall.Kill(os.Getpid(), syscall.SIGKILL)
+		select {}
+	}
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLws_KillRecovery$")
+	cmd.Env = append(os.Environ(), "LWS_CRASH_DIR="+dir)
+	out, _ := cmd.Output()
+	synced := strings.Fields(string(out))
+	require.Equal(t, 1000, len(synced))
+
+	l, err := Open(dir, WithSegmentSize(1<<14), WithBufferSize(1<<12))
+	require.Nil(t, err)
+	require.Equal(t, uint64(len(synced)), l.LastIndex())
+	for i := 1; i <= len(synced); i++ {
+		data, err := l.Read(uint64(i))
+		require.Nil(t, err)
+		require.Equal(t, fmt.Sprintf("entry_%04d", i), string(data))
+	}
+	l.Close()
+}
+
 // var (
 // 	benchLws *Lws
 // 	benchWal *wal.Log
@@ -191,3 +957,1323 @@ func TestLws_WriteReadObj(t *testing.T) {
 // 	}
 // 	l.Sync()
 // }
+
+func TestLws_DirLock(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, WithFilePrex("test_"))
+	require.Nil(t, err)
+	_, err = Open(dir, WithFilePrex("test_"))
+	require.True(t, errors.Is(err, ErrLocked))
+	//只读实例可以跟随写入实例读取，但不持有锁
+	r, err := OpenReadOnly(dir, WithFilePrex("test_"))
+	require.Nil(t, err)
+	r.Close()
+	//不同前缀的日志互不影响
+	other, err := Open(dir, WithFilePrex("other_"))
+	require.Nil(t, err)
+	other.Close()
+	l.Close()
+
+	l, err = Open(dir, WithFilePrex("test_"))
+	require.Nil(t, err)
+	l.Close()
+}
+
+func TestLws_OpenReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, WithFilePrex("test_"), WithSegmentSize(100), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	var want []string
+	for i := 0; i < 20; i++ {
+		data := fmt.Sprintf("entry_%d", i)
+		_, err = l.WriteBytes([]byte(data))
+		require.Nil(t, err)
+		want = append(want, data)
+	}
+	l.Close()
+
+	r1, err := OpenReadOnly(dir, WithFilePrex("test_"))
+	require.Nil(t, err)
+	r2, err := OpenReadOnly(dir, WithFilePrex("test_"))
+	require.Nil(t, err)
+	_, err = Open(dir, WithFilePrex("test_"))
+	require.True(t, errors.Is(err, ErrLocked))
+
+	require.Equal(t, uint64(1), r1.FirstIndex())
+	require.Equal(t, uint64(20), r1.LastIndex())
+	require.Equal(t, want, readAll(t, r1))
+	data, err := r2.Read(20)
+	require.Nil(t, err)
+	require.Equal(t, "entry_19", string(data))
+
+	_, err = r1.WriteBytes([]byte("x"))
+	require.Equal(t, ErrReadOnly, err)
+	_, _, err = r1.WriteBatch(NewBatch())
+	require.Equal(t, ErrReadOnly, err)
+	require.Equal(t, ErrReadOnly, r1.Flush())
+	require.Equal(t, ErrReadOnly, r1.Purge(PurgeWithSoftEntries(1)))
+	require.Equal(t, ErrReadOnly, r1.TruncateFront(5))
+	require.Equal(t, ErrReadOnly, r1.TruncateBack(5))
+	r1.Close()
+	r2.Close()
+
+	_, err = OpenReadOnly(filepath.Join(dir, "missing"))
+	require.NotNil(t, err)
+	l, err = Open(dir, WithFilePrex("test_"))
+	require.Nil(t, err)
+	require.Equal(t, uint64(20), l.LastIndex())
+	l.Close()
+}
+
+func TestLws_ReadOnlyRefresh(t *testing.T) {
+	for _, ft := range []FileType{FT_MMAP, FT_NORMAL} {
+		dir := t.TempDir()
+		l, err := Open(dir, WithFilePrex("test_"), WithSegmentSize(100), WithWriteFileType(ft), WithWriteFlag(WF_SYNCFLUSH, 0))
+		require.Nil(t, err)
+		var want []string
+		write := func(n int) {
+			for i := 0; i < n; i++ {
+				data := fmt.Sprintf("entry_%d", len(want))
+				_, err := l.WriteBytes([]byte(data))
+				require.Nil(t, err)
+				want = append(want, data)
+			}
+		}
+		write(5)
+
+		r, err := OpenReadOnly(dir, WithFilePrex("test_"), WithWriteFileType(ft))
+		require.Nil(t, err)
+		require.Equal(t, want, readAll(t, r))
+
+		write(20)
+		require.Equal(t, uint64(5), r.LastIndex())
+		require.Nil(t, r.Refresh())
+		require.Equal(t, uint64(25), r.LastIndex())
+		require.Equal(t, want, readAll(t, r))
+
+		require.Nil(t, l.TruncateFront(10))
+		require.Nil(t, r.Refresh())
+		st := r.Stats()
+		require.True(t, st.ReadOnly)
+		require.Equal(t, uint64(10), st.FirstIndex)
+		require.Equal(t, uint64(25), st.LastIndex)
+		require.Equal(t, st.LastIndex-st.FirstIndex+1, st.EntryCount)
+		require.Equal(t, l.segments.Len(), st.SegmentCount)
+		require.True(t, st.Size > 0)
+		require.Equal(t, want[st.FirstIndex-1:], readAll(t, r))
+
+		require.Nil(t, l.TruncateBack(20))
+		want = want[:20]
+		write(2)
+		require.Nil(t, r.Refresh())
+		require.Equal(t, uint64(22), r.LastIndex())
+		data, err := r.Read(22)
+		require.Nil(t, err)
+		require.Equal(t, want[len(want)-1], string(data))
+		r.Close()
+		l.Close()
+	}
+}
+
+func TestLws_ReadOnlyFiles(t *testing.T) {
+	for _, ft := range []FileType{FT_MMAP, FT_NORMAL} {
+		dir := t.TempDir()
+		l, err := Open(dir, WithFilePrex("test_"), WithSegmentSize(100), WithWriteFileType(ft), WithWriteFlag(WF_SYNCFLUSH, 0))
+		require.Nil(t, err)
+		var want []string
+		for i := 0; i < 20; i++ {
+			data := fmt.Sprintf("entry_%d", i)
+			_, err = l.WriteBytes([]byte(data))
+			require.Nil(t, err)
+			want = append(want, data)
+		}
+		l.Close()
+		snapshot := func() map[string]int64 {
+			entries, err := os.ReadDir(dir)
+			require.Nil(t, err)
+			files := make(map[string]int64)
+			for _, e := range entries {
+				info, err := e.Info()
+				require.Nil(t, err)
+				files[e.Name()] = info.Size()
+			}
+			return files
+		}
+		before := snapshot()
+
+		//只读实例以只读方式打开及映射文件，不会创建或扩展文件
+		r, err := OpenReadOnly(dir, WithFilePrex("test_"), WithWriteFileType(ft))
+		require.Nil(t, err)
+		require.Equal(t, want, readAll(t, r))
+		rd, err := r.findReaderByIndex(1)
+		require.Nil(t, err)
+		_, err = rd.f.LwsFile.WriteAt([]byte("x"), 0)
+		require.NotNil(t, err)
+		r.Close()
+		require.Equal(t, before, snapshot())
+	}
+}
+
+func TestLws_SegmentHeader(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, WithFilePrex("test_"), WithSegmentSize(100), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		_, err = l.WriteBytes([]byte(fmt.Sprintf("entry_%d", i)))
+		require.Nil(t, err)
+	}
+	l.Close()
+
+	l, err = Open(dir, WithFilePrex("test_"))
+	require.Nil(t, err)
+	require.Equal(t, uint64(10), l.LastIndex())
+	l.segments.ForEach(func(i int, s *Segment) bool {
+		rd, err := l.findReaderByIndex(s.Index)
+		require.Nil(t, err)
+		h := rd.Header()
+		require.NotNil(t, h)
+		require.Equal(t, segmentHeaderVersion, h.Version)
+		require.Equal(t, ChecksumIEEE, h.Checksum)
+		require.Equal(t, s.ID, h.SegmentID)
+		require.Equal(t, s.Index, h.BaseIndex)
+		require.False(t, h.CreateTime.IsZero())
+		return false
+	})
+	first := l.segments.First().Path
+	l.Close()
+
+	data, err := os.ReadFile(first)
+	require.Nil(t, err)
+	//段头被篡改
+	data[20] ^= 0xff
+	require.Nil(t, os.WriteFile(first, data, 0644))
+	_, err = NewSegmentReader(&Segment{ID: 1, Index: 1, Path: first, Size: int64(len(data))}, FT_NORMAL)
+	require.Equal(t, ErrSegmentHeader, err)
+	//段头与文件名不一致
+	data[20] ^= 0xff
+	require.Nil(t, os.WriteFile(first, data, 0644))
+	_, err = NewSegmentReader(&Segment{ID: 2, Index: 1, Path: first, Size: int64(len(data))}, FT_NORMAL)
+	require.Equal(t, ErrSegmentMismatch, err)
+}
+
+func TestLws_HeaderlessSegment(t *testing.T) {
+	dir := t.TempDir()
+	//生成没有段头的老版本文件
+	f, err := newLogFile(diskBackend{}, filepath.Join(dir, "test_00001_1.wal"), FT_NORMAL, 0, 0, false, true)
+	require.Nil(t, err)
+	var want []string
+	for i := 0; i < 5; i++ {
+		data := fmt.Sprintf("legacy_%d", i)
+		_, err = f.WriteLog(RawCoderType, []byte(data))
+		require.Nil(t, err)
+		want = append(want, data)
+	}
+	require.Nil(t, f.Close())
+
+	for _, ft := range []FileType{FT_MMAP, FT_NORMAL} {
+		l, err := Open(dir, WithFilePrex("test_"), WithWriteFileType(ft), WithWriteFlag(WF_SYNCFLUSH, 0))
+		require.Nil(t, err)
+		require.Nil(t, l.sw.Header())
+		require.Equal(t, want, readAll(t, l))
+		data := fmt.Sprintf("append_%d", ft)
+		_, err = l.WriteBytes([]byte(data))
+		require.Nil(t, err)
+		want = append(want, data)
+		l.Close()
+	}
+
+	l, err := OpenReadOnly(dir, WithFilePrex("test_"))
+	require.Nil(t, err)
+	require.Equal(t, want, readAll(t, l))
+	l.Close()
+}
+
+func TestLws_Checksum(t *testing.T) {
+	dir := t.TempDir()
+	var want []string
+	//每次打开使用不同的校验算法，新文件使用新算法，老文件沿用其段头中的算法
+	for _, ct := range []ChecksumType{ChecksumIEEE, ChecksumXXH64, ChecksumCastagnoli, ChecksumNone} {
+		l, err := Open(dir, WithFilePrex("test_"), WithSegmentSize(100), WithChecksum(ct), WithWriteFlag(WF_SYNCFLUSH, 0))
+		require.Nil(t, err)
+		for i := 0; i < 5; i++ {
+			data := fmt.Sprintf("entry_%d_%d", ct, i)
+			_, err = l.WriteBytes([]byte(data))
+			require.Nil(t, err)
+			want = append(want, data)
+		}
+		require.Equal(t, ct, l.sw.Header().Checksum)
+		l.Close()
+	}
+
+	l, err := Open(dir, WithFilePrex("test_"))
+	require.Nil(t, err)
+	require.Equal(t, want, readAll(t, l))
+	used := map[ChecksumType]bool{}
+	l.segments.ForEach(func(i int, s *Segment) bool {
+		rd, err := l.findReaderByIndex(s.Index)
+		require.Nil(t, err)
+		used[rd.Header().Checksum] = true
+		return false
+	})
+	require.Len(t, used, 4)
+	first := l.segments.First()
+	l.Close()
+
+	//篡改xxh64校验的文件中的日志数据，损坏处之后的条目不再可见
+	l, err = Open(dir, WithFilePrex("test_"))
+	require.Nil(t, err)
+	var target *Segment
+	l.segments.ForEach(func(i int, s *Segment) bool {
+		rd, err := l.findReaderByIndex(s.Index)
+		require.Nil(t, err)
+		if rd.Header().Checksum == ChecksumXXH64 && s != first {
+			target = s
+			return true
+		}
+		return false
+	})
+	require.NotNil(t, target)
+	l.Close()
+	data, err := os.ReadFile(target.Path)
+	require.Nil(t, err)
+	data[segmentHeaderSize+lenSize+8+typeSize] ^= 0xff
+	require.Nil(t, os.WriteFile(target.Path, data, 0644))
+	sr, err := NewSegmentReader(&Segment{ID: target.ID, Index: target.Index, Path: target.Path, Size: int64(len(data))}, FT_NORMAL)
+	require.Nil(t, err)
+	require.Equal(t, target.Index-1, sr.LastIndex())
+	sr.Close()
+}
+
+func TestLws_Compression(t *testing.T) {
+	big := strings.Repeat(`{"from":"0x1234","to":"0x5678","amount":100},`, 20)
+	sizeOf := func(ct CompressionType) int64 {
+		dir := t.TempDir()
+		l, err := Open(dir, WithFilePrex("test_"), WithCompression(ct), WithWriteFlag(WF_SYNCFLUSH, 0))
+		require.Nil(t, err)
+		for i := 0; i < 50; i++ {
+			_, err = l.WriteBytes([]byte(big))
+			require.Nil(t, err)
+		}
+		l.Close()
+		l, err = OpenReadOnly(dir, WithFilePrex("test_"))
+		require.Nil(t, err)
+		defer l.Close()
+		return l.Stats().Size
+	}
+	require.True(t, sizeOf(CompressionGzip)*4 < sizeOf(CompressionNone))
+
+	//压缩与未压缩的条目混合存在，读取时透明解压并保持原始类型
+	dir := t.TempDir()
+	var want []string
+	for _, ct := range []CompressionType{CompressionNone, CompressionGzip, CompressionNone} {
+		l, err := Open(dir, WithFilePrex("test_"), WithCompression(ct), WithWriteFlag(WF_SYNCFLUSH, 0))
+		require.Nil(t, err)
+		for _, data := range []string{"small", big + fmt.Sprint(ct)} {
+			_, err = l.WriteBytes([]byte(data))
+			require.Nil(t, err)
+			want = append(want, data)
+		}
+		l.Close()
+	}
+	l, err := Open(dir, WithFilePrex("test_"), WithCompression(CompressionGzip), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	require.Nil(t, l.RegisterCoder(&StudentCoder{}))
+	s := &Student{Name: strings.Repeat("lws", 100), Age: 10}
+	idx, err := l.WriteRetIndex(1, s)
+	require.Nil(t, err)
+	require.Equal(t, want, readAll(t, l)[:len(want)])
+	obj, err := l.ReadObj(idx)
+	require.Nil(t, err)
+	require.Equal(t, s, obj)
+	le, err := l.ReadEntry(idx)
+	require.Nil(t, err)
+	require.Equal(t, int8(1), le.Typ)
+	l.Close()
+}
+
+type zlibCompressor struct{}
+
+func (zlibCompressor) Type() CompressionType {
+	return 100
+}
+
+func (zlibCompressor) Compress(dst, data []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w := zlib.NewWriter(buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	err := w.Close()
+	return buf.Bytes(), err
+}
+
+func (zlibCompressor) Decompress(dst, data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(dst)
+	_, err = io.Copy(buf, r)
+	return buf.Bytes(), err
+}
+
+func TestLws_RegisterCompressor(t *testing.T) {
+	dir := t.TempDir()
+	_, err := Open(dir, WithFilePrex("test_"), WithCompression(zlibCompressor{}.Type()))
+	require.Equal(t, ErrCompressorNotExist, err)
+	require.Nil(t, RegisterCompressor(zlibCompressor{}))
+	require.Equal(t, ErrCompressorExist, RegisterCompressor(zlibCompressor{}))
+
+	l, err := Open(dir, WithFilePrex("test_"), WithCompression(zlibCompressor{}.Type()), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	data := strings.Repeat("zlib", 100)
+	idx, err := l.WriteBytes([]byte(data))
+	require.Nil(t, err)
+	l.Close()
+	l, err = Open(dir, WithFilePrex("test_"))
+	require.Nil(t, err)
+	got, err := l.Read(idx)
+	require.Nil(t, err)
+	require.Equal(t, data, string(got))
+	l.Close()
+}
+
+func TestLws_Encryption(t *testing.T) {
+	dir := t.TempDir()
+	key1, key2 := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 16)
+	secret := strings.Repeat("secret payload ", 20)
+	enc, err := NewEncryptor(1, key1)
+	require.Nil(t, err)
+	l, err := Open(dir, WithFilePrex("test_"), WithEncryptor(enc), WithCompression(CompressionGzip), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	_, err = l.WriteBytes([]byte(secret))
+	require.Nil(t, err)
+	_, err = l.WriteBytes([]byte("short secret"))
+	require.Nil(t, err)
+	//轮换密钥，之后写入的条目使用新密钥
+	require.Nil(t, enc.Rotate(2, key2))
+	require.Equal(t, uint32(2), enc.KeyID())
+	_, err = l.WriteBytes([]byte("rotated secret"))
+	require.Nil(t, err)
+	require.Equal(t, []string{secret, "short secret", "rotated secret"}, readAll(t, l))
+	path := l.segments.First().Path
+	l.Close()
+
+	raw, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.False(t, bytes.Contains(raw, []byte("secret")))
+
+	//持有全部密钥可以读取所有条目
+	enc, err = NewEncryptor(2, key2)
+	require.Nil(t, err)
+	require.Nil(t, enc.AddKey(1, key1))
+	l, err = Open(dir, WithFilePrex("test_"), WithEncryptor(enc))
+	require.Nil(t, err)
+	require.Equal(t, []string{secret, "short secret", "rotated secret"}, readAll(t, l))
+	l.Close()
+
+	//缺少老密钥或没有加密器时返回ErrKeyNotFound
+	enc, err = NewEncryptor(2, key2)
+	require.Nil(t, err)
+	l, err = OpenReadOnly(dir, WithFilePrex("test_"), WithEncryptor(enc))
+	require.Nil(t, err)
+	_, err = l.Read(1)
+	require.True(t, errors.Is(err, ErrKeyNotFound))
+	data, err := l.Read(3)
+	require.Nil(t, err)
+	require.Equal(t, "rotated secret", string(data))
+	l.Close()
+	l, err = OpenReadOnly(dir, WithFilePrex("test_"))
+	require.Nil(t, err)
+	_, err = l.Read(3)
+	require.True(t, errors.Is(err, ErrKeyNotFound))
+	l.Close()
+}
+
+func TestLws_EncryptionTamper(t *testing.T) {
+	dir := t.TempDir()
+	enc, err := NewEncryptor(1, bytes.Repeat([]byte{1}, 32))
+	require.Nil(t, err)
+	//不进行校验时，篡改由AES-GCM的认证检测
+	l, err := Open(dir, WithFilePrex("test_"), WithEncryptor(enc), WithChecksum(ChecksumNone), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	_, err = l.WriteBytes([]byte("payload"))
+	require.Nil(t, err)
+	path := l.segments.First().Path
+	l.Close()
+	raw, err := os.ReadFile(path)
+	require.Nil(t, err)
+	raw[len(raw)-1] ^= 0xff
+	require.Nil(t, os.WriteFile(path, raw, 0644))
+
+	l, err = OpenReadOnly(dir, WithFilePrex("test_"), WithEncryptor(enc))
+	require.Nil(t, err)
+	_, err = l.Read(1)
+	require.Equal(t, ErrDecrypt, err)
+	l.Close()
+}
+
+func TestLws_TypeTamper(t *testing.T) {
+	dir := t.TempDir()
+	enc, err := NewEncryptor(1, bytes.Repeat([]byte{1}, 32))
+	require.Nil(t, err)
+	l, err := Open(dir, WithFilePrex("test_"), WithEncryptor(enc), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	_, err = l.WriteBytes([]byte("payload"))
+	require.Nil(t, err)
+	path := l.segments.First().Path
+	l.Close()
+	raw, err := os.ReadFile(path)
+	require.Nil(t, err)
+	typ := segmentHeaderSize + lenSize + crc32Size
+	require.Equal(t, encryptedType, int8(raw[typ]))
+
+	//校验值覆盖类型字段，加密条目的类型被篡改为普通类型时不会将密文作为明文返回
+	tampered := append([]byte(nil), raw...)
+	tampered[typ] = byte(RawCoderType)
+	require.Nil(t, os.WriteFile(path, tampered, 0644))
+	l, err = OpenReadOnly(dir, WithFilePrex("test_"), WithEncryptor(enc))
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), l.LastIndex())
+	l.Close()
+
+	//校验值被同时重新计算时，未知的系统保留类型被视为损坏
+	unknown := int8(-5)
+	tampered[typ] = byte(unknown)
+	dl := int(deserializeUint32(tampered[segmentHeaderSize:]))
+	serializateUint32(tampered[typ-crc32Size:], crc32.ChecksumIEEE(tampered[typ:segmentHeaderSize+lenSize+dl]))
+	require.Nil(t, os.WriteFile(path, tampered, 0644))
+	l, err = OpenReadOnly(dir, WithFilePrex("test_"), WithEncryptor(enc))
+	require.Nil(t, err)
+	_, err = l.Read(1)
+	require.Equal(t, ErrCorruptEntry, err)
+	l.Close()
+}
+
+func TestLws_HashChain(t *testing.T) {
+	dir := t.TempDir()
+	enc, err := NewEncryptor(1, bytes.Repeat([]byte{1}, 32))
+	require.Nil(t, err)
+	l, err := Open(dir, WithFilePrex("test_"), WithSegmentSize(200), WithHashChain(), WithEncryptor(enc), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	var want []string
+	for i := 0; i < 10; i++ {
+		data := fmt.Sprintf("entry_%d", i)
+		_, err = l.WriteBytes([]byte(data))
+		require.Nil(t, err)
+		want = append(want, data)
+	}
+	b := NewBatch()
+	for i := 0; i < 3; i++ {
+		data := fmt.Sprintf("batch_%d", i)
+		b.Add(RawCoderType, []byte(data))
+		want = append(want, data)
+	}
+	_, _, err = l.WriteBatch(b)
+	require.Nil(t, err)
+	require.Greater(t, l.segments.Len(), 1)
+	require.Nil(t, l.VerifyChain(1, l.LastIndex()))
+	//截断后继续写入，哈希链从保留的最后一个条目处延续
+	require.Nil(t, l.TruncateBack(8))
+	want = want[:8]
+	_, err = l.WriteBytes([]byte("after_truncate"))
+	require.Nil(t, err)
+	want = append(want, "after_truncate")
+	l.Close()
+
+	//重新打开后，写入者从文件中最新的条目处延续哈希链
+	l, err = Open(dir, WithFilePrex("test_"), WithSegmentSize(200), WithHashChain(), WithEncryptor(enc), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	_, err = l.WriteBytes([]byte("reopen"))
+	require.Nil(t, err)
+	want = append(want, "reopen")
+	require.Equal(t, want, readAll(t, l))
+	last := l.LastIndex()
+	require.Nil(t, l.VerifyChain(1, last))
+	require.Nil(t, l.VerifyChain(5, last))
+	require.Equal(t, ErrNotFound, l.VerifyChain(1, last+1))
+	var second *Segment
+	l.segments.ForEach(func(i int, s *Segment) bool {
+		second = s
+		return i == 1
+	})
+	l.Close()
+
+	//重写第二个文件的第一个条目并重新计算校验值，CRC无法发现，哈希链可以发现
+	raw, err := os.ReadFile(second.Path)
+	require.Nil(t, err)
+	pos := segmentHeaderSize
+	dl := int(deserializeUint32(raw[pos:]))
+	rec := raw[pos+lenSize+crc32Size+typeSize : pos+lenSize+dl]
+	rec[len(rec)-1] ^= 0xff
+	copy(rec, chainHash(make([]byte, hashSize), int8(rec[hashSize]), rec[chainHeaderSize:]))
+	serializateUint32(raw[pos+lenSize:], crc32.ChecksumIEEE(raw[pos+lenSize+crc32Size:pos+lenSize+dl]))
+	require.Nil(t, os.WriteFile(second.Path, raw, 0644))
+
+	l, err = OpenReadOnly(dir, WithFilePrex("test_"), WithEncryptor(enc))
+	require.Nil(t, err)
+	require.Equal(t, last, l.LastIndex())
+	require.Nil(t, l.VerifyChain(1, second.Index-1))
+	err = l.VerifyChain(1, last)
+	var ce *ChainError
+	require.True(t, errors.As(err, &ce))
+	require.Equal(t, second.Index, ce.Index)
+	require.True(t, errors.Is(err, ErrChainBroken))
+	l.Close()
+
+	//未开启哈希链的日志
+	l, err = Open(t.TempDir(), WithFilePrex("test_"))
+	require.Nil(t, err)
+	_, err = l.WriteBytes([]byte("plain"))
+	require.Nil(t, err)
+	require.True(t, errors.Is(l.VerifyChain(1, 1), ErrChainMissing))
+	l.Close()
+}
+
+func TestLws_MerkleProof(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, WithFilePrex("test_"), WithSegmentSize(200), WithMerkle(), WithCompression(CompressionGzip), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	for i := 0; i < 30; i++ {
+		_, err = l.WriteBytes([]byte(fmt.Sprintf("entry_%d", i)))
+		require.Nil(t, err)
+	}
+	require.Greater(t, l.segments.Len(), 2)
+	last := l.segments.Last()
+	for idx := uint64(1); idx < last.Index; idx++ {
+		proof, err := l.Proof(idx)
+		require.Nil(t, err)
+		le, err := l.ReadEntry(idx)
+		require.Nil(t, err)
+		require.True(t, VerifyProof(proof.Root, le, proof))
+		//数据或证明被篡改
+		le.Data = append(le.Data, 'x')
+		require.False(t, VerifyProof(proof.Root, le, proof))
+		le.Data = le.Data[:len(le.Data)-1]
+		if len(proof.Path) > 0 {
+			proof.LeafIndex ^= 1
+			require.False(t, VerifyProof(proof.Root, le, proof))
+		}
+	}
+	//正在写入的文件还未封存
+	_, err = l.Proof(last.Index)
+	require.Equal(t, ErrSegmentUnsealed, err)
+	_, err = l.Proof(l.LastIndex() + 1)
+	require.Equal(t, ErrNotFound, err)
+
+	//截断后边界文件重新写入，其默克尔文件被删除，之后的文件及默克尔文件被删除
+	first := l.segments.First()
+	require.Nil(t, l.TruncateBack(first.Index+1))
+	_, err = l.Proof(first.Index)
+	require.Equal(t, ErrSegmentUnsealed, err)
+	names, err := filepath.Glob(filepath.Join(dir, "*."+merkleExtension))
+	require.Nil(t, err)
+	require.Empty(t, names)
+	_, err = l.WriteBytes([]byte("after_truncate"))
+	require.Nil(t, err)
+	l.Close()
+
+	//叶子哈希随写入累计，截断及重新打开后与文件中的条目保持一致
+	l, err = Open(dir, WithFilePrex("test_"), WithSegmentSize(200), WithMerkle(), WithCompression(CompressionGzip), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	for i := 0; i < 30; i++ {
+		_, err = l.WriteBytes([]byte(fmt.Sprintf("reopen_%d", i)))
+		require.Nil(t, err)
+	}
+	last = l.segments.Last()
+	for idx := uint64(1); idx < last.Index; idx++ {
+		proof, err := l.Proof(idx)
+		require.Nil(t, err)
+		le, err := l.ReadEntry(idx)
+		require.Nil(t, err)
+		require.True(t, VerifyProof(proof.Root, le, proof))
+	}
+	l.Close()
+}
+
+func TestLws_SegmentIndex(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, WithFilePrex("test_"), WithSegmentSize(200), WithWriteFlag(WF_TIMEDFLUSH, 0))
+	require.Nil(t, err)
+	var want []string
+	for i := 0; i < 30; i++ {
+		data := fmt.Sprintf("entry_%d", i)
+		_, err = l.WriteBytes([]byte(data))
+		require.Nil(t, err)
+		want = append(want, data)
+	}
+	b := NewBatch()
+	b.Add(RawCoderType, []byte("batch_0"))
+	b.Add(RawCoderType, []byte("batch_1"))
+	_, _, err = l.WriteBatch(b)
+	require.Nil(t, err)
+	want = append(want, "batch_0", "batch_1")
+	require.Greater(t, l.segments.Len(), 2)
+	var segs []*Segment
+	l.segments.ForEach(func(i int, s *Segment) bool {
+		segs = append(segs, s)
+		return false
+	})
+	sealed := segs[:len(segs)-1]
+	l.Close()
+
+	//封存的文件都有偏移索引，且与遍历文件得到的位置一致
+	for _, s := range sealed {
+		_, err = os.Stat(sidecarPath(s.Path, indexExtension))
+		require.Nil(t, err)
+		sr, err := NewSegmentReader(&Segment{ID: s.ID, Index: s.Index, Path: s.Path}, FT_NORMAL)
+		require.Nil(t, err)
+		scan := &SegmentReader{SegmentProcessor: sr.SegmentProcessor, s: sr.s, end: sr.base}
+		scan.end, _ = scan.traverseValidEntries(scan.end, func(ue *posEntry) {
+			scan.pos = append(scan.pos, ue.pos)
+		})
+		require.Equal(t, scan.pos, sr.pos)
+		require.Equal(t, scan.end, sr.end)
+		sr.Close()
+	}
+
+	l, err = OpenReadOnly(dir, WithFilePrex("test_"))
+	require.Nil(t, err)
+	require.Equal(t, want, readAll(t, l))
+	l.Close()
+
+	//索引损坏或文件数据与索引不一致时退回遍历文件
+	idx := sidecarPath(sealed[0].Path, indexExtension)
+	raw, err := os.ReadFile(idx)
+	require.Nil(t, err)
+	raw[indexHeaderSize] ^= 0xff
+	require.Nil(t, os.WriteFile(idx, raw, 0644))
+	data, err := os.ReadFile(sealed[1].Path)
+	require.Nil(t, err)
+	cut := len(data) - 1
+	require.Nil(t, os.Truncate(sealed[1].Path, int64(cut)))
+	l, err = OpenReadOnly(dir, WithFilePrex("test_"))
+	require.Nil(t, err)
+	rd, err := l.findReaderByIndex(sealed[0].Index)
+	require.Nil(t, err)
+	require.Equal(t, sealed[1].Index-1, rd.LastIndex())
+	rd, err = l.findReaderByIndex(sealed[1].Index)
+	require.Nil(t, err)
+	require.Equal(t, segs[2].Index-2, rd.LastIndex())
+	l.Close()
+}
+
+func TestLws_RecoveryPolicy(t *testing.T) {
+	//生成中间条目损坏的日志，返回损坏条目在文件中的位置
+	corrupt := func(dir string) int {
+		l, err := Open(dir, WithFilePrex("test_"), WithWriteFileType(FT_NORMAL), WithWriteFlag(WF_SYNCFLUSH, 0))
+		require.Nil(t, err)
+		for i := 1; i <= 10; i++ {
+			_, err = l.WriteBytes([]byte(fmt.Sprintf("entry_%d", i)))
+			require.Nil(t, err)
+		}
+		s := l.segments.First()
+		rd, err := l.findReaderByIndex(5)
+		require.Nil(t, err)
+		pos := rd.pos[4]
+		l.Close()
+		raw, err := os.ReadFile(s.Path)
+		require.Nil(t, err)
+		raw[pos+lenSize+crc32Size+typeSize] ^= 0xff
+		require.Nil(t, os.WriteFile(s.Path, raw, 0644))
+		return pos
+	}
+
+	dir := t.TempDir()
+	pos := corrupt(dir)
+	path := filepath.Join(dir, "test_00001_1.wal")
+	raw, err := os.ReadFile(path)
+	require.Nil(t, err)
+	_, err = Open(dir, WithFilePrex("test_"), WithRecoveryPolicy(FailOnCorruption))
+	require.True(t, errors.Is(err, ErrCorruption))
+	var ce *CorruptionError
+	require.True(t, errors.As(err, &ce))
+	require.Equal(t, uint64(1), ce.Report.SegmentID)
+	require.Equal(t, int64(pos), ce.Report.Offset)
+	require.Equal(t, int64(len(raw)-pos), ce.Report.Discarded)
+	//FailOnCorruption不修改文件
+	after, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, raw, after)
+
+	//跳过损坏的条目，其仍占用索引
+	l, err := Open(dir, WithFilePrex("test_"), WithRecoveryPolicy(SkipCorrupt), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	require.Equal(t, uint64(10), l.LastIndex())
+	report := l.RecoveryReport()
+	require.NotNil(t, report)
+	require.Equal(t, 1, report.Skipped)
+	require.Equal(t, int64(0), report.Discarded)
+	_, err = l.Read(5)
+	require.Equal(t, ErrCorruptEntry, err)
+	data, err := l.Read(6)
+	require.Nil(t, err)
+	require.Equal(t, "entry_6", string(data))
+	_, err = l.WriteBytes([]byte("entry_11"))
+	require.Nil(t, err)
+	l.Close()
+
+	//拷贝文件留存后截断损坏处之后的数据
+	dir = t.TempDir()
+	pos = corrupt(dir)
+	path = filepath.Join(dir, "test_00001_1.wal")
+	raw, err = os.ReadFile(path)
+	require.Nil(t, err)
+	l, err = Open(dir, WithFilePrex("test_"), WithRecoveryPolicy(QuarantineSegment))
+	require.Nil(t, err)
+	require.Equal(t, uint64(4), l.LastIndex())
+	report = l.RecoveryReport()
+	require.NotNil(t, report)
+	require.Equal(t, QuarantineSegment, report.Policy)
+	require.Equal(t, int64(len(raw)-pos), report.Discarded)
+	saved, err := os.ReadFile(report.Quarantine)
+	require.Nil(t, err)
+	require.Equal(t, raw, saved)
+	l.Close()
+	l, err = Open(dir, WithFilePrex("test_"))
+	require.Nil(t, err)
+	require.Nil(t, l.RecoveryReport())
+	require.Equal(t, uint64(4), l.LastIndex())
+	l.Close()
+}
+
+func TestLws_RecoveryExtent(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, WithFilePrex("test_"), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	for i := 1; i <= 10; i++ {
+		_, err = l.WriteBytes([]byte(fmt.Sprintf("entry_%d", i)))
+		require.Nil(t, err)
+	}
+	end := l.sw.Size()
+	path := l.segments.Last().Path
+	//模拟崩溃：文件保持预分配的大小
+	l.sw.SegmentProcessor.Close()
+	l.dirLock.Unlock()
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	require.Nil(t, err)
+	_, err = f.WriteAt(bytes.Repeat([]byte{0xff}, 100), end)
+	require.Nil(t, err)
+	//全零区域之后的数据不属于残留数据，不会被扫描
+	_, err = f.WriteAt([]byte{0xff}, end+4<<20)
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+
+	l, err = Open(dir, WithFilePrex("test_"))
+	require.Nil(t, err)
+	report := l.RecoveryReport()
+	require.NotNil(t, report)
+	require.Equal(t, end, report.Offset)
+	require.Equal(t, int64(100), report.Discarded)
+	require.Equal(t, uint64(10), l.LastIndex())
+	l.Close()
+}
+
+func TestLws_RecoveryPolicySealed(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, WithFilePrex("test_"), WithSegmentSize(200), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	for i := 1; i <= 30; i++ {
+		_, err = l.WriteBytes([]byte(fmt.Sprintf("entry_%d", i)))
+		require.Nil(t, err)
+	}
+	first := l.segments.First()
+	l.Close()
+	raw, err := os.ReadFile(first.Path)
+	require.Nil(t, err)
+	raw[segmentHeaderSize+lenSize+crc32Size+typeSize] ^= 0xff
+	require.Nil(t, os.WriteFile(first.Path, raw, 0644))
+
+	//通过偏移索引加载的文件在读取时校验
+	l, err = OpenReadOnly(dir, WithFilePrex("test_"), WithRecoveryPolicy(FailOnCorruption))
+	require.Nil(t, err)
+	_, err = l.Read(1)
+	require.Equal(t, ErrCorruptEntry, err)
+	_, err = l.Read(2)
+	require.Nil(t, err)
+	l.Close()
+
+	//没有偏移索引时加载已封存的文件即按策略处理
+	require.Nil(t, removeSidecars(storage{diskBackend{}}, first.Path))
+	l, err = OpenReadOnly(dir, WithFilePrex("test_"), WithRecoveryPolicy(FailOnCorruption))
+	require.Nil(t, err)
+	_, err = l.Read(2)
+	require.True(t, errors.Is(err, ErrCorruption))
+	l.Close()
+	l, err = OpenReadOnly(dir, WithFilePrex("test_"), WithRecoveryPolicy(SkipCorrupt))
+	require.Nil(t, err)
+	_, err = l.Read(1)
+	require.Equal(t, ErrCorruptEntry, err)
+	_, err = l.Read(2)
+	require.Nil(t, err)
+	l.Close()
+}
+
+func TestLws_WriteEntry(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, WithFilePrex("test_"))
+	require.Nil(t, err)
+	defer l.Close()
+	idx, err := l.WriteEntry(3, []byte("typed"))
+	require.Nil(t, err)
+	le, err := l.ReadEntry(idx)
+	require.Nil(t, err)
+	require.Equal(t, int8(3), le.Typ)
+	require.Equal(t, "typed", string(le.Data))
+	_, err = l.WriteEntry(batchHeaderType, []byte("x"))
+	require.Equal(t, ErrCodeSysType, err)
+
+	err = l.WriteEntriesToFile("side.log", []*LogEntry{{Typ: 2, Data: []byte("a")}, {Typ: 3, Data: []byte("b")}})
+	require.Nil(t, err)
+	require.NotNil(t, l.WriteEntriesToFile("test_00001_1.wal", nil))
+	it, err := l.ReadFromFile("side.log")
+	require.Nil(t, err)
+	require.True(t, it.HasNextN(2))
+	le, err = it.NextN(2).GetEntry()
+	require.Nil(t, err)
+	require.Equal(t, int8(3), le.Typ)
+	require.Equal(t, "b", string(le.Data))
+}
+
+func TestLws_Memory(t *testing.T) {
+	const path = "mem://memory_test"
+	defer file.RemoveMemDir("memory_test")
+	l, err := Open(path, WithFilePrex("test_"), WithSegmentSize(200), WithMerkle())
+	require.Nil(t, err)
+	require.Equal(t, FT_MEMORY, l.opts.Ft)
+	for i := 1; i <= 50; i++ {
+		_, err = l.WriteBytes([]byte(fmt.Sprintf("entry_%d", i)))
+		require.Nil(t, err)
+	}
+	require.True(t, l.segments.Len() > 3)
+	_, err = Open(path, WithFilePrex("test_"))
+	require.True(t, errors.Is(err, ErrLocked))
+	it := l.NewLogIterator()
+	for i := 1; it.HasNext(); i++ {
+		data, err := it.Next().Get()
+		require.Nil(t, err)
+		require.Equal(t, fmt.Sprintf("entry_%d", i), string(data))
+	}
+	it.Release()
+	proof, err := l.Proof(2)
+	require.Nil(t, err)
+	require.True(t, VerifyProof(proof.Root, &LogEntry{Data: []byte("entry_2")}, proof))
+	require.Nil(t, l.TruncateFront(20))
+	first := l.segments.First().Index
+	require.True(t, first > 1 && first <= 20)
+	l.Close()
+	//没有进行任何磁盘读写
+	_, err = os.Stat("memory_test")
+	require.True(t, os.IsNotExist(err))
+
+	//同一进程中重新打开，模拟重启
+	l, err = Open(path, WithFilePrex("test_"), WithSegmentSize(200))
+	require.Nil(t, err)
+	require.Equal(t, uint64(20), l.FirstIndex())
+	require.Equal(t, uint64(50), l.LastIndex())
+	idx, err := l.WriteBytes([]byte("entry_51"))
+	require.Nil(t, err)
+	require.Equal(t, uint64(51), idx)
+	require.Nil(t, l.WriteToFile("side.log", RawCoderType, []byte("side")))
+	l.Close()
+
+	l, err = OpenReadOnly(path, WithFilePrex("test_"))
+	require.Nil(t, err)
+	defer l.Close()
+	data, err := l.Read(51)
+	require.Nil(t, err)
+	require.Equal(t, "entry_51", string(data))
+	fit, err := l.ReadFromFile("side.log")
+	require.Nil(t, err)
+	data, err = fit.Next().Get()
+	require.Nil(t, err)
+	require.Equal(t, "side", string(data))
+
+	//离线工具通过ListSegments获取的段在其所在的内存后端上隔离
+	segs, err := ListSegments(path, WithFilePrex("test_"))
+	require.Nil(t, err)
+	require.Equal(t, l.segments.Len(), len(segs))
+	last := segs[len(segs)-1]
+	dst, err := MoveToQuarantine(last)
+	require.Nil(t, err)
+	_, err = memBackend{}.Stat(dst)
+	require.Nil(t, err)
+	_, err = memBackend{}.Stat(last.Path)
+	require.True(t, os.IsNotExist(err))
+}
+
+//countBackend 统计调用次数的自定义存储后端
+type countBackend struct {
+	memBackend
+	creates, removes, syncs int32
+}
+
+func (cb *countBackend) Create(path string) (LwsFile, error) {
+	atomic.AddInt32(&cb.creates, 1)
+	return cb.memBackend.Create(path)
+}
+
+func (cb *countBackend) Remove(path string) error {
+	atomic.AddInt32(&cb.removes, 1)
+	return cb.memBackend.Remove(path)
+}
+
+func (cb *countBackend) SyncDir(dir string) error {
+	atomic.AddInt32(&cb.syncs, 1)
+	return nil
+}
+
+func TestLws_Backend(t *testing.T) {
+	cb := &countBackend{}
+	require.Nil(t, RegisterBackend("Custom", cb))
+	require.Equal(t, ErrBackendExist, RegisterBackend("custom", &countBackend{}))
+	require.Equal(t, ErrBackendExist, RegisterBackend("file", &countBackend{}))
+	defer file.RemoveMemDir("backend_test")
+
+	l, err := Open("custom://backend_test", WithFilePrex("test_"), WithSegmentSize(200), WithWriteFileType(FT_MMAP))
+	require.Nil(t, err)
+	require.Equal(t, FT_NORMAL, l.opts.Ft)
+	for i := 1; i <= 50; i++ {
+		_, err = l.WriteBytes([]byte(fmt.Sprintf("entry_%d", i)))
+		require.Nil(t, err)
+	}
+	require.True(t, l.segments.Len() > 3)
+	require.True(t, atomic.LoadInt32(&cb.creates) > 3)
+	//封存时写入的附属文件重命名后同步目录
+	require.True(t, atomic.LoadInt32(&cb.syncs) >= int32(l.segments.Len()-1))
+	require.Nil(t, l.Purge(PurgeWithKeepFiles(2)))
+	require.True(t, atomic.LoadInt32(&cb.removes) > 0)
+	l.Close()
+	_, err = os.Stat("backend_test")
+	require.True(t, os.IsNotExist(err))
+
+	l, err = Open("custom://backend_test", WithFilePrex("test_"), WithSegmentSize(200))
+	require.Nil(t, err)
+	defer l.Close()
+	require.Equal(t, 2, l.segments.Len())
+	require.Equal(t, uint64(50), l.LastIndex())
+	data, err := l.Read(l.FirstIndex())
+	require.Nil(t, err)
+	require.Equal(t, fmt.Sprintf("entry_%d", l.FirstIndex()), string(data))
+}
+
+func TestLws_Replicate(t *testing.T) {
+	leaderDir, followerDir := t.TempDir(), t.TempDir()
+	leader, err := Open(leaderDir, WithFilePrex("test_"), WithSegmentSize(200), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	defer leader.Close()
+	for i := 1; i <= 20; i++ {
+		_, err = leader.WriteEntry(int8(i%3), []byte(fmt.Sprintf("entry_%d", i)))
+		require.Nil(t, err)
+	}
+	//推送的是还原后的条目，必须指定TLS配置或共享密钥
+	_, err = leader.NewReplicator("tcp://127.0.0.1:0")
+	require.Equal(t, ErrReplicaInsecure, err)
+	secret := []byte("replication secret")
+	rp, err := leader.NewReplicator("tcp://127.0.0.1:0", ReplicateWithSecret(secret))
+	require.Nil(t, err)
+	addr := rp.Addr().String()
+
+	follower, err := Open(followerDir, WithFilePrex("test_"), WithSegmentSize(200))
+	require.Nil(t, err)
+	defer follower.Close()
+	_, err = follower.Follow(addr)
+	require.Equal(t, ErrReplicaInsecure, err)
+	f, err := follower.Follow("tcp://"+addr, FollowWithName("f1"), FollowWithRetryInterval(10*time.Millisecond), FollowWithSecret(secret))
+	require.Nil(t, err)
+	caughtUp := func(index uint64) func() bool {
+		return func() bool {
+			return follower.LastIndex() == index && rp.AckedIndex("f1") == index
+		}
+	}
+	require.Eventually(t, caughtUp(20), 5*time.Second, 5*time.Millisecond)
+	//新写入的条目被持续推送
+	_, err = leader.WriteBytes([]byte("entry_21"))
+	require.Nil(t, err)
+	require.Eventually(t, caughtUp(21), 5*time.Second, 5*time.Millisecond)
+
+	//主节点断开期间写入的条目在重连后从断开处继续复制
+	require.Nil(t, rp.Close())
+	for i := 22; i <= 40; i++ {
+		_, err = leader.WriteEntry(int8(i%3), []byte(fmt.Sprintf("entry_%d", i)))
+		require.Nil(t, err)
+	}
+	rp, err = leader.NewReplicator(addr, ReplicateWithSecret(secret))
+	require.Nil(t, err)
+	defer rp.Close()
+	require.Eventually(t, caughtUp(40), 5*time.Second, 5*time.Millisecond)
+
+	//主节点截断尾部后，从节点随之截断，并复制截断后新写入的条目
+	require.Nil(t, leader.TruncateBack(35))
+	require.Eventually(t, func() bool {
+		return follower.LastIndex() == 35 && rp.AckedIndex("f1") == 35
+	}, 5*time.Second, 5*time.Millisecond)
+	for i := 36; i <= 40; i++ {
+		_, err = leader.WriteEntry(int8(i%3), []byte(fmt.Sprintf("new_%d", i)))
+		require.Nil(t, err)
+	}
+	require.Eventually(t, caughtUp(40), 5*time.Second, 5*time.Millisecond)
+	require.Nil(t, f.Close())
+	require.Nil(t, f.Err())
+	for i := uint64(1); i <= 40; i++ {
+		want, err := leader.ReadEntry(i)
+		require.Nil(t, err)
+		le, err := follower.ReadEntry(i)
+		require.Nil(t, err)
+		require.Equal(t, want.Typ, le.Typ)
+		require.Equal(t, want.Data, le.Data)
+	}
+
+	//主节点已清理的条目无法复制
+	require.Nil(t, leader.Purge(PurgeWithKeepFiles(1)))
+	require.True(t, leader.FirstIndex() > 1)
+	empty, err := Open(t.TempDir())
+	require.Nil(t, err)
+	defer empty.Close()
+	f, err = empty.Follow(addr, FollowWithSecret(secret))
+	require.Nil(t, err)
+	<-f.Done()
+	require.True(t, errors.Is(f.Err(), ErrCompacted))
+
+	//共享密钥不一致时认证失败，复制终止
+	f, err = empty.Follow(addr, FollowWithSecret([]byte("wrong secret")))
+	require.Nil(t, err)
+	<-f.Done()
+	require.Equal(t, ErrReplicaAuth, f.Err())
+
+	//传输中损坏的条目校验失败
+	var buf bytes.Buffer
+	require.Nil(t, writeRecord(&buf, 1, RawCoderType, []byte("entry")))
+	raw := buf.Bytes()
+	raw[len(raw)-1] ^= 0xff
+	_, _, _, err = readRecord(bytes.NewReader(raw))
+	require.Equal(t, ErrReplicaChecksum, err)
+}
+
+func TestLws_ReplicateTLS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	leader, err := Open(t.TempDir(), WithFilePrex("test_"), WithWriteFlag(WF_SYNCFLUSH, 0))
+	require.Nil(t, err)
+	defer leader.Close()
+	for i := 1; i <= 10; i++ {
+		_, err = leader.WriteBytes([]byte(fmt.Sprintf("entry_%d", i)))
+		require.Nil(t, err)
+	}
+	rp, err := leader.NewReplicator("127.0.0.1:0", ReplicateWithTLS(&tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}))
+	require.Nil(t, err)
+	defer rp.Close()
+	follower, err := Open(t.TempDir(), WithFilePrex("test_"))
+	require.Nil(t, err)
+	defer follower.Close()
+	f, err := follower.Follow(rp.Addr().String(), FollowWithName("f1"), FollowWithRetryInterval(10*time.Millisecond), FollowWithTLS(&tls.Config{RootCAs: pool}))
+	require.Nil(t, err)
+	require.Eventually(t, func() bool {
+		return follower.LastIndex() == 10 && rp.AckedIndex("f1") == 10
+	}, 5*time.Second, 5*time.Millisecond)
+	require.Nil(t, f.Close())
+	data, err := follower.Read(10)
+	require.Nil(t, err)
+	require.Equal(t, "entry_10", string(data))
+}
+
+//failArchiver 归档失败的归档器
+type failArchiver struct{}
+
+func (failArchiver) Archive(string, io.Reader) error {
+	return errors.New("archive failed")
+}
+
+func TestLws_Archive(t *testing.T) {
+	dir, gzDir, rawDir := t.TempDir(), t.TempDir(), t.TempDir()
+	gz, err := NewDirArchiver(gzDir, CompressionGzip)
+	require.Nil(t, err)
+	_, err = NewDirArchiver(rawDir, CompressionType(200))
+	require.Equal(t, ErrCompressorNotExist, err)
+	//归档到日志目录会覆盖待清理的文件
+	self, err := NewDirArchiver(dir, CompressionNone)
+	require.Nil(t, err)
+	_, err = Open(dir, WithFilePrex("test_"), WithArchiver(self))
+	require.Equal(t, ErrArchiveLogDir, err)
+	l, err := Open(dir, WithFilePrex("test_"), WithSegmentSize(200), WithArchiver(gz), WithMerkle())
+	require.Nil(t, err)
+	defer l.Close()
+	require.Equal(t, ErrArchiveLogDir, l.Purge(PurgeWithKeepFiles(1), PurgeWithArchiver(self)))
+	for i := 1; i <= 60; i++ {
+		_, err = l.WriteEntry(int8(i%2), []byte(fmt.Sprintf("entry_%d", i)))
+		require.Nil(t, err)
+	}
+	segs := l.segments.Len()
+	//归档失败时不删除任何文件
+	require.NotNil(t, l.Purge(PurgeWithKeepFiles(1), PurgeWithArchiver(failArchiver{})))
+	require.Equal(t, segs, l.segments.Len())
+	require.Equal(t, uint64(1), l.FirstIndex())
+
+	//默认的归档器压缩归档，指定的归档器原样归档
+	require.Nil(t, l.TruncateFront(20))
+	gzLast := l.segments.First().Index - 1
+	//归档目录同样不能位于日志目录中
+	nested, err := NewDirArchiver(filepath.Join(dir, "archive"), CompressionNone)
+	require.Nil(t, err)
+	require.Equal(t, ErrArchiveLogDir, l.Purge(PurgeWithKeepFiles(1), PurgeWithArchiver(nested)))
+	rawArchiver, err := NewDirArchiver(rawDir, CompressionNone)
+	require.Nil(t, err)
+	require.Nil(t, l.Purge(PurgeWithKeepFiles(1), PurgeWithArchiver(rawArchiver)))
+	rawFirst, rawLast := gzLast+1, l.segments.First().Index-1
+	require.True(t, rawLast > rawFirst)
+	files, err := filepath.Glob(filepath.Join(gzDir, "test_*.wal"+archiveCompressedExt))
+	require.Nil(t, err)
+	require.True(t, len(files) > 0)
+	files, err = filepath.Glob(filepath.Join(rawDir, "test_*.wal"))
+	require.Nil(t, err)
+	require.True(t, len(files) > 0)
+	//附属文件随文件一起归档
+	files, err = filepath.Glob(filepath.Join(rawDir, "test_*."+merkleExtension))
+	require.Nil(t, err)
+	require.True(t, len(files) > 0)
+	names, err := l.matchFiles()
+	require.Nil(t, err)
+	require.Equal(t, l.segments.Len(), len(names))
+
+	for _, c := range []struct {
+		dir         string
+		first, last uint64
+	}{
+		{gzDir, 1, gzLast},
+		{rawDir, rawFirst, rawLast},
+	} {
+		a, err := OpenArchive(c.dir, WithFilePrex("test_"))
+		require.Nil(t, err)
+		require.Equal(t, c.first, a.FirstIndex())
+		require.Equal(t, c.last, a.LastIndex())
+		it := a.NewLogIterator()
+		i := c.first
+		for ; it.HasNext(); i++ {
+			ele := it.Next()
+			require.Equal(t, i, ele.Index())
+			le, err := ele.GetEntry()
+			require.Nil(t, err)
+			require.Equal(t, int8(i%2), le.Typ)
+			require.Equal(t, fmt.Sprintf("entry_%d", i), string(le.Data))
+		}
+		it.Release()
+		require.Equal(t, c.last+1, i)
+		//归档的默克尔根依然可以验证归档的条目
+		proof, err := a.Proof(c.first)
+		require.Nil(t, err)
+		require.True(t, VerifyProof(proof.Root, &LogEntry{Typ: int8(c.first % 2), Data: []byte(fmt.Sprintf("entry_%d", c.first))}, proof))
+		require.Equal(t, ErrReadOnly, a.TruncateFront(c.last))
+		a.Close()
+	}
+
+	//压缩归档的文件头中记录的大小被损坏时返回ErrArchivedFile，不会按其分配内存
+	files, err = filepath.Glob(filepath.Join(gzDir, "test_*.wal"+archiveCompressedExt))
+	require.Nil(t, err)
+	raw, err := os.ReadFile(files[0])
+	require.Nil(t, err)
+	for i := 1; i < archiveHeadSize; i++ {
+		raw[i] = 0xff
+	}
+	require.Nil(t, os.WriteFile(files[0], raw, 0644))
+	path := strings.TrimSuffix(files[0], archiveCompressedExt)
+	_, err = archiveBackend{}.Open(path)
+	require.Equal(t, ErrArchivedFile, err)
+	_, err = archiveBackend{}.Stat(path)
+	require.Equal(t, ErrArchivedFile, err)
+}
+
+func TestLws_PurgeMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, WithFilePrex("test_"), WithSegmentSize(200))
+	require.Nil(t, err)
+	write := func(from, to int) {
+		for i := from; i <= to; i++ {
+			_, err := l.WriteBytes([]byte(fmt.Sprintf("entry_%d", i)))
+			require.Nil(t, err)
+		}
+	}
+	write(1, 30)
+	require.Nil(t, l.Purge(PurgeWithMaxAge(time.Hour)))
+	require.Equal(t, uint64(1), l.FirstIndex())
+	time.Sleep(300 * time.Millisecond)
+	write(31, 60)
+	//只清理封存时间超过保留时长的文件，第二批写入时封存的文件被保留
+	require.Nil(t, l.Purge(PurgeWithMaxAge(150*time.Millisecond)))
+	first := l.FirstIndex()
+	require.True(t, first > 1 && first <= 30)
+	l.Close()
+
+	//重新打开后根据下一个文件段头中的创建时间判断封存时间
+	l, err = Open(dir, WithFilePrex("test_"), WithSegmentSize(200))
+	require.Nil(t, err)
+	require.Nil(t, l.Purge(PurgeWithMaxAge(time.Hour)))
+	require.Equal(t, first, l.FirstIndex())
+	time.Sleep(300 * time.Millisecond)
+	require.Nil(t, l.Purge(PurgeWithMaxAge(150*time.Millisecond)))
+	require.Equal(t, 1, l.segments.Len())
+	require.Equal(t, uint64(60), l.LastIndex())
+	l.Close()
+
+	//没有写入时由定时检测清理过期的文件
+	l, err = Open(t.TempDir(), WithFilePrex("test_"), WithSegmentSize(200), WithAgeLimitForPurge(100*time.Millisecond))
+	require.Nil(t, err)
+	defer l.Close()
+	write(1, 30)
+	require.Eventually(t, func() bool {
+		l.segments.RLock()
+		defer l.segments.RUnlock()
+		return l.segments.Len() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	data, err := l.Read(30)
+	require.Nil(t, err)
+	require.Equal(t, "entry_30", string(data))
+}
+
+func TestLws_PurgeMaxAgeHeaderless(t *testing.T) {
+	dir := t.TempDir()
+	//生成三个没有段头的老版本文件，前两个的修改时间在两小时前
+	old := time.Now().Add(-2 * time.Hour)
+	for i, start := range []uint64{1, 6, 11} {
+		path := filepath.Join(dir, fmt.Sprintf("test_%05d_%d.wal", i+1, start))
+		f, err := newLogFile(diskBackend{}, path, FT_NORMAL, 0, 0, false, true)
+		require.Nil(t, err)
+		for j := 0; j < 5; j++ {
+			_, err = f.WriteLog(RawCoderType, []byte(fmt.Sprintf("legacy_%d", start+uint64(j))))
+			require.Nil(t, err)
+		}
+		require.Nil(t, f.Close())
+		if i < 2 {
+			require.Nil(t, os.Chtimes(path, old, old))
+		}
+	}
+
+	l, err := Open(dir, WithFilePrex("test_"))
+	require.Nil(t, err)
+	defer l.Close()
+	require.Equal(t, uint64(15), l.LastIndex())
+	require.Nil(t, l.Purge(PurgeWithMaxAge(3*time.Hour)))
+	require.Equal(t, uint64(1), l.FirstIndex())
+	//没有段头时使用文件自身的修改时间作为封存时间
+	require.Nil(t, l.Purge(PurgeWithMaxAge(time.Hour)))
+	require.Equal(t, uint64(11), l.FirstIndex())
+	data, err := l.Read(11)
+	require.Nil(t, err)
+	require.Equal(t, "legacy_11", string(data))
+}
@@ -0,0 +1,261 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package lws
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+)
+
+//默克尔文件布局(大端)：
+//	magic[4] | version[2] | reserved[2] | segmentID[8] | baseIndex[8] | count[8] | root[32] | leaves[32*count] | crc32[4]
+//叶子哈希为sha256(0x00|类型|数据)，内部节点哈希为sha256(0x01|左|右)，每层节点数为奇数时最后一个节点直接提升到上一层
+const (
+	merkleExtension         = "merkle"
+	merkleVersion    uint16 = 1
+	merkleHeaderSize        = 64
+
+	merkleLeafPrefix byte = 0
+	merkleNodePrefix byte = 1
+)
+
+var (
+	merkleMagic = []byte("LWSM")
+
+	ErrMerkleFile      = errors.New("invalid segment merkle file")
+	ErrSegmentUnsealed = errors.New("segment has not been sealed")
+)
+
+//MerkleProof 日志条目在其所在文件的默克尔树中的包含证明
+type MerkleProof struct {
+	Index     uint64   //日志条目的索引
+	SegmentID uint64   //日志条目所在文件的编号
+	LeafIndex uint64   //日志条目在文件中的序号
+	LeafCount uint64   //文件中日志条目的数量
+	Root      []byte   //文件的默克尔根
+	Path      [][]byte //自叶子向上的兄弟节点哈希
+}
+
+//merkleLeaf 计算日志条目的叶子哈希，数据为解密及解压后的原始数据
+func merkleLeaf(t int8, data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleLeafPrefix, byte(t)})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func merkleNode(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleNodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+//merkleRoot 根据叶子哈希计算默克尔根，没有叶子时为空数据的哈希
+func merkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	}
+	level := leaves
+	for len(level) > 1 {
+		level = merkleParents(level)
+	}
+	return level[0]
+}
+
+//merkleParents 计算上一层的节点，节点数为奇数时最后一个节点直接提升
+func merkleParents(level [][]byte) [][]byte {
+	parents := make([][]byte, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 < len(level) {
+			parents = append(parents, merkleNode(level[i], level[i+1]))
+		} else {
+			parents = append(parents, level[i])
+		}
+	}
+	return parents
+}
+
+//merklePath 生成第n个叶子自下而上的兄弟节点哈希
+func merklePath(leaves [][]byte, n uint64) [][]byte {
+	var path [][]byte
+	level := leaves
+	for len(level) > 1 {
+		if sibling := n ^ 1; sibling < uint64(len(level)) {
+			path = append(path, level[sibling])
+		}
+		level = merkleParents(level)
+		n /= 2
+	}
+	return path
+}
+
+/*
+ @title: VerifyProof
+ @description: 校验日志条目是否包含在默克尔根为root的文件中，无需读取文件
+ @param {[]byte} root 可信的文件默克尔根
+ @param {*LogEntry} entry 日志条目，通过ReadEntry读取到的类型及数据
+ @param {*MerkleProof} proof 通过Lws.Proof获取的包含证明
+ @return {bool} 条目包含在文件中返回true
+*/
+func VerifyProof(root []byte, entry *LogEntry, proof *MerkleProof) bool {
+	if entry == nil || proof == nil || proof.LeafIndex >= proof.LeafCount {
+		return false
+	}
+	var (
+		hash  = merkleLeaf(entry.Typ, entry.Data)
+		n     = proof.LeafIndex
+		count = proof.LeafCount
+		path  = proof.Path
+	)
+	for count > 1 {
+		//本层最后一个节点没有兄弟节点时直接提升
+		if n^1 < count {
+			if len(path) == 0 {
+				return false
+			}
+			if n&1 == 0 {
+				hash = merkleNode(hash, path[0])
+			} else {
+				hash = merkleNode(path[0], hash)
+			}
+			path = path[1:]
+		}
+		n /= 2
+		count = (count + 1) / 2
+	}
+	return len(path) == 0 && bytes.Equal(hash, root)
+}
+
+//segmentMerkle 封存的文件的默克尔信息
+type segmentMerkle struct {
+	SegmentID uint64
+	BaseIndex uint64
+	Root      []byte
+	Leaves    [][]byte
+}
+
+func (sm *segmentMerkle) encode() []byte {
+	b := make([]byte, merkleHeaderSize+len(sm.Leaves)*sha256.Size+crc32Size)
+	copy(b, merkleMagic)
+	binary.BigEndian.PutUint16(b[4:], merkleVersion)
+	binary.BigEndian.PutUint64(b[8:], sm.SegmentID)
+	binary.BigEndian.PutUint64(b[16:], sm.BaseIndex)
+	binary.BigEndian.PutUint64(b[24:], uint64(len(sm.Leaves)))
+	copy(b[32:], sm.Root)
+	for i, leaf := range sm.Leaves {
+		copy(b[merkleHeaderSize+i*sha256.Size:], leaf)
+	}
+	binary.BigEndian.PutUint32(b[len(b)-crc32Size:], crc32.ChecksumIEEE(b[:len(b)-crc32Size]))
+	return b
+}
+
+//decodeSegmentMerkle 解析并校验默克尔文件的内容，根需与叶子一致
+func decodeSegmentMerkle(b []byte) (*segmentMerkle, error) {
+	if len(b) < merkleHeaderSize+crc32Size || !bytes.Equal(b[:len(merkleMagic)], merkleMagic) {
+		return nil, ErrMerkleFile
+	}
+	if binary.BigEndian.Uint16(b[4:]) != merkleVersion {
+		return nil, ErrMerkleFile
+	}
+	count := binary.BigEndian.Uint64(b[24:])
+	if uint64(len(b)-merkleHeaderSize-crc32Size) != count*sha256.Size {
+		return nil, ErrMerkleFile
+	}
+	if binary.BigEndian.Uint32(b[len(b)-crc32Size:]) != crc32.ChecksumIEEE(b[:len(b)-crc32Size]) {
+		return nil, ErrMerkleFile
+	}
+	sm := &segmentMerkle{
+		SegmentID: binary.BigEndian.Uint64(b[8:]),
+		BaseIndex: binary.BigEndian.Uint64(b[16:]),
+		Root:      b[32:merkleHeaderSize],
+		Leaves:    make([][]byte, count),
+	}
+	for i := range sm.Leaves {
+		sm.Leaves[i] = b[merkleHeaderSize+i*sha256.Size : merkleHeaderSize+(i+1)*sha256.Size]
+	}
+	if !bytes.Equal(sm.Root, merkleRoot(sm.Leaves)) {
+		return nil, ErrMerkleFile
+	}
+	return sm, nil
+}
+
+//merkleLeaves 返回当前文件中随写入累计的叶子哈希，用于文件封存时生成默克尔根
+func (sw *SegmentWriter) merkleLeaves() ([][]byte, error) {
+	sw.writeLocker.Lock()
+	defer sw.writeLocker.Unlock()
+	return sw.leaves, sw.leafErr
+}
+
+//writeMerkle 计算即将封存的当前文件的默克尔根，并写入与其同名的默克尔文件
+func (l *Lws) writeMerkle(s *Segment) error {
+	leaves, err := l.sw.merkleLeaves()
+	if err != nil {
+		return err
+	}
+	sm := &segmentMerkle{
+		SegmentID: s.ID,
+		BaseIndex: s.Index,
+		Root:      merkleRoot(leaves),
+		Leaves:    leaves,
+	}
+	return l.store.WriteFile(sidecarPath(s.Path, merkleExtension), sm.encode())
+}
+
+/*
+ @title: Proof
+ @description: 生成日志条目在其所在文件的默克尔树中的包含证明，开启WithMerkle后通过rollover封存的文件才有默克尔根
+ @param {uint64} index 日志条目的索引
+ @return {*MerkleProof} 包含证明，其中记录了文件的默克尔根
+ @return {error} 条目所在的文件还未封存返回ErrSegmentUnsealed
+*/
+func (l *Lws) Proof(index uint64) (*MerkleProof, error) {
+	l.readRequest()
+	defer l.readRelease()
+	if index < l.FirstIndex() {
+		return nil, ErrCompacted
+	}
+	if index > l.LastIndex() {
+		return nil, ErrNotFound
+	}
+	s := l.findSegmentByIndex(index)
+	if s == nil {
+		return nil, ErrIndexOutOfRange
+	}
+	b, err := l.store.ReadFile(sidecarPath(s.Path, merkleExtension))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrSegmentUnsealed
+		}
+		return nil, err
+	}
+	sm, err := decodeSegmentMerkle(b)
+	if err != nil {
+		return nil, err
+	}
+	if sm.SegmentID != s.ID || sm.BaseIndex != s.Index {
+		return nil, ErrMerkleFile
+	}
+	n := index - s.Index
+	if n >= uint64(len(sm.Leaves)) {
+		return nil, ErrMerkleFile
+	}
+	return &MerkleProof{
+		Index:     index,
+		SegmentID: s.ID,
+		LeafIndex: n,
+		LeafCount: uint64(len(sm.Leaves)),
+		Root:      sm.Root,
+		Path:      merklePath(sm.Leaves, n),
+	}, nil
+}
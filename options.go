@@ -6,6 +6,8 @@ SPDX-License-Identifier: Apache-2.0
 */
 package lws
 
+import "time"
+
 type (
 	FlushStrategy int
 	FileType      int
@@ -23,6 +25,7 @@ const (
 const (
 	FT_NORMAL FileType = iota
 	FT_MMAP
+	FT_MEMORY //进程内的内存文件，不进行磁盘读写，通过mem://路径打开时使用
 )
 
 const (
@@ -37,10 +40,18 @@ type Options struct {
 	Ft                         FileType  //文件类型(1 普通文件 2 mmap) 默认1
 	MmapFileLock               bool      //文件映射的时候，是否锁定内存以提高write速度
 	BufferSize                 int
-	LogFileLimitForPurge       int //存在日志文件限制
-	LogEntryCountLimitForPurge int //存在日志条目限制
+	LogFileLimitForPurge       int           //存在日志文件限制
+	LogEntryCountLimitForPurge int           //存在日志条目限制
+	LogAgeLimitForPurge        time.Duration //文件封存后的保留时长，超出的文件会被定时清理
 	FilePrefix                 string
 	FileExtension              string
+	Checksum                   ChecksumType    //新文件中日志条目的校验算法，默认IEEE多项式的crc32
+	Compression                CompressionType //日志条目的压缩算法，默认不压缩
+	Encryptor                  *Encryptor      //日志条目的加密器，默认不加密
+	HashChain                  bool            //新文件中的日志条目是否带有哈希链，默认不带
+	Merkle                     bool            //文件封存时是否计算其默克尔根，默认不计算
+	Recovery                   RecoveryPolicy  //检测到损坏数据时的处理策略，默认TruncateTail
+	Archiver                   Archiver        //清理文件时先将其归档，默认直接删除
 }
 
 type Opt func(*Options)
@@ -76,6 +87,13 @@ func WithEntryLimitForPurge(l int) Opt {
 	}
 }
 
+//WithAgeLimitForPurge 文件封存超过age后被自动清理，除写入时检测外，后台每隔age/10(最长1分钟)检测一次，故没有写入时也会清理，封存时间的确定方式见PurgeWithMaxAge
+func WithAgeLimitForPurge(age time.Duration) Opt {
+	return func(o *Options) {
+		o.LogAgeLimitForPurge = age
+	}
+}
+
 func WithFilePrex(prex string) Opt {
 	return func(o *Options) {
 		o.FilePrefix = prex
@@ -100,14 +118,66 @@ func WithBufferSize(s int) Opt {
 	}
 }
 
+//WithChecksum 指定新文件中日志条目的校验算法，已有的文件沿用其段头中记录的算法
+func WithChecksum(ct ChecksumType) Opt {
+	return func(o *Options) {
+		o.Checksum = ct
+	}
+}
+
+//WithCompression 指定日志条目的压缩算法，过小或压缩后没有变小的条目不会被压缩，读取时自动解压
+func WithCompression(ct CompressionType) Opt {
+	return func(o *Options) {
+		o.Compression = ct
+	}
+}
+
+//WithEncryptor 指定日志条目的加密器，写入时使用其当前密钥加密，读取时根据条目中记录的密钥ID解密
+func WithEncryptor(e *Encryptor) Opt {
+	return func(o *Options) {
+		o.Encryptor = e
+	}
+}
+
+//WithHashChain 新文件中的日志条目带有链接上一个条目的哈希，文件的起点哈希由上一个文件传递，可通过VerifyChain校验日志是否被篡改
+func WithHashChain() Opt {
+	return func(o *Options) {
+		o.HashChain = true
+	}
+}
+
+//WithMerkle 文件写满切换时计算其日志条目的默克尔根，并写入与其同名的默克尔文件，可通过Proof生成条目的包含证明
+func WithMerkle() Opt {
+	return func(o *Options) {
+		o.Merkle = true
+	}
+}
+
+//WithRecoveryPolicy 指定检测到损坏数据时的处理策略，写入者打开最新文件时及reader加载已封存的文件时进行检测
+func WithRecoveryPolicy(p RecoveryPolicy) Opt {
+	return func(o *Options) {
+		o.Recovery = p
+	}
+}
+
+//WithArchiver 清理文件时(包括自动清理及TruncateFront)先通过a归档再删除，用于留存历史日志
+func WithArchiver(a Archiver) Opt {
+	return func(o *Options) {
+		o.Archiver = a
+	}
+}
+
 type PurgeOptions struct {
-	mode purgeMod
+	mode     purgeMod
+	archiver Archiver //本次清理使用的归档器，默认使用Options中配置的归档器
 	purgeLimit
 }
 type purgeLimit struct {
 	keepFiles int
 	// keepEntries     int
 	keepSoftEntries int
+	purgeBefore     uint64        //清理此索引之前的所有日志条目
+	maxAge          time.Duration //清理封存时间超过此时长的文件
 }
 
 type PurgeOpt func(*PurgeOptions)
@@ -124,6 +194,28 @@ func PurgeWithSoftEntries(c int) PurgeOpt {
 	}
 }
 
+//PurgeWithMaxAge 清理封存时间超过age的文件，文件的封存时间即下一个文件的创建时间，正在写入的文件不会被清理
+//下一个文件没有段头时使用文件自身的修改时间，存储后端无法提供修改时间时(如mem://)，之前进程中封存的老版本文件不会按时长清理
+func PurgeWithMaxAge(age time.Duration) PurgeOpt {
+	return func(po *PurgeOptions) {
+		po.maxAge = age
+	}
+}
+
+//PurgeBefore 清理index之前的日志条目，index所在的文件会被保留，起始索引会被精确的调整到index，有其他清理正在进行时等待其结束
+func PurgeBefore(index uint64) PurgeOpt {
+	return func(po *PurgeOptions) {
+		po.purgeBefore = index
+	}
+}
+
+//PurgeWithArchiver 清理的文件先通过a归档再删除
+func PurgeWithArchiver(a Archiver) PurgeOpt {
+	return func(po *PurgeOptions) {
+		po.archiver = a
+	}
+}
+
 func PurgeWithAsync() PurgeOpt {
 	return func(po *PurgeOptions) {
 		po.mode = purgeModAsync
@@ -9,8 +9,11 @@ package lws
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"syscall"
+	"time"
 )
 
 type writeNoticeType int8
@@ -21,7 +24,8 @@ const (
 )
 
 var (
-	purgeLocker = NewChansema(1)
+	purgeLocker        = NewChansema(1)
+	purgeCheckInterval = time.Minute //按时长清理的最长检测间隔
 )
 
 //chan实现的信号量
@@ -60,7 +64,7 @@ func (cs *Chansema) Release() {
 	<-cs.ch
 }
 
-//FileLock Used to exclusively lock a file
+//FileLock Used to exclusively or sharedly lock a file
 type FileLock struct {
 	path string
 	f    *os.File
@@ -74,21 +78,41 @@ func NewFileLocker(path string) *FileLock {
 
 //Lock non-block adding an exclusive lock to a file, if successfully return nil, otherwise return a error
 func (fl *FileLock) Lock() error {
-	f, err := os.Open(fl.path)
+	return fl.lock(syscall.LOCK_EX)
+}
+
+//RLock non-block adding a shared lock to a file, it can be held by several lockers but conflicts with the exclusive lock
+func (fl *FileLock) RLock() error {
+	return fl.lock(syscall.LOCK_SH)
+}
+
+//lock the file will be created if it does not exist; ErrLocked is returned if the lock is held by others
+func (fl *FileLock) lock(how int) error {
+	f, err := os.OpenFile(fl.path, os.O_RDONLY|os.O_CREATE, 0644)
 	if err != nil {
 		return err
 	}
-	fl.f = f
-	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	err = syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
 	if err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return fmt.Errorf("%w: %s", ErrLocked, fl.path)
+		}
 		return fmt.Errorf("cannot lock file %s - %s", fl.path, err)
 	}
+	fl.f = f
 	return nil
 }
 
-//Unlock release the exclusive lock
+//Unlock release the lock
 func (fl *FileLock) Unlock() error {
-	defer fl.f.Close()
+	if fl.f == nil {
+		return nil
+	}
+	defer func() {
+		fl.f.Close()
+		fl.f = nil
+	}()
 	return syscall.Flock(int(fl.f.Fd()), syscall.LOCK_UN)
 }
 
@@ -96,7 +120,8 @@ func (fl *FileLock) Unlock() error {
 //now has two kind of water level, one is files level, anther is log entey level
 type segmentWaterPool struct {
 	*rwlockSegmentGroup
-	lastIndex uint64
+	firstIndex uint64
+	lastIndex  uint64
 }
 
 //fileWaterLevel return the current level of file segment
@@ -124,11 +149,15 @@ func (pg *purgeGuarder) Release() {
 // purgeWorker represents a cleanup process who knows the clean up standard
 type purgeWorker struct {
 	purgeLimit
+	store    storage  //被清理的文件所在的存储
+	archiver Archiver //删除前归档文件，为nil时直接删除
 }
 
-func newPurgeWorker(limit purgeLimit) *purgeWorker {
+func newPurgeWorker(limit purgeLimit, store storage, archiver Archiver) *purgeWorker {
 	return &purgeWorker{
 		purgeLimit: limit,
+		store:      store,
+		archiver:   archiver,
 	}
 }
 
@@ -144,6 +173,16 @@ func (pw *purgeWorker) Guard() *purgeGuarder {
 	return nil
 }
 
+//Wait blocks until the resources are locked, used by the purge explicitly requested by the caller
+func (pw *purgeWorker) Wait() *purgeGuarder {
+	purgeLocker.Acquire(context.Background())
+	return &purgeGuarder{
+		fn: func() {
+			purgeLocker.Release()
+		},
+	}
+}
+
 //Probe detect if cleaning is required
 func (pw *purgeWorker) Probe(swp segmentWaterPool) bool {
 	return pw.purgeType(swp) != 0
@@ -159,22 +198,61 @@ func (pw *purgeWorker) Purge(swp segmentWaterPool, call func(*Segment)) error {
 		boundary, files = pw.pureOverEntryLevel(swp)
 	case 2: //type 2: file limit reached
 		boundary, files = pw.pureOverFilesLevel(swp)
+	case 3: //type 3: purge before the specified index
+		boundary, files = pw.pureBeforeIndex(swp)
+	case 4: //type 4: segments sealed longer than max age
+		boundary, files = pw.pureOverAge(swp)
 	}
 	//boundary no pure worker need to do
 	if boundary == nil {
 		return nil
 	}
+	//archive files first, nothing is deleted if any of them fails
+	if pw.archiver != nil {
+		for _, fn := range files {
+			if err := pw.archive(fn); err != nil {
+				return err
+			}
+		}
+	}
 	//delete files
 	for _, fn := range files {
-		os.Remove(fn)
+		pw.store.Remove(fn)
+		removeSidecars(pw.store, fn)
 	}
 	//call: invoke upper-level processing logic
 	call(boundary)
 	return nil
 }
 
-//purgeType return the pure type, 0: no purge worker, 1 log entry limit reached, 2 file limit reached
+//archive hand the whole content of the file and its sidecars to the archiver, so the archived segment can still be verified
+func (pw *purgeWorker) archive(path string) error {
+	if err := pw.archiveFile(path); err != nil {
+		return err
+	}
+	for _, ext := range sidecarExtensions {
+		//sidecars only exist for segments sealed with the feature enabled
+		if err := pw.archiveFile(sidecarPath(path, ext)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pw *purgeWorker) archiveFile(path string) error {
+	f, err := pw.store.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return pw.archiver.Archive(filepath.Base(path), io.NewSectionReader(f, 0, f.Size()))
+}
+
+//purgeType return the pure type, 0: no purge worker, 1 log entry limit reached, 2 file limit reached, 3 purge before the specified index, 4 max age reached
 func (pw *purgeWorker) purgeType(swp segmentWaterPool) int {
+	if pw.purgeBefore > swp.firstIndex {
+		return 3
+	}
 	trigger := pw.keepSoftEntries > 0 && swp.entryWaterLevel() > uint64(pw.keepSoftEntries)
 	if trigger {
 		return 1
@@ -183,6 +261,14 @@ func (pw *purgeWorker) purgeType(swp segmentWaterPool) int {
 	if trigger {
 		return 2
 	}
+	if pw.maxAge > 0 {
+		swp.RLock()
+		trigger = pw.sealedBefore(swp, 0, time.Now().Add(-pw.maxAge))
+		swp.RUnlock()
+		if trigger {
+			return 4
+		}
+	}
 	return 0
 }
 
@@ -228,3 +314,68 @@ func (pw *purgeWorker) pureOverEntryLevel(swp segmentWaterPool) (boundary *Segme
 	swp.RUnlock()
 	return
 }
+
+//pureBeforeIndex calculate boundary and filenames to clean based on the specified index, the boundary is the segment where the index is located
+func (pw *purgeWorker) pureBeforeIndex(swp segmentWaterPool) (boundary *Segment, files []string) {
+	swp.RLock()
+	swp.ForEach(func(i int, s *Segment) bool {
+		if i+1 < swp.Len() && swp.At(i+1).Index <= pw.purgeBefore {
+			files = append(files, s.Path)
+			return false
+		}
+		boundary = s
+		return true
+	})
+	swp.RUnlock()
+	return
+}
+
+//pureOverAge calculate boundary and filenames to clean based on the seal time of segments, the first segment not expired is the boundary
+func (pw *purgeWorker) pureOverAge(swp segmentWaterPool) (boundary *Segment, files []string) {
+	cutoff := time.Now().Add(-pw.maxAge)
+	swp.RLock()
+	swp.ForEach(func(i int, s *Segment) bool {
+		if pw.sealedBefore(swp, i, cutoff) {
+			files = append(files, s.Path)
+			return false
+		}
+		boundary = s
+		return true
+	})
+	swp.RUnlock()
+	return
+}
+
+//sealedBefore whether the i-th segment was sealed before cutoff, the caller must hold the read lock
+//a segment is sealed when the next one is created, so the create time in the next segment header is used if it was sealed by a previous process
+//the last segment is being written and is never opened, the seal time of the one before it is filled in by the snapshot
+//if neither is known, e.g. the next segment has no header, the modification time of the segment itself is used
+func (pw *purgeWorker) sealedBefore(swp segmentWaterPool, i int, cutoff time.Time) bool {
+	if i+1 >= swp.Len() {
+		return false
+	}
+	sealed := swp.At(i).Sealed
+	if sealed.IsZero() && i+2 < swp.Len() {
+		sealed = pw.createTime(swp.At(i + 1))
+	}
+	if sealed.IsZero() {
+		sealed = pw.store.ModTime(swp.At(i).Path)
+	}
+	return !sealed.IsZero() && sealed.Before(cutoff)
+}
+
+//createTime read the create time from the segment header, zero if the segment has no header
+func (pw *purgeWorker) createTime(s *Segment) time.Time {
+	f, err := pw.store.Open(s.Path)
+	if err != nil {
+		return time.Time{}
+	}
+	defer f.Close()
+	b := make([]byte, segmentHeaderSize)
+	n, _ := f.ReadAt(b, 0)
+	h, err := decodeSegmentHeader(b[:n])
+	if err != nil {
+		return time.Time{}
+	}
+	return h.CreateTime
+}
@@ -0,0 +1,223 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package lws
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+//RecoveryPolicy 检测到文件中有损坏的数据时的处理策略
+//写入者打开最新文件时及reader加载已封存的文件时进行检测，正在写入的文件尾部可能有未写完的条目，reader对其不做检测
+type RecoveryPolicy int
+
+const (
+	TruncateTail      RecoveryPolicy = iota //丢弃损坏处之后的数据，写入者会将其截断，默认策略
+	FailOnCorruption                        //返回CorruptionError，不做任何修改
+	SkipCorrupt                             //跳过长度可信且之后还有完整条目的损坏条目，其仍占用日志索引，读取时返回ErrCorruptEntry，无法跳过时按TruncateTail处理
+	QuarantineSegment                       //将文件拷贝到quarantine目录留存后，按TruncateTail处理
+)
+
+const quarantineDir = "quarantine"
+
+var (
+	ErrCorruption   = errors.New("log data is corrupted")
+	ErrCorruptEntry = errors.New("log entry is corrupted")
+)
+
+//RecoveryReport 对损坏数据的处理记录
+type RecoveryReport struct {
+	SegmentID  uint64
+	Path       string
+	Policy     RecoveryPolicy
+	Offset     int64  //第一处损坏在文件中的位置
+	Discarded  int64  //丢弃的文件尾部数据的字节数
+	Skipped    int    //SkipCorrupt策略下跳过的损坏条目数量
+	Quarantine string //QuarantineSegment策略下文件副本的路径
+}
+
+//CorruptionError FailOnCorruption策略下检测到损坏数据时返回的错误
+type CorruptionError struct {
+	Report RecoveryReport
+}
+
+func (ce *CorruptionError) Error() string {
+	return fmt.Sprintf("%s: segment %d at offset %d, %d bytes", ErrCorruption, ce.Report.SegmentID, ce.Report.Offset, ce.Report.Discarded)
+}
+
+func (ce *CorruptionError) Unwrap() error {
+	return ErrCorruption
+}
+
+//scanEntries 遍历文件中完整的日志条目，SkipCorrupt策略下跳过校验失败的条目并以corrupt标记回调
+//只有之后还有完整条目的损坏条目才会被跳过，尾部的损坏条目可能是未写完的条目，遍历终止于此
+//返回最后一个识别的条目之后的文件位置，及跳过的第一个条目的位置(没有则为-1)和跳过的数量
+func (sp *SegmentProcessor) scanEntries(from int, call func(*posEntry)) (end int, torn bool, first int, skipped int) {
+	var (
+		pending []*posEntry //等待后续完整条目确认的损坏条目
+		next    int
+	)
+	end, first = from, -1
+	emit := func(ue *posEntry) {
+		for _, pe := range pending {
+			if first < 0 {
+				first = pe.pos
+			}
+			skipped++
+			call(pe)
+		}
+		pending = pending[:0]
+		call(ue)
+	}
+	for {
+		if next, torn = sp.traverseValidEntries(from, emit); next > from {
+			end = next
+		}
+		if sp.pc.recovery != SkipCorrupt || torn {
+			return
+		}
+		//条目的长度超出文件范围时，无法定位下一个条目
+		le, err := sp.readLog(int64(next))
+		if err != nil || le == nil || le.Len < sp.summer.Size()+typeSize || int64(next+lenSize+le.Len) > sp.f.Size() {
+			return
+		}
+		pending = append(pending, &posEntry{
+			LogEntry: le,
+			pos:      next,
+			corrupt:  true,
+		})
+		from = next + lenSize + le.Len
+	}
+}
+
+//corruptExtent 返回from之后直至第一个全零区域之前最后一个非零字节的长度，为0表示from之后没有残留数据
+//写入者会将文件预分配扩展，残留数据之后都是零，只需扫描到第一个全零区域，打开文件的开销不随文件大小增长
+func (sp *SegmentProcessor) corruptExtent(from int) (int64, error) {
+	const chunk = 1 << 16 //全零区域的大小
+	var (
+		size = sp.f.Size()
+		last = int64(-1)
+	)
+	for pos := int64(from); pos < size; pos += chunk {
+		n := chunk
+		if size-pos < chunk {
+			n = int(size - pos)
+		}
+		b, err := sp.f.ReadRaw(pos, n)
+		if err != nil {
+			return 0, err
+		}
+		i := len(b) - 1
+		for i >= 0 && b[i] == 0 {
+			i--
+		}
+		if i < 0 {
+			break
+		}
+		last = pos + int64(i)
+	}
+	if last < 0 {
+		return 0, nil
+	}
+	return last + 1 - int64(from), nil
+}
+
+//recover 根据遍历的结果按照策略处理损坏的数据，没有损坏时返回nil
+func (sp *SegmentProcessor) recover(s *Segment, end, first, skipped int) (*RecoveryReport, error) {
+	discarded, err := sp.corruptExtent(end)
+	if err != nil {
+		return nil, err
+	}
+	if discarded == 0 && skipped == 0 {
+		return nil, nil
+	}
+	report := &RecoveryReport{
+		SegmentID: s.ID,
+		Path:      s.Path,
+		Policy:    sp.pc.recovery,
+		Offset:    int64(end),
+		Discarded: discarded,
+		Skipped:   skipped,
+	}
+	if first >= 0 {
+		report.Offset = int64(first)
+	}
+	switch sp.pc.recovery {
+	case FailOnCorruption:
+		return report, &CorruptionError{Report: *report}
+	case QuarantineSegment:
+		if sp.pc.writable {
+			report.Quarantine, err = quarantineSegment(storage{sp.pc.backend}, s.Path, int64(end)+discarded)
+		}
+	}
+	return report, err
+}
+
+//quarantineSegment 将文件前size个字节拷贝到日志目录下的quarantine目录中
+//写入者打开文件时可能已将其扩展到预分配的大小，故只拷贝有数据的部分
+func quarantineSegment(store storage, path string, size int64) (string, error) {
+	dst := quarantinePath(path)
+	if err := store.MkdirAll(filepath.Dir(dst)); err != nil {
+		return "", err
+	}
+	return dst, store.CopyFile(dst, path, size)
+}
+
+//Verify 从头遍历文件并校验所有日志条目，不使用偏移索引，也不修改文件
+//返回文件中损坏数据的记录，文件完整时返回nil
+func (sr *SegmentReader) Verify() (*RecoveryReport, error) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	end, _, first, skipped := sr.scanEntries(sr.base, func(*posEntry) {})
+	return sr.recover(sr.s, end, first, skipped)
+}
+
+/*
+ @title: MoveToQuarantine
+ @description: 将损坏的wal文件移动到日志目录下的quarantine目录中，并删除其附属文件，用于离线修复，通过ListSegments获取的段在其日志所在的存储后端上移动，其他段视为磁盘文件
+ @param {*Segment} s 损坏的文件的段信息
+ @return {string} 移动后的文件路径
+ @return {error} 错误信息
+*/
+func MoveToQuarantine(s *Segment) (string, error) {
+	var (
+		store = storage{s.backend}
+		dst   = quarantinePath(s.Path)
+	)
+	if s.backend == nil {
+		store.Backend = diskBackend{}
+	}
+	if err := store.MkdirAll(filepath.Dir(dst)); err != nil {
+		return "", err
+	}
+	if err := store.Rename(s.Path, dst); err != nil {
+		return "", err
+	}
+	return dst, removeSidecars(store, s.Path)
+}
+
+//quarantinePath 文件在quarantine目录中的路径，扩展名不会被wal文件的命名规则匹配到
+func quarantinePath(path string) string {
+	return sidecarPath(filepath.Join(filepath.Dir(path), quarantineDir, filepath.Base(path)), "corrupt")
+}
+
+//RecoveryReport 返回写入者打开文件时对损坏数据的处理记录，没有检测到损坏的数据时为nil
+func (sw *SegmentWriter) RecoveryReport() *RecoveryReport {
+	return sw.report
+}
+
+/*
+ @title: RecoveryReport
+ @description: 返回写入者打开最新文件时对损坏数据的处理记录，TruncateBack在边界文件上重新打开写入者时随之更新
+ @return {*RecoveryReport} 没有检测到损坏的数据时为nil
+*/
+func (l *Lws) RecoveryReport() *RecoveryReport {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.report
+}
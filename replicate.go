@@ -0,0 +1,634 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package lws
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+//日志复制协议，所有整数均为大端序
+//握手: 主节点先发送 challenge[16]，从节点发送 magic[4]|version[1]|next[8]|nameLen[2]|name|nonce[16]|mac[32]
+//主节点回复 status[1]|first[8]|last[8]|mac[32]，mac为以共享密钥计算的HMAC-SHA256，从节点的mac覆盖challenge及其之前的消息，主节点的mac覆盖nonce及回复
+//之后主节点从next开始推送条目 index[8]|typ[1]|len[4]|crc[4]|data，crc为crc32(IEEE)对crc之前的头部及数据的计算值
+//主节点截断尾部后推送typ为replicateTruncateType的条目，index为保留的最后一个条目的索引，从节点随之截断
+//从节点刷盘后回复确认 index[8]，表示index及之前的条目均已落盘
+const (
+	replicateMagic   uint32 = 0x4c575352 //"LWSR"
+	replicateVersion uint8  = 1
+
+	replicateOK           uint8 = 0 //握手成功，开始推送
+	replicateCompacted    uint8 = 1 //从节点需要的条目已被主节点清理
+	replicateAhead        uint8 = 2 //从节点的日志比主节点新
+	replicateUnauthorized uint8 = 3 //从节点没有通过认证
+
+	replicateTruncateType int8 = -1 //截断消息的条目类型，日志条目不会使用负数类型
+
+	recordHeadSize = 8 + 1 + 4 + 4
+	maxRecordSize  = 1 << 30
+	nonceSize      = 16
+	macSize        = sha256.Size
+
+	defaultRetryInterval = time.Second
+	defaultDialTimeout   = 5 * time.Second
+	handshakeTimeout     = 5 * time.Second
+)
+
+var (
+	ErrReplicaAhead    = errors.New("follower log is ahead of the leader")
+	ErrReplicaChecksum = errors.New("replicated record checksum mismatch")
+	ErrReplicaProtocol = errors.New("invalid replication message")
+	ErrReplicaAuth     = errors.New("replication peer authentication failed")
+	ErrReplicaInsecure = errors.New("replication requires a TLS config or a shared secret")
+)
+
+type replicateOptions struct {
+	tlsConfig *tls.Config //监听使用的TLS配置
+	secret    []byte      //与从节点共享的密钥，握手时双向认证
+}
+
+type ReplicateOpt func(*replicateOptions)
+
+//ReplicateWithTLS 通过TLS加密推送的日志条目，需要认证从节点时在cfg中设置ClientAuth
+func ReplicateWithTLS(cfg *tls.Config) ReplicateOpt {
+	return func(ro *replicateOptions) {
+		ro.tlsConfig = cfg
+	}
+}
+
+//ReplicateWithSecret 握手时通过共享密钥与从节点双向认证，不加密传输的数据，跨越不可信网络时应同时使用TLS
+func ReplicateWithSecret(secret []byte) ReplicateOpt {
+	return func(ro *replicateOptions) {
+		ro.secret = secret
+	}
+}
+
+//Replicator 日志复制的主节点，监听tcp地址，将已刷盘的日志条目推送给连接的从节点
+type Replicator struct {
+	wal     *Lws
+	ln      net.Listener
+	opts    replicateOptions
+	mu      sync.Mutex
+	acked   map[string]uint64 //从节点确认落盘的索引，以从节点名称为键
+	wg      sync.WaitGroup
+	closeCh chan struct{}
+	once    sync.Once
+}
+
+/*
+ @title: NewReplicator
+ @description: 在addr上监听从节点的连接，并将日志推送给从节点，只推送已刷盘的条目，故从节点不会比主节点新，推送的是解密及解压后的条目，故必须指定TLS配置或共享密钥
+ @param {string} addr 监听地址，格式为host:port或tcp://host:port，端口为0时随机选择
+ @param {...ReplicateOpt} opt 主节点的参数配置，包括TLS配置及共享密钥
+ @return {*Replicator} 复制主节点，lws关闭时停止推送
+ @return {error} 两者都没有指定时返回ErrReplicaInsecure
+*/
+func (l *Lws) NewReplicator(addr string, opt ...ReplicateOpt) (*Replicator, error) {
+	if l.readOnly {
+		return nil, ErrReadOnly
+	}
+	var opts replicateOptions
+	for _, o := range opt {
+		o(&opts)
+	}
+	if opts.tlsConfig == nil && len(opts.secret) == 0 {
+		return nil, ErrReplicaInsecure
+	}
+	ln, err := net.Listen("tcp", trimTCPSchema(addr))
+	if err != nil {
+		return nil, err
+	}
+	if opts.tlsConfig != nil {
+		ln = tls.NewListener(ln, opts.tlsConfig)
+	}
+	r := &Replicator{
+		wal:     l,
+		ln:      ln,
+		opts:    opts,
+		acked:   make(map[string]uint64),
+		closeCh: make(chan struct{}),
+	}
+	r.wg.Add(1)
+	go r.accept()
+	go func() {
+		select {
+		case <-r.closeCh:
+		case <-l.closeCh:
+		}
+		ln.Close()
+	}()
+	return r, nil
+}
+
+//Addr 返回监听的地址
+func (r *Replicator) Addr() net.Addr {
+	return r.ln.Addr()
+}
+
+//AckedIndex 返回从节点确认落盘的最新索引，从节点未连接过时返回0
+func (r *Replicator) AckedIndex(name string) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.acked[name]
+}
+
+//Close 停止监听并断开所有从节点的连接
+func (r *Replicator) Close() error {
+	r.once.Do(func() {
+		close(r.closeCh)
+	})
+	r.wg.Wait()
+	return nil
+}
+
+func (r *Replicator) accept() {
+	defer r.wg.Done()
+	for {
+		conn, err := r.ln.Accept()
+		if err != nil {
+			return
+		}
+		r.wg.Add(1)
+		go r.serve(conn)
+	}
+}
+
+func (r *Replicator) setAcked(name string, index uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.acked[name] = index
+}
+
+//truncateAcked 主节点截断尾部后，从节点确认的索引不超过保留的最后一个条目
+func (r *Replicator) truncateAcked(name string, index uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.acked[name] > index {
+		r.acked[name] = index
+	}
+}
+
+//serve 与一个从节点握手后从其请求的索引开始推送，连接出错或lws关闭时结束，从节点重连后重新握手
+//已推送的条目被TruncateBack删除时通知从节点截断，之后从截断处继续推送
+func (r *Replicator) serve(conn net.Conn) {
+	defer r.wg.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.closeCh:
+		case <-ctx.Done():
+		}
+		conn.Close()
+	}()
+	//握手完成前限制时长，防止未认证的连接长期占用
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	challenge, err := writeChallenge(conn)
+	if err != nil {
+		return
+	}
+	name, next, nonce, err := readHandshake(conn, r.opts.secret, challenge)
+	if errors.Is(err, ErrReplicaAuth) {
+		writeHandshakeReply(conn, r.opts.secret, nonce, replicateUnauthorized, 0, 0)
+		return
+	}
+	if err != nil {
+		return
+	}
+	status := replicateOK
+	ti, err := r.wal.NewTailIterator(next, TailWithFlushed())
+	if errors.Is(err, ErrCompacted) {
+		status = replicateCompacted
+	} else if err != nil {
+		status = replicateAhead
+	}
+	if err = writeHandshakeReply(conn, r.opts.secret, nonce, status, r.wal.FirstIndex(), r.wal.LastIndex()); err != nil || ti == nil {
+		return
+	}
+	defer ti.Release()
+	conn.SetDeadline(time.Time{})
+	r.setAcked(name, next-1)
+	go func() {
+		//连接断开时读取失败，取消等待新条目
+		defer cancel()
+		var b [8]byte
+		for {
+			if _, err := io.ReadFull(conn, b[:]); err != nil {
+				return
+			}
+			r.setAcked(name, binary.BigEndian.Uint64(b[:]))
+		}
+	}()
+	w := bufio.NewWriter(conn)
+	for {
+		//没有可以立即推送的条目时，将缓存的条目发送出去再等待
+		if !ti.HasNext() && w.Flush() != nil {
+			return
+		}
+		ele, err := ti.NextWait(ctx)
+		if errors.Is(err, ErrTruncated) {
+			//迭代器已回退到保留的最后一个条目
+			r.truncateAcked(name, ti.index)
+			if err = writeRecord(w, ti.index, replicateTruncateType, nil); err != nil {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			return
+		}
+		le, err := ele.GetEntry()
+		if err != nil {
+			return
+		}
+		if err = writeRecord(w, ele.Index(), le.Typ, le.Data); err != nil {
+			return
+		}
+	}
+}
+
+type followOptions struct {
+	name          string        //从节点名称，主节点据此记录确认的索引
+	retryInterval time.Duration //连接断开后重连的间隔
+	tlsConfig     *tls.Config   //连接主节点使用的TLS配置
+	secret        []byte        //与主节点共享的密钥
+}
+
+type FollowOpt func(*followOptions)
+
+//FollowWithName 指定从节点的名称，默认为日志的路径
+func FollowWithName(name string) FollowOpt {
+	return func(fo *followOptions) {
+		fo.name = name
+	}
+}
+
+//FollowWithRetryInterval 指定连接断开后重连的间隔，默认为1秒
+func FollowWithRetryInterval(d time.Duration) FollowOpt {
+	return func(fo *followOptions) {
+		fo.retryInterval = d
+	}
+}
+
+//FollowWithTLS 通过TLS连接主节点，cfg中需要能够校验主节点的证书
+func FollowWithTLS(cfg *tls.Config) FollowOpt {
+	return func(fo *followOptions) {
+		fo.tlsConfig = cfg
+	}
+}
+
+//FollowWithSecret 握手时通过共享密钥与主节点双向认证，需与主节点的ReplicateWithSecret一致
+func FollowWithSecret(secret []byte) FollowOpt {
+	return func(fo *followOptions) {
+		fo.secret = secret
+	}
+}
+
+//Follower 日志复制的从节点，将主节点推送的条目追加写入本地日志，断开后从本地最新索引+1处重新握手
+type Follower struct {
+	wal     *Lws
+	addr    string
+	opts    followOptions
+	mu      sync.Mutex
+	conn    net.Conn
+	err     error
+	closeCh chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+/*
+ @title: Follow
+ @description: 作为从节点连接addr上的主节点，持续复制其日志，本地日志不应再由其他途径写入，关闭lws前应先关闭Follower
+ @param {string} addr 主节点地址，格式为host:port或tcp://host:port
+ @param {...FollowOpt} opt 从节点的参数配置，包括名称、重连间隔、TLS配置及共享密钥，后两者至少指定一个
+ @return {*Follower} 复制从节点
+ @return {error} 只读模式下返回ErrReadOnly，没有指定TLS配置及共享密钥时返回ErrReplicaInsecure
+*/
+func (l *Lws) Follow(addr string, opt ...FollowOpt) (*Follower, error) {
+	if l.readOnly {
+		return nil, ErrReadOnly
+	}
+	f := &Follower{
+		wal:  l,
+		addr: trimTCPSchema(addr),
+		opts: followOptions{
+			name:          l.path,
+			retryInterval: defaultRetryInterval,
+		},
+		closeCh: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for _, o := range opt {
+		o(&f.opts)
+	}
+	if f.opts.tlsConfig == nil && len(f.opts.secret) == 0 {
+		return nil, ErrReplicaInsecure
+	}
+	go f.run()
+	return f, nil
+}
+
+//Err 返回导致复制终止的错误，如主节点已清理所需的条目(ErrCompacted)、本地日志比主节点新(ErrReplicaAhead)或认证失败(ErrReplicaAuth)
+//网络错误及校验失败会重连，不会终止复制
+func (f *Follower) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+//Done 返回复制终止时被关闭的通道
+func (f *Follower) Done() <-chan struct{} {
+	return f.done
+}
+
+//Close 断开与主节点的连接并停止复制
+func (f *Follower) Close() error {
+	f.once.Do(func() {
+		f.mu.Lock()
+		close(f.closeCh)
+		if f.conn != nil {
+			f.conn.Close()
+		}
+		f.mu.Unlock()
+	})
+	<-f.done
+	return nil
+}
+
+func (f *Follower) run() {
+	defer close(f.done)
+	for {
+		fatal, err := f.follow()
+		if fatal {
+			f.mu.Lock()
+			f.err = err
+			f.mu.Unlock()
+			return
+		}
+		select {
+		case <-f.closeCh:
+			return
+		case <-f.wal.closeCh:
+			return
+		case <-time.After(f.opts.retryInterval):
+		}
+	}
+}
+
+//setConn 记录当前的连接以便Close将其断开，已关闭时返回false
+func (f *Follower) setConn(conn net.Conn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	select {
+	case <-f.closeCh:
+		return false
+	default:
+	}
+	f.conn = conn
+	return true
+}
+
+//follow 建立一次连接并复制直至连接断开，返回的fatal表示错误无法通过重连恢复
+func (f *Follower) follow() (fatal bool, err error) {
+	conn, err := f.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if !f.setConn(conn) {
+		return false, nil
+	}
+	defer f.setConn(nil)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		//本地lws关闭时断开连接，结束阻塞的读取
+		select {
+		case <-f.wal.closeCh:
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	r := bufio.NewReader(conn)
+	challenge := make([]byte, nonceSize)
+	if _, err = io.ReadFull(r, challenge); err != nil {
+		return false, err
+	}
+	nonce, err := writeHandshake(conn, f.opts.secret, challenge, f.opts.name, f.wal.LastIndex()+1)
+	if err != nil {
+		return false, err
+	}
+	status, err := readHandshakeReply(r, f.opts.secret, nonce)
+	if errors.Is(err, ErrReplicaAuth) {
+		return true, err
+	}
+	if err != nil {
+		return false, err
+	}
+	switch status {
+	case replicateOK:
+	case replicateCompacted:
+		return true, ErrCompacted
+	case replicateAhead:
+		return true, ErrReplicaAhead
+	case replicateUnauthorized:
+		return true, ErrReplicaAuth
+	default:
+		return false, ErrReplicaProtocol
+	}
+	conn.SetDeadline(time.Time{})
+	var ack [8]byte
+	for {
+		index, typ, data, err := readRecord(r)
+		if err != nil {
+			return false, err
+		}
+		if typ == replicateTruncateType {
+			//主节点截断了尾部，丢弃已复制的被截断条目，之后从截断处继续复制
+			if index < f.wal.LastIndex() {
+				if err = f.wal.TruncateBack(index); err != nil {
+					return true, err
+				}
+			}
+		} else {
+			if last := f.wal.LastIndex(); index != last+1 {
+				return false, fmt.Errorf("%w: index %d does not follow %d", ErrReplicaProtocol, index, last)
+			}
+			if _, err = f.wal.WriteEntry(typ, data); err != nil {
+				return true, err
+			}
+		}
+		//已收到的条目处理完毕后再刷盘并确认，减少刷盘次数
+		if r.Buffered() > 0 {
+			continue
+		}
+		if err = f.wal.Flush(); err != nil {
+			return true, err
+		}
+		binary.BigEndian.PutUint64(ack[:], f.wal.LastIndex())
+		if _, err = conn.Write(ack[:]); err != nil {
+			return false, err
+		}
+	}
+}
+
+//dial 连接主节点，指定了TLS配置时进行TLS握手
+func (f *Follower) dial() (net.Conn, error) {
+	d := &net.Dialer{
+		Timeout: defaultDialTimeout,
+	}
+	if f.opts.tlsConfig != nil {
+		return tls.DialWithDialer(d, "tcp", f.addr, f.opts.tlsConfig)
+	}
+	return d.Dial("tcp", f.addr)
+}
+
+func trimTCPSchema(addr string) string {
+	if i := strings.Index(addr, "://"); i >= 0 && strings.EqualFold(addr[:i], "tcp") {
+		return addr[i+3:]
+	}
+	return addr
+}
+
+//replicaMAC 以共享密钥计算parts的HMAC-SHA256，没有共享密钥时对端不进行校验
+func replicaMAC(secret []byte, parts ...[]byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func newNonce() ([]byte, error) {
+	b := make([]byte, nonceSize)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+//writeChallenge 主节点发送随机的challenge，从节点的认证码需覆盖此值以防止重放
+func writeChallenge(w io.Writer) ([]byte, error) {
+	challenge, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(challenge)
+	return challenge, err
+}
+
+//writeHandshake 发送从节点的握手消息，返回其中的nonce，主节点的回复需对其计算认证码
+func writeHandshake(w io.Writer, secret, challenge []byte, name string, next uint64) ([]byte, error) {
+	if len(name) > 0xffff {
+		name = name[:0xffff]
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 4+1+8+2+len(name), 4+1+8+2+len(name)+nonceSize+macSize)
+	binary.BigEndian.PutUint32(b, replicateMagic)
+	b[4] = replicateVersion
+	binary.BigEndian.PutUint64(b[5:], next)
+	binary.BigEndian.PutUint16(b[13:], uint16(len(name)))
+	copy(b[15:], name)
+	b = append(b, nonce...)
+	b = append(b, replicaMAC(secret, challenge, b)...)
+	_, err = w.Write(b)
+	return nonce, err
+}
+
+//readHandshake 读取从节点的握手消息，主节点设置了共享密钥时校验其认证码，校验失败返回ErrReplicaAuth
+func readHandshake(r io.Reader, secret, challenge []byte) (name string, next uint64, nonce []byte, err error) {
+	var b [15]byte
+	if _, err = io.ReadFull(r, b[:]); err != nil {
+		return
+	}
+	if binary.BigEndian.Uint32(b[:]) != replicateMagic || b[4] != replicateVersion {
+		return "", 0, nil, ErrReplicaProtocol
+	}
+	rest := make([]byte, int(binary.BigEndian.Uint16(b[13:]))+nonceSize+macSize)
+	if _, err = io.ReadFull(r, rest); err != nil {
+		return
+	}
+	msg := append(b[:], rest[:len(rest)-macSize]...)
+	nonce = rest[len(rest)-macSize-nonceSize : len(rest)-macSize]
+	if len(secret) > 0 && !hmac.Equal(rest[len(rest)-macSize:], replicaMAC(secret, challenge, msg)) {
+		return "", 0, nonce, ErrReplicaAuth
+	}
+	return string(rest[:len(rest)-macSize-nonceSize]), binary.BigEndian.Uint64(b[5:]), nonce, nil
+}
+
+func writeHandshakeReply(w io.Writer, secret, nonce []byte, status uint8, first, last uint64) error {
+	var b [17 + macSize]byte
+	b[0] = status
+	binary.BigEndian.PutUint64(b[1:], first)
+	binary.BigEndian.PutUint64(b[9:], last)
+	copy(b[17:], replicaMAC(secret, nonce, b[:17]))
+	_, err := w.Write(b[:])
+	return err
+}
+
+//readHandshakeReply 读取主节点的回复，从节点设置了共享密钥时校验其认证码，校验失败返回ErrReplicaAuth
+func readHandshakeReply(r io.Reader, secret, nonce []byte) (uint8, error) {
+	var b [17 + macSize]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	if len(secret) > 0 && !hmac.Equal(b[17:], replicaMAC(secret, nonce, b[:17])) {
+		return 0, ErrReplicaAuth
+	}
+	return b[0], nil
+}
+
+func writeRecord(w io.Writer, index uint64, typ int8, data []byte) error {
+	var head [recordHeadSize]byte
+	binary.BigEndian.PutUint64(head[:], index)
+	head[8] = byte(typ)
+	binary.BigEndian.PutUint32(head[9:], uint32(len(data)))
+	crc := crc32.Update(crc32.ChecksumIEEE(head[:13]), crc32.IEEETable, data)
+	binary.BigEndian.PutUint32(head[13:], crc)
+	if _, err := w.Write(head[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readRecord(r io.Reader) (index uint64, typ int8, data []byte, err error) {
+	var head [recordHeadSize]byte
+	if _, err = io.ReadFull(r, head[:]); err != nil {
+		return
+	}
+	n := binary.BigEndian.Uint32(head[9:])
+	if n > maxRecordSize {
+		return 0, 0, nil, ErrReplicaProtocol
+	}
+	data = make([]byte, n)
+	if _, err = io.ReadFull(r, data); err != nil {
+		return
+	}
+	if crc32.Update(crc32.ChecksumIEEE(head[:13]), crc32.IEEETable, data) != binary.BigEndian.Uint32(head[13:]) {
+		return 0, 0, nil, ErrReplicaChecksum
+	}
+	return binary.BigEndian.Uint64(head[:]), int8(head[8]), data, nil
+}
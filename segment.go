@@ -16,14 +16,15 @@ import (
 )
 
 const (
-	checkSumPoly  = crc32.IEEE
 	bufferSize    = 1 << 27
 	maxBufferSize = 1 << 29
 
 	lenSize   = 4
 	crc32Size = 4
 	typeSize  = 1
-	metaSize  = lenSize + crc32Size + typeSize
+
+	batchHeaderType int8 = -1 //批量头条目的类型，数据为批量中条目的数量，其不占用日志索引
+	batchHeaderSize      = 4
 )
 
 var (
@@ -33,21 +34,27 @@ var (
 
 type posEntry struct {
 	*LogEntry
-	pos int
+	pos     int
+	batch   *posEntry //条目所属批量的批量头，不属于批量则为nil
+	corrupt bool      //SkipCorrupt策略下跳过的损坏条目
 }
 
 type LogEntry struct {
-	Len   int //crc32 + typ + data总长度
-	Crc32 uint32
-	Typ   int8
-	Data  []byte
+	Len    int    //checksum + typ + data总长度
+	Sum    uint64 //校验值，在条目中的长度由段的校验算法决定
+	Typ    int8
+	Data   []byte
+	record []byte //文件中记录的 typ|data，用于计算校验值
 }
 
 type Segment struct {
-	ID    uint64 //文件编号
-	Size  int64  //文件当前大小
-	Index uint64 //文件中日志的最小索引
-	Path  string //文件路径
+	ID     uint64    //文件编号
+	Size   int64     //文件当前大小
+	Index  uint64    //文件中日志的最小索引
+	Path   string    //文件路径
+	Sealed time.Time //本进程中封存的时间，未封存或在之前的进程中封存时为零值
+
+	backend Backend //ListSegments返回的段所在的存储后端，为nil时文件位于磁盘
 }
 
 type crc32Ctor struct {
@@ -55,8 +62,12 @@ type crc32Ctor struct {
 	table *crc32.Table
 }
 
-func (crc *crc32Ctor) Checksum(data []byte) uint32 {
-	return crc32.Checksum(data, crc.table)
+func (crc *crc32Ctor) Size() int {
+	return crc32Size
+}
+
+func (crc *crc32Ctor) Sum(data []byte) uint64 {
+	return uint64(crc32.Checksum(data, crc.table))
 }
 
 func newCrc32er(poly uint32) *crc32Ctor {
@@ -73,8 +84,16 @@ type SegmentWriter struct {
 	wf          WriteFlag //刷盘策略
 	threshold   int
 	acc         int //等待刷盘的累计值
+	flushed     int //已经刷盘的条目数量
+	onFlush     func()
 	segmentSize int
-	count       int //写入条目的数量
+	count       int             //写入条目的数量
+	pos         []int           //每个条目在文件中的位置，文件封存时写入偏移索引
+	corrupt     int             //文件中跳过的损坏条目数量，有损坏条目的文件封存时不写入偏移索引
+	report      *RecoveryReport //打开文件时对损坏数据的处理记录
+	merkle      bool            //是否随写入累计日志条目的默克尔叶子哈希
+	leaves      [][]byte        //每个条目的默克尔叶子哈希，文件封存时据此生成默克尔根
+	leafErr     error           //打开文件时还原已有条目失败的错误，封存时返回
 	closeCh     chan struct{}
 	writeLocker sync.Mutex //非同步写情况下，可能会导致并发写相同数据
 }
@@ -86,6 +105,14 @@ type WriterOptions struct {
 	Fv          int
 	MapLock     bool
 	BufferSize  int
+	OnFlush     func()          //刷盘成功后的回调
+	Checksum    ChecksumType    //新文件使用的校验算法，已有的文件沿用段头中记录的算法
+	Compression CompressionType //日志条目的压缩算法
+	Encryptor   *Encryptor      //日志条目的加密器
+	HashChain   bool            //新文件中的日志条目是否带有哈希链，已有的文件沿用段头中的记录
+	Recovery    RecoveryPolicy  //打开文件时检测到损坏数据的处理策略
+	Backend     Backend         //文件所在的存储后端，为nil时根据Ft选择
+	Merkle      bool            //是否随写入累计日志条目的默克尔叶子哈希
 }
 
 func NewSegmentWriter(s *Segment, opt WriterOptions) (*SegmentWriter, error) {
@@ -95,23 +122,33 @@ func NewSegmentWriter(s *Segment, opt WriterOptions) (*SegmentWriter, error) {
 			mapLock:     opt.MapLock,
 			bufferSize:  opt.BufferSize,
 			ft:          opt.Ft,
+			writable:    true,
+			checksum:    opt.Checksum,
+			compression: opt.Compression,
+			encryptor:   opt.Encryptor,
+			hashChain:   opt.HashChain,
+			recovery:    opt.Recovery,
+			backend:     opt.Backend,
 		}),
 		s:           s,
 		ft:          opt.Ft,
 		wf:          opt.Wf,
 		segmentSize: int(opt.SegmentSize),
 		threshold:   opt.Fv,
+		onFlush:     opt.OnFlush,
+		merkle:      opt.Merkle,
 		closeCh:     make(chan struct{}),
 	}
 	//打开写入的目标文件
 	if err := sw.open(s); err != nil {
 		return nil, err
 	}
-	//遍历文件的所有log entry并检测其完整性
+	//遍历文件的所有log entry并检测其完整性，出错时不调整文件大小，保持文件原有的数据
 	if err := sw.readAndCheck(); err != nil {
-		sw.Close()
+		sw.SegmentProcessor.Close()
 		return nil, err
 	}
+	sw.flushed = sw.count //文件中已有的条目视为已刷盘
 	//如果配置定时刷盘策略，则开启后台刷盘任务
 	sw.startFlushWorker()
 	return sw, nil
@@ -119,18 +156,50 @@ func NewSegmentWriter(s *Segment, opt WriterOptions) (*SegmentWriter, error) {
 
 func (sw *SegmentWriter) readAndCheck() (err error) {
 	//遍历文件中所有的日志条目，如果遍历到文件末尾或者检测到日志损坏，则终止遍历，并从最新的完整条目处开始写日志
-	sw.traverseLogEntries(func(ue *posEntry) bool {
-		if ue.LogEntry == nil || ue.Len == 0 || !sw.crc32Check(ue.Crc32, ue.Data) {
-			// sw.f.Truncate(int64(ue.pos))
-			sw.f.Seek(int64(ue.pos), io.SeekStart)
-			return true
-		}
+	end, _, first, skipped := sw.scanEntries(sw.base, func(ue *posEntry) {
 		sw.count++
-		return false
+		sw.pos = append(sw.pos, ue.pos)
+		if sw.merkle {
+			sw.restoreLeaf(ue)
+		}
+		if ue.corrupt {
+			sw.corrupt++
+			return
+		}
+		sw.f.chain.advance(ue.Typ, ue.Data) //哈希链推进到最新的完整条目
 	})
+	//根据策略处理损坏的数据，FailOnCorruption策略下不做任何修改，只将预分配扩展的文件恢复到数据的大小
+	if sw.report, err = sw.recover(sw.s, end, first, skipped); err != nil {
+		if sw.report != nil {
+			sw.f.Truncate(int64(end) + sw.report.Discarded)
+		}
+		return
+	}
+	//损坏处或不完整的批量残留的数据需截断，防止后续写入覆盖部分数据后，残留的条目被再次识别
+	if sw.report != nil && sw.report.Discarded > 0 {
+		if err = sw.f.Truncate(int64(end)); err != nil {
+			return
+		}
+	}
+	_, err = sw.f.Seek(int64(end), io.SeekStart)
 	return
 }
 
+//restoreLeaf 计算文件中已有条目的叶子哈希，叶子针对还原后的原始数据，损坏的条目使用其记录的数据以保持叶子与索引对应
+func (sw *SegmentWriter) restoreLeaf(ue *posEntry) {
+	le := ue.LogEntry
+	if !ue.corrupt {
+		var err error
+		if le, err = sw.f.restoreRecord(ue.LogEntry); err != nil {
+			if sw.leafErr == nil {
+				sw.leafErr = err
+			}
+			le = ue.LogEntry
+		}
+	}
+	sw.leaves = append(sw.leaves, merkleLeaf(le.Typ, le.Data))
+}
+
 func (sw *SegmentWriter) startFlushWorker() {
 	if sw.wf&(^WF_SYNCWRITE) == WF_TIMEDFLUSH {
 		go sw.flushTimeDelay()
@@ -147,10 +216,9 @@ func (sw *SegmentWriter) flushTimeDelay() {
 	for {
 		select {
 		case <-timer.C:
-			if sw.acc == 0 {
-				continue
+			if sw.acc != 0 {
+				sw.Flush()
 			}
-			sw.Flush()
 			timer.Reset(t)
 		case <-sw.closeCh:
 			return
@@ -176,16 +244,31 @@ func (sw *SegmentWriter) Replace(s *Segment) error {
 	if err := sw.open(s); err != nil {
 		return err
 	}
+	sw.writeLocker.Lock()
 	sw.s = s
 	sw.count = 0
+	sw.pos = nil
+	sw.leaves, sw.leafErr = nil, nil
+	sw.corrupt = 0
+	sw.flushed = 0
+	sw.writeLocker.Unlock()
 	return nil
 }
 
+//FlushedIndex 返回已经刷盘的最新条目的索引，切换文件时会将老文件刷盘，故之前文件中的条目都已刷盘
+func (sw *SegmentWriter) FlushedIndex() uint64 {
+	sw.writeLocker.Lock()
+	defer sw.writeLocker.Unlock()
+	return sw.s.Index + uint64(sw.flushed) - 1
+}
+
 func (sw *SegmentWriter) Write(t int8, data []byte) (int, error) {
 	sw.writeLocker.Lock()
+	mark := sw.f.chain.mark()
 	l, err := sw.writeToBuffer(t, data) //蒋日志写入缓存中，如果写入失败，则回退写入游标，以防止用户重试时数据出现错乱
 	if err != nil {
 		sw.f.Seek(int64(-l), io.SeekCurrent)
+		sw.discard(sw.count - 1)
 		sw.writeLocker.Unlock()
 		return 0, err
 	}
@@ -193,6 +276,8 @@ func (sw *SegmentWriter) Write(t int8, data []byte) (int, error) {
 	if sw.wf&WF_SYNCWRITE == WF_SYNCWRITE {
 		if err := sw.f.WriteBack(); err != nil {
 			sw.f.Seek(int64(-l), io.SeekCurrent)
+			sw.discard(sw.count - 1)
+			sw.f.chain.reset(mark)
 			sw.writeLocker.Unlock()
 			return 0, err
 		}
@@ -203,11 +288,58 @@ func (sw *SegmentWriter) Write(t int8, data []byte) (int, error) {
 	return len(data), err
 }
 
+//WriteBatch 将多条日志作为一个整体连续写入，写入前会先写入记录条目数量的批量头，恢复时只有整批完整才会被认可
+//写入失败则回退写入游标至批量起始处，整批写入后只进行一次刷盘检测
+func (sw *SegmentWriter) WriteBatch(entries []*LogEntry) (int, error) {
+	sw.writeLocker.Lock()
+	var (
+		start, _ = sw.f.Seek(0, io.SeekCurrent)
+		count    = sw.count
+		mark     = sw.f.chain.mark()
+		header   = make([]byte, batchHeaderSize)
+		n        int
+	)
+	serializateUint32(header, uint32(len(entries)))
+	_, err := sw.writeLog(batchHeaderType, header)
+	for i := 0; err == nil && i < len(entries); i++ {
+		_, err = sw.writeToBuffer(entries[i].Typ, entries[i].Data)
+		n += len(entries[i].Data)
+	}
+	if err == nil && sw.wf&WF_SYNCWRITE == WF_SYNCWRITE {
+		err = sw.f.WriteBack()
+	}
+	if err != nil {
+		sw.f.Seek(start, io.SeekStart)
+		sw.discard(count)
+		sw.f.chain.reset(mark)
+		sw.writeLocker.Unlock()
+		return 0, err
+	}
+	sw.acc += len(entries)
+	sw.writeLocker.Unlock()
+	sw.tryFlush()
+	return n, nil
+}
+
 func (sw *SegmentWriter) writeToBuffer(t int8, data []byte) (int, error) {
+	pos, _ := sw.f.Seek(0, io.SeekCurrent)
 	sw.count++
+	sw.pos = append(sw.pos, int(pos))
+	if sw.merkle {
+		sw.leaves = append(sw.leaves, merkleLeaf(t, data))
+	}
 	return sw.writeLog(t, data)
 }
 
+//discard 写入失败时丢弃第n个之后的条目记录
+func (sw *SegmentWriter) discard(n int) {
+	sw.count = n
+	sw.pos = sw.pos[:n]
+	if sw.merkle {
+		sw.leaves = sw.leaves[:n]
+	}
+}
+
 func (sw *SegmentWriter) tryFlush() error {
 	if sw.wf&WF_SYNCFLUSH == WF_SYNCFLUSH {
 		return sw.Flush()
@@ -219,6 +351,67 @@ func (sw *SegmentWriter) tryFlush() error {
 	return nil
 }
 
+//TruncateEntries 保留文件中前n个日志条目，并将之后的数据截断，如果截断处位于批量中，则重写批量头中的条目数，以保证保留的条目在恢复时仍然完整
+func (sw *SegmentWriter) TruncateEntries(n int) error {
+	if n < 0 || n >= sw.count {
+		return nil
+	}
+	//先将缓存中的数据全部回写，防止截断后回写的脏数据再次扩展文件
+	if err := sw.Flush(); err != nil {
+		return err
+	}
+	sw.writeLocker.Lock()
+	defer sw.writeLocker.Unlock()
+	var (
+		cut    int       //截断的文件位置
+		header *posEntry //截断处所在批量的批量头
+		kept   uint32    //截断处所在批量中保留的条目数
+		batch  *posEntry
+		run    uint32 //当前批量中已遍历的条目数
+		i      int
+	)
+	if sw.header != nil {
+		sw.f.chain.reset(sw.header.PrevHash)
+	}
+	sw.traverseValidEntries(sw.base, func(ue *posEntry) {
+		if i < n {
+			sw.f.chain.advance(ue.Typ, ue.Data) //哈希链回退到保留的最后一个条目
+		}
+		if ue.batch != batch {
+			batch, run = ue.batch, 0
+		}
+		if i == n {
+			cut, header, kept = ue.pos, ue.batch, run
+		}
+		run++
+		i++
+	})
+	if header != nil {
+		if kept == 0 {
+			cut = header.pos
+		} else {
+			buf := make([]byte, batchHeaderSize)
+			serializateUint32(buf, kept)
+			sw.f.Seek(int64(header.pos), io.SeekStart)
+			if _, err := sw.writeLog(batchHeaderType, buf); err != nil {
+				return err
+			}
+		}
+	}
+	if err := sw.f.Truncate(int64(cut)); err != nil {
+		return err
+	}
+	if _, err := sw.f.Seek(int64(cut), io.SeekStart); err != nil {
+		return err
+	}
+	sw.discard(n)
+	sw.acc = 0
+	if sw.flushed > n {
+		sw.flushed = n
+	}
+	return sw.f.Sync()
+}
+
 //Size 获取文件当前的写入的大小，因为writer会预分配文件大小，所以使用write offset标识写入的大小值
 func (sw *SegmentWriter) Size() int64 {
 	n, _ := sw.f.Seek(0, io.SeekCurrent)
@@ -227,21 +420,37 @@ func (sw *SegmentWriter) Size() int64 {
 
 //Flush 如果用户没有指定同步写文件操作，则需要将缓存数据回写到文件，再进行刷盘
 func (sw *SegmentWriter) Flush() error {
+	sw.writeLocker.Lock()
+	seg, count := sw.s, sw.count //刷盘前写入的条目在刷盘成功后都已持久化
 	if sw.wf&WF_SYNCWRITE != WF_SYNCWRITE {
-		sw.writeLocker.Lock()
-		err := sw.f.WriteBack()
-		sw.writeLocker.Unlock()
-		if err != nil {
+		if err := sw.f.WriteBack(); err != nil {
+			sw.writeLocker.Unlock()
 			return err
 		}
 	}
+	sw.writeLocker.Unlock()
 	err := sw.f.Sync()
 	if err == nil {
 		sw.acc = 0
+		sw.writeLocker.Lock()
+		if seg == sw.s && count > sw.flushed {
+			sw.flushed = count
+		}
+		sw.writeLocker.Unlock()
+		if sw.onFlush != nil {
+			sw.onFlush()
+		}
 	}
 	return err
 }
 
+//WriteBack 将写缓存中的数据回写到文件，使其对其他reader可见
+func (sw *SegmentWriter) WriteBack() error {
+	sw.writeLocker.Lock()
+	defer sw.writeLocker.Unlock()
+	return sw.f.WriteBack()
+}
+
 //truncate将文件大小调整至实际内容大小
 func (sw *SegmentWriter) truncate() error {
 	n, _ := sw.f.Seek(0, io.SeekCurrent)
@@ -256,17 +465,28 @@ func (sw *SegmentWriter) Close() error {
 
 type SegmentReader struct {
 	*SegmentProcessor
-	s   *Segment
-	pos []int //记录每个entry的起始位置
+	s       *Segment
+	pos     []int            //记录每个entry的起始位置
+	end     int              //最后一个完整entry之后的位置，reload时从此处继续遍历
+	corrupt map[int]struct{} //SkipCorrupt策略下跳过的损坏条目在pos中的序号
+	indexed bool             //条目是否通过偏移索引加载，此时条目未经遍历校验，读取时需校验
+	mu      sync.Mutex
 }
 
 func NewSegmentReader(s *Segment, ft FileType) (*SegmentReader, error) {
+	return newSegmentReader(s, ft, TruncateTail, nil)
+}
+
+//newSegmentReader 创建reader，加载文件时按照recovery策略处理损坏的数据，正在写入的文件需使用TruncateTail
+func newSegmentReader(s *Segment, ft FileType, recovery RecoveryPolicy, backend Backend) (*SegmentReader, error) {
 	var (
 		sr = &SegmentReader{
 			SegmentProcessor: newSegmentProcessor(procConfig{
 				segmentSize: s.Size,
 				bufferSize:  -1,
 				ft:          ft,
+				recovery:    recovery,
+				backend:     backend,
 			}),
 			s: s,
 		}
@@ -276,6 +496,7 @@ func NewSegmentReader(s *Segment, ft FileType) (*SegmentReader, error) {
 	if err = sr.open(s); err != nil {
 		return nil, err
 	}
+	sr.end = sr.base
 
 	if err = sr.loadEntries(); err != nil {
 		sr.Close()
@@ -285,38 +506,110 @@ func NewSegmentReader(s *Segment, ft FileType) (*SegmentReader, error) {
 }
 
 //loadEntries 遍历文件中所有的日志条目直至文件末尾或出现日志损坏处，将遍历的条目所在文件的pos记录在案
+//封存的文件有有效的偏移索引时直接使用索引，只从索引记录的结束位置继续遍历
 func (sr *SegmentReader) loadEntries() error {
-	call := func(ue *posEntry) bool {
-		if ue.LogEntry == nil || ue.Len == 0 || !sr.crc32Check(ue.Crc32, ue.Data) {
-			return true
+	if len(sr.pos) == 0 && sr.end == sr.base {
+		sr.loadIndex()
+	}
+	end, _, first, skipped := sr.scanEntries(sr.end, func(ue *posEntry) {
+		if ue.corrupt {
+			if sr.corrupt == nil {
+				sr.corrupt = make(map[int]struct{})
+			}
+			sr.corrupt[len(sr.pos)] = struct{}{}
 		}
-
 		sr.pos = append(sr.pos, ue.pos)
-		return false
+	})
+	sr.end = end
+	//reader不修改文件，只在FailOnCorruption策略下返回错误
+	if sr.pc.recovery == FailOnCorruption {
+		if _, err := sr.recover(sr.s, end, first, skipped); err != nil {
+			return err
+		}
 	}
-	sr.traverseLogEntries(call)
 	return nil
 }
 
+//Reload 同步文件的最新状态，并从上次遍历结束处继续加载reader创建之后写入文件的日志条目
+func (sr *SegmentReader) Reload() error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if err := sr.f.Refresh(); err != nil {
+		return err
+	}
+	//reader创建时写入者可能还未写入段头，此时需重新检测
+	if sr.header == nil && len(sr.pos) == 0 {
+		h, base, err := sr.loadHeader(sr.f, sr.s)
+		if err != nil {
+			return err
+		}
+		sr.header, sr.base, sr.end = h, base, base
+		sr.setChecksum()
+	}
+	return sr.loadEntries()
+}
+
+//setEncryptor 指定解密日志条目使用的加密器
+func (sr *SegmentReader) setEncryptor(e *Encryptor) {
+	sr.pc.encryptor = e
+	sr.f.encryptor = e
+}
+
+//readRecordByIndex 通过index读取文件中记录的日志条目，不进行解密及解压，用于校验哈希链
+func (sr *SegmentReader) readRecordByIndex(index uint64) (*LogEntry, error) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	pos := int(index - sr.s.Index)
+	if pos < 0 || pos >= len(sr.pos) {
+		return nil, ErrSegmentIndex
+	}
+	if _, corrupt := sr.corrupt[pos]; corrupt {
+		return nil, ErrCorruptEntry
+	}
+	le, err := sr.readRecordAt(sr.pos[pos])
+	if err == nil && le == nil {
+		return nil, ErrNotFound
+	}
+	return le, err
+}
+
+//readRecordAt 读取pos处文件中记录的日志条目，通过偏移索引加载的条目校验失败时返回ErrCorruptEntry
+func (sr *SegmentReader) readRecordAt(pos int) (*LogEntry, error) {
+	le, err := sr.f.ReadRecord(int64(pos))
+	if err == nil && le != nil && sr.indexed && !sr.validEntry(&posEntry{LogEntry: le, pos: pos}) {
+		return nil, ErrCorruptEntry
+	}
+	return le, err
+}
+
 //ReadLogByIndex 通过index获取到指定的日志条目
 func (sr *SegmentReader) ReadLogByIndex(index uint64) (*LogEntry, error) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
 	pos := int(index - sr.s.Index) //通过index与文件中起始条目的index差值，获取到索引值，通过索引值获取到日志在文件的位置，并读取
 	if pos < 0 || pos >= len(sr.pos) {
 		return nil, ErrSegmentIndex
 	}
-	return sr.readOneEntryFrom(sr.pos[pos], false), nil
+	if _, corrupt := sr.corrupt[pos]; corrupt {
+		return nil, ErrCorruptEntry
+	}
+	return sr.readOneEntryFrom(sr.pos[pos], false)
 }
 
 //readOneEntryFrom 从文件的pos处读取一个entry，copyData标识读取的日志是否需要copy，在有缓存层的情况下，读出的数据是缓存层的一部分，建议进行copy
 //因为缓存层会进行复用，即覆盖历史数据，异或上层用户会修改数据以影响到缓存层
-func (sr *SegmentReader) readOneEntryFrom(pos int, copyData bool) *LogEntry {
-	le, err := sr.readLog(int64(pos))
-	if err == nil && copyData {
+//压缩的条目会被解压，其数据为新分配的内存
+func (sr *SegmentReader) readOneEntryFrom(pos int, copyData bool) (*LogEntry, error) {
+	le, err := sr.readRecordAt(pos)
+	if err == nil && le != nil {
+		le, err = sr.f.restoreRecord(le)
+	}
+	if err == nil && le != nil && copyData {
 		data := make([]byte, len(le.Data))
 		copy(data, le.Data)
 		le.Data = data
 	}
-	return le
+	return le, err
 }
 
 //FirstIndex 此文件段条目的起始索引
@@ -326,27 +619,43 @@ func (sr *SegmentReader) FirstIndex() uint64 {
 
 //LastIndex 此文件段条目的结束索引
 func (sr *SegmentReader) LastIndex() uint64 {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
 	return sr.s.Index + uint64(len(sr.pos)) - 1
 }
 
 type SegmentProcessor struct {
-	f       *logfile
-	pc      procConfig //对应的段信息
-	crc32er *crc32Ctor
+	f      *logfile
+	pc     procConfig     //对应的段信息
+	summer checksumer     //当前文件的校验器
+	header *SegmentHeader //段头，老版本没有段头的文件为nil
+	base   int            //第一个日志条目在文件中的位置
 }
 
 type procConfig struct {
-	segmentSize int64    //文件预留大小
-	mapLock     bool     //内存映射使是否进行内存锁定以提高write性能
-	bufferSize  int      //缓存大小
-	ft          FileType //文件类型
+	segmentSize int64           //文件预留大小
+	mapLock     bool            //内存映射使是否进行内存锁定以提高write性能
+	bufferSize  int             //缓存大小
+	ft          FileType        //文件类型
+	writable    bool            //是否为写入者，写入者会为新文件写入段头，读取者以只读方式打开文件
+	checksum    ChecksumType    //写入者为新文件选择的校验算法
+	compression CompressionType //写入者压缩日志条目使用的算法
+	encryptor   *Encryptor      //日志条目的加密器
+	hashChain   bool            //写入者是否为新文件的日志条目添加哈希链
+	recovery    RecoveryPolicy  //检测到损坏数据的处理策略
+	backend     Backend         //文件所在的存储后端
 }
 
 func newSegmentProcessor(pc procConfig) *SegmentProcessor {
 	pc.ft = transformFileType(pc.ft)
+	if pc.backend == nil {
+		pc.backend = backendOf(pc.ft)
+	}
+	if newChecksumer(pc.checksum) == nil {
+		pc.checksum = ChecksumIEEE
+	}
 	return &SegmentProcessor{
-		pc:      pc,
-		crc32er: newCrc32er(checkSumPoly), //生成crc计算器
+		pc: pc,
 	}
 }
 
@@ -370,21 +679,93 @@ func (sp *SegmentProcessor) open(s *Segment) error {
 		}
 	}
 	//创建一个新的日志文件
-	f, err := newLogFile(s.Path, sp.pc.ft, sp.pc.segmentSize, bufsz, sp.pc.mapLock)
+	f, err := newLogFile(sp.pc.backend, s.Path, sp.pc.ft, sp.pc.segmentSize, bufsz, sp.pc.mapLock, sp.pc.writable)
 	if err != nil {
 		return err
 	}
+	//读取并校验段头
+	h, base, err := sp.loadHeader(f, s)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	f.encryptor = sp.pc.encryptor
+	if h != nil && h.HashChain {
+		f.chain = &hashChain{
+			last: h.PrevHash,
+		}
+	}
+	if sp.pc.writable && sp.pc.compression != CompressionNone {
+		if f.compressor, err = getCompressor(sp.pc.compression); err != nil {
+			f.Close()
+			return err
+		}
+	}
 	//如果processor有老的日志文件，则关闭此文件
 	if sp.f != nil {
 		sp.f.Close()
 	}
-	sp.f = f
+	sp.f, sp.header, sp.base = f, h, base
+	sp.setChecksum()
 	return nil
 }
 
-//traverseLogEntries processor会遍历读取文件中的日志，并回调call函数，call返回true则代表终止遍历
-func (sp *SegmentProcessor) traverseLogEntries(call func(*posEntry) bool) {
-	pos := 0
+//setChecksum 根据段头记录的算法生成校验器，有段头的文件校验 typ|data，没有段头的老版本文件使用IEEE多项式的crc32且只校验数据
+func (sp *SegmentProcessor) setChecksum() {
+	ct := ChecksumIEEE
+	if sp.header != nil {
+		ct = sp.header.Checksum
+	}
+	sp.summer = newChecksumer(ct)
+	sp.f.summer = sp.summer
+	sp.f.typedSum = sp.header != nil
+}
+
+//loadHeader 读取文件的段头并校验其与段信息是否一致，返回段头及第一个日志条目的位置
+//没有段头的文件如果还未写入日志条目，写入者会为其写入段头，已有日志条目的老版本文件则保持无段头的格式
+func (sp *SegmentProcessor) loadHeader(f *logfile, s *Segment) (*SegmentHeader, int, error) {
+	b, err := f.ReadRaw(0, segmentHeaderSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	if hasSegmentMagic(b) {
+		h, err := decodeSegmentHeader(b)
+		if err != nil {
+			return nil, 0, err
+		}
+		if h.SegmentID != s.ID || h.BaseIndex != s.Index {
+			return nil, 0, ErrSegmentMismatch
+		}
+		return h, h.Size, nil
+	}
+	if !sp.pc.writable || (len(b) >= lenSize && deserializeUint32(b) != 0) {
+		return nil, 0, nil
+	}
+	h := newSegmentHeader(s, sp.pc.checksum)
+	//哈希链的起点为上一个文件最后一个条目的哈希，上一个文件不带哈希链时为零值
+	if sp.pc.hashChain {
+		h.HashChain = true
+		if sp.f != nil {
+			h.PrevHash = sp.f.chain.mark()
+		}
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	if _, err = f.WriteRaw(h.encode()); err != nil {
+		return nil, 0, err
+	}
+	return h, h.Size, nil
+}
+
+//Header 返回文件的段头，老版本没有段头的文件返回nil
+func (sp *SegmentProcessor) Header() *SegmentHeader {
+	return sp.header
+}
+
+//traverseLogEntries processor会从文件的from处开始遍历读取文件中的日志，并回调call函数，call返回true则代表终止遍历
+func (sp *SegmentProcessor) traverseLogEntries(from int, call func(*posEntry) bool) {
+	pos := from
 	for {
 		le, _ := sp.readLog(int64(pos))
 		if call(&posEntry{
@@ -397,17 +778,60 @@ func (sp *SegmentProcessor) traverseLogEntries(call func(*posEntry) bool) {
 	}
 }
 
-func (sp *SegmentProcessor) writeLog(t int8, data []byte) (int, error) {
-	return sp.f.WriteLog(t, data, sp.crc32er.Checksum(data))
+//traverseValidEntries 从文件的from处开始遍历完整的日志条目并回调call，批量写入的条目只有在整批完整时才会回调，批量头不会回调
+//返回最后一个完整条目之后的文件位置，以及遍历是否终止于一个不完整的批量
+func (sp *SegmentProcessor) traverseValidEntries(from int, call func(*posEntry)) (end int, torn bool) {
+	end = from
+	var (
+		pending []*posEntry //等待整批完整的条目
+		header  *posEntry   //当前批量的批量头
+		remain  uint32      //批量中尚未读取的条目数
+	)
+	sp.traverseLogEntries(from, func(ue *posEntry) bool {
+		if !sp.validEntry(ue) {
+			torn = remain > 0
+			return true
+		}
+		next := ue.pos + ue.Len + lenSize
+		switch {
+		case remain > 0:
+			ue.batch = header
+			pending = append(pending, ue)
+			if remain--; remain > 0 {
+				return false
+			}
+			for _, pe := range pending {
+				call(pe)
+			}
+			pending = pending[:0]
+		case ue.Typ == batchHeaderType:
+			if len(ue.Data) != batchHeaderSize {
+				return true
+			}
+			header = ue
+			if remain = deserializeUint32(ue.Data); remain > 0 {
+				return false
+			}
+		default:
+			call(ue)
+		}
+		end = next
+		return false
+	})
+	return
 }
 
-func (sp *SegmentProcessor) readLog(pos int64) (*LogEntry, error) {
-	return sp.f.ReadLog(pos)
+//validEntry 检测遍历到的日志条目是否完整
+func (sp *SegmentProcessor) validEntry(ue *posEntry) bool {
+	return ue.LogEntry != nil && ue.Len != 0 && sp.f.verify(ue.LogEntry)
 }
 
-//crc32Check检测data的crc32值和传入的crc32值是否相等
-func (sp *SegmentProcessor) crc32Check(crc32 uint32, data []byte) bool {
-	return sp.crc32er.Checksum(data) == crc32
+func (sp *SegmentProcessor) writeLog(t int8, data []byte) (int, error) {
+	return sp.f.WriteLog(t, data)
+}
+
+func (sp *SegmentProcessor) readLog(pos int64) (*LogEntry, error) {
+	return sp.f.ReadRecord(pos)
 }
 
 func (sp *SegmentProcessor) closeFile() error {
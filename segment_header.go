@@ -0,0 +1,110 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package lws
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"time"
+)
+
+//段头布局(大端)：
+//	magic[4] | version[2] | headerSize[2] | checksum[1] | flags[1] | reserved[6] | segmentID[8] | baseIndex[8] | createTime[8] | prevHash[32] | reserved[4] | crc32[4]
+//headerSize记录段头的总长度，后续版本扩展段头时，老版本仍可根据headerSize定位到第一个日志条目
+//flags及reserved区域预留给之后的文件级特性，写入时置零，新增特性通过flags标记而无需升级版本
+const (
+	segmentHeaderVersion uint16 = 1
+	segmentHeaderSize           = 80
+
+	headerFlagHashChain uint8 = 1 //文件中的日志条目带有哈希链
+)
+
+var (
+	segmentMagic = []byte("LWSF")
+
+	ErrSegmentHeader   = errors.New("invalid segment header")
+	ErrSegmentVersion  = errors.New("unsupported segment format version")
+	ErrSegmentChecksum = errors.New("unsupported segment checksum algorithm")
+	ErrSegmentMismatch = errors.New("segment header does not match the segment file name")
+)
+
+//SegmentHeader 段文件的文件头，记录文件格式版本及写入时的配置，没有文件头的老版本文件其值为nil
+type SegmentHeader struct {
+	Version    uint16
+	Size       int          //段头的总长度，日志条目从此处开始
+	Checksum   ChecksumType //日志条目的校验算法
+	SegmentID  uint64
+	BaseIndex  uint64
+	CreateTime time.Time
+	HashChain  bool           //日志条目是否带有哈希链
+	PrevHash   [hashSize]byte //上一个文件最后一个条目的哈希，为哈希链在本文件的起点
+}
+
+func newSegmentHeader(s *Segment, ct ChecksumType) *SegmentHeader {
+	return &SegmentHeader{
+		Version:    segmentHeaderVersion,
+		Size:       segmentHeaderSize,
+		Checksum:   ct,
+		SegmentID:  s.ID,
+		BaseIndex:  s.Index,
+		CreateTime: time.Now(),
+	}
+}
+
+func (h *SegmentHeader) encode() []byte {
+	b := make([]byte, segmentHeaderSize)
+	copy(b, segmentMagic)
+	binary.BigEndian.PutUint16(b[4:], h.Version)
+	binary.BigEndian.PutUint16(b[6:], uint16(h.Size))
+	b[8] = byte(h.Checksum)
+	if h.HashChain {
+		b[9] |= headerFlagHashChain
+	}
+	binary.BigEndian.PutUint64(b[16:], h.SegmentID)
+	binary.BigEndian.PutUint64(b[24:], h.BaseIndex)
+	binary.BigEndian.PutUint64(b[32:], uint64(h.CreateTime.UnixNano()))
+	copy(b[40:], h.PrevHash[:])
+	binary.BigEndian.PutUint32(b[segmentHeaderSize-crc32Size:], crc32.ChecksumIEEE(b[:segmentHeaderSize-crc32Size]))
+	return b
+}
+
+//hasSegmentMagic 检测文件起始处是否为段头
+func hasSegmentMagic(b []byte) bool {
+	return len(b) >= len(segmentMagic) && bytes.Equal(b[:len(segmentMagic)], segmentMagic)
+}
+
+//decodeSegmentHeader 解析并校验段头，b需包含完整的段头
+func decodeSegmentHeader(b []byte) (*SegmentHeader, error) {
+	if len(b) < segmentHeaderSize || !hasSegmentMagic(b) {
+		return nil, ErrSegmentHeader
+	}
+	h := &SegmentHeader{
+		Version: binary.BigEndian.Uint16(b[4:]),
+		Size:    int(binary.BigEndian.Uint16(b[6:])),
+	}
+	if h.Version == 0 || h.Version > segmentHeaderVersion {
+		return nil, ErrSegmentVersion
+	}
+	if h.Size != segmentHeaderSize {
+		return nil, ErrSegmentHeader
+	}
+	if binary.BigEndian.Uint32(b[h.Size-crc32Size:]) != crc32.ChecksumIEEE(b[:h.Size-crc32Size]) {
+		return nil, ErrSegmentHeader
+	}
+	h.Checksum = ChecksumType(b[8])
+	h.SegmentID = binary.BigEndian.Uint64(b[16:])
+	h.BaseIndex = binary.BigEndian.Uint64(b[24:])
+	h.CreateTime = time.Unix(0, int64(binary.BigEndian.Uint64(b[32:])))
+	h.HashChain = b[9]&headerFlagHashChain != 0
+	copy(h.PrevHash[:], b[40:])
+	if newChecksumer(h.Checksum) == nil {
+		return nil, ErrSegmentChecksum
+	}
+	return h, nil
+}
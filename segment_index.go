@@ -0,0 +1,145 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package lws
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+//偏移索引文件布局(大端)：
+//	magic[4] | version[2] | reserved[2] | segmentID[8] | baseIndex[8] | count[8] | end[8] | offsets[8*count] | crc32[4]
+//end为最后一个日志条目之后的文件位置，offsets为每个日志条目在文件中的位置
+const (
+	indexExtension         = "idx"
+	indexVersion    uint16 = 1
+	indexHeaderSize        = 40
+	indexOffsetSize        = 8
+)
+
+var (
+	indexMagic = []byte("LWSI")
+
+	ErrIndexFile = errors.New("invalid segment index file")
+)
+
+//segmentIndex 封存的文件的偏移索引，打开文件时据此直接定位日志条目，无需遍历整个文件
+type segmentIndex struct {
+	SegmentID uint64
+	BaseIndex uint64
+	End       int
+	Offsets   []int
+}
+
+func (si *segmentIndex) encode() []byte {
+	b := make([]byte, indexHeaderSize+len(si.Offsets)*indexOffsetSize+crc32Size)
+	copy(b, indexMagic)
+	binary.BigEndian.PutUint16(b[4:], indexVersion)
+	binary.BigEndian.PutUint64(b[8:], si.SegmentID)
+	binary.BigEndian.PutUint64(b[16:], si.BaseIndex)
+	binary.BigEndian.PutUint64(b[24:], uint64(len(si.Offsets)))
+	binary.BigEndian.PutUint64(b[32:], uint64(si.End))
+	for i, off := range si.Offsets {
+		binary.BigEndian.PutUint64(b[indexHeaderSize+i*indexOffsetSize:], uint64(off))
+	}
+	binary.BigEndian.PutUint32(b[len(b)-crc32Size:], crc32.ChecksumIEEE(b[:len(b)-crc32Size]))
+	return b
+}
+
+//decodeSegmentIndex 解析并校验偏移索引，条目的位置需严格递增且位于end之前
+func decodeSegmentIndex(b []byte) (*segmentIndex, error) {
+	if len(b) < indexHeaderSize+crc32Size || !bytes.Equal(b[:len(indexMagic)], indexMagic) {
+		return nil, ErrIndexFile
+	}
+	if binary.BigEndian.Uint16(b[4:]) != indexVersion {
+		return nil, ErrIndexFile
+	}
+	count := binary.BigEndian.Uint64(b[24:])
+	if uint64(len(b)-indexHeaderSize-crc32Size) != count*indexOffsetSize {
+		return nil, ErrIndexFile
+	}
+	if binary.BigEndian.Uint32(b[len(b)-crc32Size:]) != crc32.ChecksumIEEE(b[:len(b)-crc32Size]) {
+		return nil, ErrIndexFile
+	}
+	si := &segmentIndex{
+		SegmentID: binary.BigEndian.Uint64(b[8:]),
+		BaseIndex: binary.BigEndian.Uint64(b[16:]),
+		End:       int(binary.BigEndian.Uint64(b[32:])),
+		Offsets:   make([]int, count),
+	}
+	prev := -1
+	for i := range si.Offsets {
+		off := int(binary.BigEndian.Uint64(b[indexHeaderSize+i*indexOffsetSize:]))
+		if off <= prev || off >= si.End {
+			return nil, ErrIndexFile
+		}
+		si.Offsets[i], prev = off, off
+	}
+	return si, nil
+}
+
+//loadIndex 读取文件的偏移索引，索引不存在、损坏或与文件内容不一致时返回false，由调用者遍历文件
+//为防止索引写入后文件数据丢失，会校验最后一个日志条目完整且恰好结束于索引记录的位置
+//其余条目的校验推迟到读取时进行
+func (sr *SegmentReader) loadIndex() bool {
+	b, err := storage{sr.pc.backend}.ReadFile(sidecarPath(sr.s.Path, indexExtension))
+	if err != nil {
+		return false
+	}
+	si, err := decodeSegmentIndex(b)
+	if err != nil || si.SegmentID != sr.s.ID || si.BaseIndex != sr.s.Index || len(si.Offsets) == 0 {
+		return false
+	}
+	if si.Offsets[0] < sr.base || int64(si.End) > sr.f.Size() {
+		return false
+	}
+	last := si.Offsets[len(si.Offsets)-1]
+	le, err := sr.readLog(int64(last))
+	if err != nil || !sr.validEntry(&posEntry{LogEntry: le, pos: last}) || last+le.Len+lenSize != si.End {
+		return false
+	}
+	sr.pos, sr.end, sr.indexed = si.Offsets, si.End, true
+	return true
+}
+
+//sealSegment 封存即将切换的当前文件，写入其偏移索引，开启WithMerkle时同时写入其默克尔根
+//封存前先刷盘，保证附属文件记录的条目已经持久化
+func (l *Lws) sealSegment() error {
+	if err := l.sw.Flush(); err != nil {
+		return err
+	}
+	s := l.sw.s
+	if l.opts.Merkle {
+		if err := l.writeMerkle(s); err != nil {
+			return err
+		}
+	}
+	si := l.sw.offsetIndex()
+	if si == nil {
+		return nil
+	}
+	return l.store.WriteFile(sidecarPath(s.Path, indexExtension), si.encode())
+}
+
+//offsetIndex 生成当前文件的偏移索引，文件中有跳过的损坏条目时返回nil，由reader遍历文件以识别损坏条目
+func (sw *SegmentWriter) offsetIndex() *segmentIndex {
+	sw.writeLocker.Lock()
+	defer sw.writeLocker.Unlock()
+	if sw.corrupt > 0 {
+		return nil
+	}
+	end, _ := sw.f.Seek(0, io.SeekCurrent)
+	return &segmentIndex{
+		SegmentID: sw.s.ID,
+		BaseIndex: sw.s.Index,
+		End:       int(end),
+		Offsets:   sw.pos,
+	}
+}
@@ -0,0 +1,34 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package lws
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//附属文件与wal文件同名，仅扩展名不同，不会被wal文件的命名规则匹配到
+var sidecarExtensions = []string{
+	merkleExtension,
+	indexExtension,
+}
+
+//sidecarPath 根据wal文件的路径生成扩展名为ext的附属文件路径
+func sidecarPath(segmentPath, ext string) string {
+	return strings.TrimSuffix(segmentPath, filepath.Ext(segmentPath)) + "." + ext
+}
+
+//removeSidecars 删除wal文件的所有附属文件，文件被清理、截断或重新写入时其附属文件随之失效
+func removeSidecars(store storage, segmentPath string) error {
+	for _, ext := range sidecarExtensions {
+		if err := store.Remove(sidecarPath(segmentPath, ext)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
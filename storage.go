@@ -0,0 +1,392 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package lws
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"chainmaker.org/chainmaker/lws/dsl"
+	"chainmaker.org/chainmaker/lws/file"
+)
+
+var (
+	ErrBackendExist = errors.New("this schema backend has exist")
+
+	//backends 按照DSL协议名称注册的存储后端
+	backends = struct {
+		sync.RWMutex
+		m map[string]Backend
+	}{
+		m: map[string]Backend{
+			"file": diskBackend{},
+			"mem":  memBackend{},
+		},
+	}
+)
+
+//Backend 日志文件的存储后端，wal文件及附属文件的创建、打开、查找、删除、重命名均通过其进行
+//磁盘以外的后端不支持内存映射，FT_MMAP会按照FT_NORMAL使用；目录锁只在进程内生效
+type Backend interface {
+	Create(path string) (LwsFile, error) //打开文件，不存在时创建
+	Open(path string) (LwsFile, error)   //以只读方式打开已存在的文件，不存在时返回os.ErrNotExist
+	List(dir string) ([]string, error)   //返回目录下的文件名
+	Stat(path string) (int64, error)     //返回文件的大小，文件不存在时返回os.ErrNotExist
+	Remove(path string) error
+	Rename(oldPath, newPath string) error
+}
+
+/*
+ @title: RegisterBackend
+ @description: 注册DSL协议对应的存储后端，之后即可通过Open("schema://path")在此后端上打开日志
+ @param {string} schema 协议名称，不区分大小写
+ @param {Backend} b 存储后端
+ @return {error} 协议已注册时返回ErrBackendExist
+*/
+func RegisterBackend(schema string, b Backend) error {
+	schema = strings.ToLower(schema)
+	backends.Lock()
+	defer backends.Unlock()
+	if _, ok := backends.m[schema]; ok {
+		return ErrBackendExist
+	}
+	if err := dsl.RegisterProtocol(schema); err != nil {
+		return err
+	}
+	backends.m[schema] = b
+	return nil
+}
+
+//getBackend 获取协议对应的存储后端，未注册时返回nil
+func getBackend(schema string) Backend {
+	backends.RLock()
+	defer backends.RUnlock()
+	return backends.m[schema]
+}
+
+//backendOf 没有指定后端时根据文件类型选择，FT_MEMORY的文件位于进程内的内存中，其余位于磁盘
+func backendOf(ft FileType) Backend {
+	if ft == FT_MEMORY {
+		return memBackend{}
+	}
+	return diskBackend{}
+}
+
+//dirMaker 需要预先创建目录的后端实现此接口
+type dirMaker interface {
+	MkdirAll(dir string) error
+}
+
+//dirSyncer 需要同步目录才能持久化重命名的后端实现此接口
+type dirSyncer interface {
+	SyncDir(dir string) error
+}
+
+//modTimer 能够提供文件修改时间的后端实现此接口，用于推断没有段头的老版本文件的封存时间
+type modTimer interface {
+	ModTime(path string) (time.Time, error)
+}
+
+//lockerMaker 提供跨进程目录锁的后端实现此接口，否则使用进程内的目录锁
+type lockerMaker interface {
+	Locker(path string) dirLocker
+}
+
+//dirLocker 日志目录锁，读写模式加排他锁，只读模式加共享锁
+type dirLocker interface {
+	Lock() error
+	RLock() error
+	Unlock() error
+}
+
+//storage 在Backend的基础上提供整文件的读写及拷贝，用于附属文件及隔离文件
+type storage struct {
+	Backend
+}
+
+func (s storage) MkdirAll(dir string) error {
+	if dm, ok := s.Backend.(dirMaker); ok {
+		return dm.MkdirAll(dir)
+	}
+	return nil
+}
+
+func (s storage) SyncDir(dir string) error {
+	if ds, ok := s.Backend.(dirSyncer); ok {
+		return ds.SyncDir(dir)
+	}
+	return nil
+}
+
+//ModTime 返回文件的修改时间，后端不支持或者出错时返回零值
+func (s storage) ModTime(path string) time.Time {
+	if mt, ok := s.Backend.(modTimer); ok {
+		if t, err := mt.ModTime(path); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s storage) Locker(path string) dirLocker {
+	if lm, ok := s.Backend.(lockerMaker); ok {
+		return lm.Locker(path)
+	}
+	return &memLock{
+		path: filepath.Clean(path),
+	}
+}
+
+func (s storage) ReadFile(path string) ([]byte, error) {
+	size, err := s.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := s.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b := make([]byte, size)
+	n, err := f.ReadAt(b, 0)
+	if err == io.EOF {
+		err = nil
+	}
+	return b[:n], err
+}
+
+//WriteFile 先写入临时文件并刷盘，再重命名并同步目录，保证读取者不会看到写了一半的内容，且崩溃后文件不会丢失
+func (s storage) WriteFile(path string, b []byte) error {
+	tmp := path + ".tmp"
+	f, err := s.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err = f.Truncate(0); err == nil {
+		if _, err = f.WriteAt(b, 0); err == nil {
+			err = f.Sync()
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		s.Remove(tmp)
+		return err
+	}
+	if err = s.Rename(tmp, path); err != nil {
+		return err
+	}
+	return s.SyncDir(filepath.Dir(path))
+}
+
+//CopyFile 拷贝src的前size个字节到dst
+func (s storage) CopyFile(dst, src string, size int64) error {
+	const chunk = 1 << 20
+	in, err := s.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := s.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err = out.Truncate(0); err == nil {
+		buf := make([]byte, chunk)
+		for off := int64(0); off < size && err == nil; off += chunk {
+			b := buf
+			if size-off < chunk {
+				b = buf[:size-off]
+			}
+			var n int
+			if n, err = in.ReadAt(b, off); err == io.EOF {
+				size, err = off+int64(n), nil //src不足size个字节时拷贝到其末尾
+			}
+			if err == nil {
+				_, err = out.WriteAt(b[:n], off)
+			}
+		}
+		if err == nil {
+			err = out.Sync()
+		}
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+//diskBackend 本地磁盘，file协议的后端
+type diskBackend struct{}
+
+func (diskBackend) Create(path string) (LwsFile, error) {
+	f, err := file.NewFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (diskBackend) Open(path string) (LwsFile, error) {
+	f, err := file.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (diskBackend) Stat(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+//List 只列出dir下的文件，不进入子目录，quarantine目录中的文件不会被当作日志文件
+func (diskBackend) List(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func (diskBackend) ModTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func (diskBackend) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (diskBackend) Rename(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+func (diskBackend) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, 0777)
+}
+
+func (diskBackend) SyncDir(dir string) error {
+	return syncDir(dir)
+}
+
+func (diskBackend) Locker(path string) dirLocker {
+	return NewFileLocker(path)
+}
+
+//syncDir 同步目录，使其中文件的创建及重命名持久化
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+//memBackend 进程内的内存存储，mem协议的后端，同一进程中以相同路径打开的实例共享文件，可用于模拟重启
+type memBackend struct{}
+
+func (memBackend) Create(path string) (LwsFile, error) {
+	return file.OpenMemFile(path), nil
+}
+
+func (memBackend) Open(path string) (LwsFile, error) {
+	if _, err := file.StatMemFile(path); err != nil {
+		return nil, err
+	}
+	return file.OpenMemFile(path), nil
+}
+
+func (memBackend) Stat(path string) (int64, error) {
+	return file.StatMemFile(path)
+}
+
+func (memBackend) List(dir string) ([]string, error) {
+	return file.ListMemFiles(dir), nil
+}
+
+func (memBackend) Remove(path string) error {
+	return file.RemoveMemFile(path)
+}
+
+func (memBackend) Rename(oldPath, newPath string) error {
+	return file.RenameMemFile(oldPath, newPath)
+}
+
+//memLocks 进程内目录锁的状态，值为-1表示加了排他锁，大于0为共享锁的数量
+var memLocks = struct {
+	sync.Mutex
+	held map[string]int
+}{
+	held: make(map[string]int),
+}
+
+//memLock 进程内的目录锁，与FileLock的语义一致
+type memLock struct {
+	path   string
+	shared bool
+	locked bool
+}
+
+func (ml *memLock) Lock() error {
+	return ml.lock(false)
+}
+
+func (ml *memLock) RLock() error {
+	return ml.lock(true)
+}
+
+func (ml *memLock) lock(shared bool) error {
+	memLocks.Lock()
+	defer memLocks.Unlock()
+	n := memLocks.held[ml.path]
+	if n < 0 || (n > 0 && !shared) {
+		return fmt.Errorf("%w: %s", ErrLocked, ml.path)
+	}
+	if shared {
+		memLocks.held[ml.path] = n + 1
+	} else {
+		memLocks.held[ml.path] = -1
+	}
+	ml.shared, ml.locked = shared, true
+	return nil
+}
+
+func (ml *memLock) Unlock() error {
+	memLocks.Lock()
+	defer memLocks.Unlock()
+	if !ml.locked {
+		return nil
+	}
+	ml.locked = false
+	if n := memLocks.held[ml.path]; ml.shared && n > 1 {
+		memLocks.held[ml.path] = n - 1
+	} else {
+		delete(memLocks.held, ml.path)
+	}
+	return nil
+}
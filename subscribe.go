@@ -0,0 +1,301 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package lws
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	defaultSubscribeBuffer = 1024
+)
+
+//EntryEvent 新写入的日志条目的推送事件
+type EntryEvent struct {
+	Index     uint64
+	Typ       int8
+	Data      []byte
+	Truncated bool //截断事件，索引大于Index的条目已被删除，订阅者需丢弃已收到的这些条目，之后的事件从Index+1开始
+}
+
+type subscribeOptions struct {
+	bufferSize  int  //订阅通道的缓存大小
+	block       bool //通道满时阻塞写入，默认丢弃事件
+	onlyFlushed bool //只推送已经刷盘的条目
+}
+
+type SubscribeOpt func(*subscribeOptions)
+
+//SubscribeWithBuffer 指定订阅通道的缓存大小
+func SubscribeWithBuffer(n int) SubscribeOpt {
+	return func(so *subscribeOptions) {
+		so.bufferSize = n
+	}
+}
+
+//SubscribeWithBlock 订阅通道满时事件在订阅者的队列中等待消费，不会丢弃也不会阻塞写入，默认丢弃事件
+//订阅者长时间不消费时队列会持续增长，不再需要时应及时取消订阅
+func SubscribeWithBlock() SubscribeOpt {
+	return func(so *subscribeOptions) {
+		so.block = true
+	}
+}
+
+//SubscribeWithFlushed 只在条目达到写入策略的刷盘点之后才进行推送
+func SubscribeWithFlushed() SubscribeOpt {
+	return func(so *subscribeOptions) {
+		so.onlyFlushed = true
+	}
+}
+
+//subscriber 订阅者，阻塞模式的事件先进入队列，由单独的协程推送到通道，推送不会阻塞写入者
+type subscriber struct {
+	opts  subscribeOptions
+	ch    chan EntryEvent
+	done  chan struct{} //取消订阅时关闭，以结束推送协程
+	once  sync.Once
+	mu    sync.Mutex
+	queue []EntryEvent  //阻塞模式下等待推送的事件
+	wake  chan struct{} //有事件入队时通知推送协程
+	last  uint64        //已离开队列推送给订阅者的最大索引
+}
+
+//send 推送事件，不会阻塞，非阻塞模式下通道满时丢弃事件
+func (s *subscriber) send(ev EntryEvent) {
+	if !s.opts.block {
+		select {
+		case s.ch <- ev:
+			s.last = ev.Index
+		default:
+		}
+		return
+	}
+	s.mu.Lock()
+	s.queue = append(s.queue, ev)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+//run 阻塞模式下将队列中的事件依次推送到通道，取消订阅时退出并关闭通道，未推送的事件被丢弃
+func (s *subscriber) run() {
+	defer close(s.ch)
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		ev := s.queue[0]
+		s.queue = s.queue[1:]
+		s.last = ev.Index
+		s.mu.Unlock()
+		select {
+		case s.ch <- ev:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+//subscriberSet 订阅者集合，刷盘后推送的事件在刷盘前暂存在pending中
+type subscriberSet struct {
+	mu      sync.Mutex
+	subs    []*subscriber
+	pending []EntryEvent //等待刷盘后推送的事件
+	count   int32        //订阅者数量，用于写入时快速判断是否需要生成事件
+	closed  bool         //lws已关闭，不再接受新的订阅者
+}
+
+func (ss *subscriberSet) active() bool {
+	return atomic.LoadInt32(&ss.count) > 0
+}
+
+//add 加入订阅者，lws已关闭时返回false
+func (ss *subscriberSet) add(s *subscriber) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.closed {
+		return false
+	}
+	ss.subs = append(ss.subs, s)
+	atomic.AddInt32(&ss.count, 1)
+	if s.opts.block {
+		go s.run()
+	}
+	return true
+}
+
+//remove 将订阅者从集合中删除并关闭其通道，阻塞模式的通道由推送协程退出时关闭
+func (ss *subscriberSet) remove(s *subscriber) {
+	s.once.Do(func() {
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
+		for i, v := range ss.subs {
+			if v == s {
+				ss.subs = append(ss.subs[:i], ss.subs[i+1:]...)
+				break
+			}
+		}
+		if atomic.AddInt32(&ss.count, -1) == 0 {
+			ss.pending = nil
+		}
+		close(s.done)
+		if !s.opts.block {
+			close(s.ch)
+		}
+	})
+}
+
+//removeAll 关闭时删除所有订阅者，之后的订阅直接返回已关闭的通道
+func (ss *subscriberSet) removeAll() {
+	ss.mu.Lock()
+	ss.closed = true
+	subs := append([]*subscriber(nil), ss.subs...)
+	ss.mu.Unlock()
+	for _, s := range subs {
+		ss.remove(s)
+	}
+}
+
+//publish 推送新写入的事件，flushed为当前已刷盘的索引，已刷盘的事件会同时推送给只订阅刷盘条目的订阅者
+func (ss *subscriberSet) publish(events []EntryEvent, flushed uint64) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.deliverFlushed(flushed)
+	var durable bool
+	for _, s := range ss.subs {
+		if s.opts.onlyFlushed {
+			durable = true
+			continue
+		}
+		for _, ev := range events {
+			s.send(ev)
+		}
+	}
+	if durable {
+		ss.pending = append(ss.pending, events...)
+		ss.deliverFlushed(flushed)
+	}
+}
+
+//flushed 刷盘之后，将索引不大于flushed的暂存事件推送给只订阅刷盘条目的订阅者
+func (ss *subscriberSet) flushed(flushed uint64) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.deliverFlushed(flushed)
+}
+
+func (ss *subscriberSet) deliverFlushed(flushed uint64) {
+	n := 0
+	for n < len(ss.pending) && ss.pending[n].Index <= flushed {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	for _, s := range ss.subs {
+		if !s.opts.onlyFlushed {
+			continue
+		}
+		for _, ev := range ss.pending[:n] {
+			s.send(ev)
+		}
+	}
+	ss.pending = ss.pending[n:]
+}
+
+//truncate 丢弃索引大于index的暂存事件，用于日志尾部被截断的情况，已收到被截断条目的订阅者会收到截断事件
+func (ss *subscriberSet) truncate(index uint64) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.pending = truncateEvents(ss.pending, index)
+	for _, s := range ss.subs {
+		s.truncate(index)
+	}
+}
+
+//truncate 丢弃队列中被截断的事件，被截断的事件已经推送过时推送截断事件
+func (s *subscriber) truncate(index uint64) {
+	s.mu.Lock()
+	s.queue = truncateEvents(s.queue, index)
+	sent := s.last > index
+	s.mu.Unlock()
+	if sent {
+		s.send(EntryEvent{
+			Index:     index,
+			Truncated: true,
+		})
+	}
+}
+
+//truncateEvents 丢弃events尾部索引大于index的事件
+func truncateEvents(events []EntryEvent, index uint64) []EntryEvent {
+	n := len(events)
+	for n > 0 && events[n-1].Index > index {
+		n--
+	}
+	return events[:n]
+}
+
+/*
+ @title: Subscribe
+ @description: 订阅新写入的日志条目，每个写入的条目都会生成一个事件推送到返回的通道中
+ @param {...SubscribeOpt} opt 订阅的参数配置，包括通道缓存大小、通道满时的处理策略、是否只推送刷盘的条目
+ @return {<-chan EntryEvent} 事件通道，取消订阅或lws关闭时会被关闭，lws关闭之后订阅返回已关闭的通道
+ @return {func()} 取消订阅的函数
+*/
+func (l *Lws) Subscribe(opt ...SubscribeOpt) (<-chan EntryEvent, func()) {
+	opts := subscribeOptions{
+		bufferSize: defaultSubscribeBuffer,
+	}
+	for _, o := range opt {
+		o(&opts)
+	}
+	if opts.bufferSize < 0 {
+		opts.bufferSize = 0
+	}
+	s := &subscriber{
+		opts: opts,
+		ch:   make(chan EntryEvent, opts.bufferSize),
+		done: make(chan struct{}),
+		wake: make(chan struct{}, 1),
+	}
+	if !l.subs.add(s) {
+		close(s.ch)
+		return s.ch, func() {}
+	}
+	return s.ch, func() {
+		l.subs.remove(s)
+	}
+}
+
+//publishEntries 将从first开始写入的条目推送给订阅者，数据会被拷贝，防止写入者复用数据
+func (l *Lws) publishEntries(first uint64, entries []*LogEntry) {
+	if !l.subs.active() {
+		return
+	}
+	events := make([]EntryEvent, len(entries))
+	for i, e := range entries {
+		data := make([]byte, len(e.Data))
+		copy(data, e.Data)
+		events[i] = EntryEvent{
+			Index: first + uint64(i),
+			Typ:   e.Typ,
+			Data:  data,
+		}
+	}
+	l.subs.publish(events, l.sw.FlushedIndex())
+}
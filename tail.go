@@ -0,0 +1,168 @@
+/*
+Copyright (C) BABEC. All rights reserved.
+Copyright (C) THL A29 Limited, a Tencent company. All rights reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+package lws
+
+import "context"
+
+type tailOptions struct {
+	onlyFlushed bool //只迭代已经刷盘的条目
+}
+
+type TailOpt func(*tailOptions)
+
+//TailWithFlushed tail迭代器只返回已经刷盘的日志条目
+func TailWithFlushed() TailOpt {
+	return func(to *tailOptions) {
+		to.onlyFlushed = true
+	}
+}
+
+//truncation 尾部截断的记录点，每次截断填写当前记录点并链接一个新的记录点，持有旧记录点的迭代器可以遍历之后所有的截断
+type truncation struct {
+	index uint64      //截断后保留的最后一个条目的索引
+	next  *truncation //之后的记录点，为nil表示之后没有发生截断
+}
+
+//record 记录一次截断并返回新的记录点，需持有l.mu
+func (t *truncation) record(index uint64) *truncation {
+	t.index = index
+	t.next = &truncation{}
+	return t.next
+}
+
+//tailContainer 结束索引随写入而增长的日志容器，每次读取时才短暂阻止清理程序，故长期持有不会影响日志清理
+type tailContainer struct {
+	wal   *Lws
+	first uint64
+	opts  tailOptions
+}
+
+func (tc *tailContainer) FirstIndex() uint64 {
+	return tc.first
+}
+
+func (tc *tailContainer) LastIndex() uint64 {
+	//只读模式下没有写入者，所有条目均已落盘
+	if tc.opts.onlyFlushed && tc.wal.sw != nil {
+		return tc.wal.sw.FlushedIndex()
+	}
+	return tc.wal.LastIndex()
+}
+
+func (tc *tailContainer) GetLogEntry(idx uint64) (*LogEntry, error) {
+	tc.wal.readRequest()
+	defer tc.wal.readRelease()
+	if idx < tc.wal.FirstIndex() {
+		return nil, ErrCompacted
+	}
+	sr, err := tc.wal.findReaderByIndex(idx)
+	if err != nil {
+		return nil, err
+	}
+	sr.Obtain()
+	defer sr.Release()
+	le, err := sr.ReadLogByIndex(idx)
+	if err != nil || le == nil {
+		return le, err
+	}
+	//释放之后文件可能被清理或截断，其缓冲区随之失效，故返回数据的拷贝
+	data := make([]byte, len(le.Data))
+	copy(data, le.Data)
+	return &LogEntry{
+		Len:  le.Len,
+		Sum:  le.Sum,
+		Typ:  le.Typ,
+		Data: data,
+	}, nil
+}
+
+func (tc *tailContainer) GetCoder(t int8) (Coder, error) {
+	return tc.wal.coders.GetCoder(t)
+}
+
+func (tc *tailContainer) ReaderRelease() {
+}
+
+//TailIterator 跟随写入的日志条目迭代器，迭代到最新条目后可以阻塞等待新条目的写入
+type TailIterator struct {
+	*EntryIterator
+	wal   *Lws
+	trunc *truncation //上次检测截断时的记录点
+}
+
+/*
+ @title: NewTailIterator
+ @description: 生成从from开始的跟随迭代器，回放完已有日志后可通过NextWait等待新写入的日志
+ @param {uint64} from 迭代的起始索引，可以为最新索引+1以只迭代之后写入的日志
+ @param {...TailOpt} opt 迭代器的参数配置
+ @return {*TailIterator} 跟随迭代器
+ @return {error} from小于起始索引返回ErrCompacted，from大于最新索引+1返回ErrNotFound
+*/
+func (l *Lws) NewTailIterator(from uint64, opt ...TailOpt) (*TailIterator, error) {
+	l.mu.Lock()
+	first, last, trunc := l.firstIndex, l.lastIndex, l.truncs
+	l.mu.Unlock()
+	if from < first {
+		return nil, ErrCompacted
+	}
+	if from > last+1 {
+		return nil, ErrNotFound
+	}
+	tc := &tailContainer{
+		wal:   l,
+		first: from,
+	}
+	for _, o := range opt {
+		o(&tc.opts)
+	}
+	return &TailIterator{
+		EntryIterator: newEntryIterator(tc),
+		wal:           l,
+		trunc:         trunc,
+	}, nil
+}
+
+//NextWait 返回下一个日志条目，如果已经迭代到最新条目，则阻塞等待新条目写入，ctx取消或者lws关闭时返回对应的错误
+//已返回的条目被TruncateBack删除时返回ErrTruncated，迭代器随之回退到截断处，之后从截断后新写入的条目继续迭代
+func (ti *TailIterator) NextWait(ctx context.Context) (*EntryElemnet, error) {
+	for {
+		//先获取通知通道再检测，防止检测与等待之间写入的条目无法唤醒
+		notify := ti.wal.appendNotify()
+		if err := ti.checkTruncated(); err != nil {
+			return nil, err
+		}
+		if ti.HasNext() {
+			return ti.Next(), nil
+		}
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ti.wal.closeCh:
+			return nil, ErrClosed
+		}
+	}
+}
+
+//checkTruncated 遍历上次检测之后的截断记录，截断处位于已返回的条目之前时回退迭代器并返回ErrTruncated
+func (ti *TailIterator) checkTruncated() error {
+	l := ti.wal
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	index := ti.index
+	for t := ti.trunc; t.next != nil; t = t.next {
+		if t.index < index {
+			index = t.index
+		}
+	}
+	ti.trunc = l.truncs
+	if index < ti.index {
+		ti.index = index
+		return ErrTruncated
+	}
+	return nil
+}